@@ -0,0 +1,232 @@
+package torrenty
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/metadata"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+const (
+	// defaultAnnounceInterval is the interval between regular announces when
+	// the trackers do not set one.
+	defaultAnnounceInterval = 30 * time.Minute
+
+	// eventAnnounceTimeout bounds the completed and stopped announces, which
+	// are not aborted by the shutdown of the torrent.
+	eventAnnounceTimeout = 5 * time.Second
+)
+
+// announceRetryInterval is the delay before a failed announce is retried,
+// doubled after every further failure up to the announce interval.
+var announceRetryInterval = time.Minute
+
+// announcer announces a torrent to its trackers, reporting the progress of
+// its download. The started event is sent with the first announce, the
+// completed event once the download completes and the stopped event when the
+// torrent shuts down.
+type announcer struct {
+	t *Torrent
+
+	// started is set once the trackers acknowledged the started event. last
+	// is the time of the last announce, and interval and minInterval the
+	// intervals requested by the trackers.
+	started     bool
+	last        time.Time
+	interval    time.Duration
+	minInterval time.Duration
+	failures    int
+
+	// completed is closed once the download completes, if it was not
+	// complete already when it started, and completedSent is set once the
+	// trackers acknowledged the completed event.
+	completed     chan struct{}
+	completedOnce sync.Once
+	completedSent bool
+
+	// needed signals that the download ran out of peers, so that the
+	// trackers are asked for more as soon as the min interval allows.
+	needed chan struct{}
+}
+
+// hasTrackers reports whether the torrent lists any tracker to announce to.
+func hasTrackers(m *metadata.Metadata) bool {
+	return len(m.Trackers) > 0 || m.Announce != ""
+}
+
+// announce announces the torrent to its trackers along with event, which is
+// replaced by the started event until the trackers acknowledged it. The peers
+// of every tier are handed to found, if not nil, as soon as the tier responds.
+// Announces aborted by ctx are not reported as a TrackerAnnounced event.
+func (a *announcer) announce(ctx context.Context, m *metadata.Metadata, event metadata.Event, found func([]peer.Peer)) (*metadata.Response, error) {
+	if !a.started && event == metadata.EventNone {
+		event = metadata.EventStarted
+	}
+
+	c := a.t.client
+	progress := metadata.Progress{
+		Event:      event,
+		Uploaded:   a.t.stats.Uploaded.Load(),
+		Downloaded: a.t.stats.Downloaded.Load(),
+		Left:       int64(m.Size) - a.t.stats.Completed.Load(),
+		IPv6:       c.ipv6,
+	}
+
+	a.last = time.Now()
+	res, err := m.SyncWithTrackerFunc(ctx, c.peerID, uint16(c.Port()), progress, found)
+	if ctx.Err() == nil {
+		a.t.announced(res, err)
+	}
+	if err != nil {
+		a.failures++
+		return nil, err
+	}
+
+	a.failures = 0
+	switch event {
+	case metadata.EventStarted:
+		a.started = true
+	case metadata.EventCompleted:
+		a.completedSent = true
+	}
+	a.interval = time.Duration(res.RefreshInterval) * time.Second
+	a.minInterval = time.Duration(res.MinInterval) * time.Second
+	m.SetRefreshInterval(res.RefreshInterval)
+
+	return res, nil
+}
+
+// complete signals that the download completed, so that the completed event
+// is announced.
+func (a *announcer) complete() {
+	if a.completed == nil {
+		return
+	}
+
+	a.completedOnce.Do(func() {
+		close(a.completed)
+	})
+}
+
+// need asks for an announce as soon as possible, as the download ran out of
+// peers.
+func (a *announcer) need() {
+	if a.needed == nil {
+		return
+	}
+
+	select {
+	case a.needed <- struct{}{}:
+	default:
+	}
+}
+
+// wait returns how long to wait before the next announce. Regular announces
+// are sent every interval requested by the trackers, failed ones are retried
+// sooner with an exponential backoff. Neither is sent before the min interval
+// requested by the trackers elapsed.
+func (a *announcer) wait() time.Duration {
+	interval := a.interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+
+	if a.failures > 0 {
+		retry := announceRetryInterval
+		for i := 1; i < a.failures && retry < interval; i++ {
+			retry *= 2
+		}
+		interval = min(retry, interval)
+	}
+
+	return time.Until(a.last.Add(max(interval, a.minInterval)))
+}
+
+// run announces the torrent until ctx is done, delivering the peers returned
+// by each tier of trackers to peers as soon as it responds. The completed
+// event is announced as soon as the min interval allows once the download
+// completes, and so is a regular announce once the download needs more peers.
+func (a *announcer) run(ctx context.Context, m *metadata.Metadata, peers chan<- []peer.Peer) {
+	deliver := func(found []peer.Peer) {
+		select {
+		case peers <- found:
+		case <-ctx.Done():
+		}
+	}
+
+	completed := a.completed
+	event := metadata.EventNone
+	urgent := false
+	for {
+		wait := a.wait()
+		if (urgent || event == metadata.EventCompleted) && a.failures == 0 {
+			wait = time.Until(a.last.Add(a.minInterval))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			event = metadata.EventCompleted
+			continue
+		case <-a.needed:
+			timer.Stop()
+			urgent = true
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		// The completed event is not aborted by the shutdown of the torrent,
+		// so that it is not announced a second time by stop.
+		announceCtx, cancel := ctx, context.CancelFunc(func() {})
+		if event == metadata.EventCompleted {
+			announceCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), eventAnnounceTimeout)
+		}
+		res, err := a.announce(announceCtx, m, event, deliver)
+		cancel()
+		if err != nil {
+			logger.Log(logger.Warning, "announcing to trackers failed: %s", err)
+			continue
+		}
+		logger.Log(logger.Info, "announced to trackers, got %d peers", len(res.Peers))
+		event = metadata.EventNone
+		urgent = false
+	}
+}
+
+// stop announces the stopped event to the trackers that were told about the
+// torrent, once, preceded by the completed event if the download completed
+// before it could be announced. They are sent even though ctx is done, as the
+// torrent shuts down.
+func (a *announcer) stop(ctx context.Context, m *metadata.Metadata) {
+	if !a.started {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), eventAnnounceTimeout)
+	defer cancel()
+
+	if a.completed != nil && !a.completedSent {
+		select {
+		case <-a.completed:
+			_, err := a.announce(ctx, m, metadata.EventCompleted, nil)
+			if err != nil {
+				logger.Log(logger.Warning, "announcing completion to trackers failed: %s", err)
+			}
+		default:
+		}
+	}
+
+	_, err := a.announce(ctx, m, metadata.EventStopped, nil)
+	if err != nil {
+		logger.Log(logger.Warning, "announcing stop to trackers failed: %s", err)
+	}
+	a.started = false
+}
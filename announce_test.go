@@ -0,0 +1,65 @@
+package torrenty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnnouncerWait(t *testing.T) {
+	tests := map[string]struct {
+		interval    time.Duration
+		minInterval time.Duration
+		failures    int
+		want        time.Duration
+	}{
+		"should wait for the default interval when the trackers set none": {
+			want: defaultAnnounceInterval,
+		},
+		"should wait for the interval of the trackers": {
+			interval: 10 * time.Minute,
+			want:     10 * time.Minute,
+		},
+		"should not announce before the min interval": {
+			interval:    time.Minute,
+			minInterval: 2 * time.Minute,
+			want:        2 * time.Minute,
+		},
+		"should retry a failed announce sooner": {
+			interval: 10 * time.Minute,
+			failures: 1,
+			want:     announceRetryInterval,
+		},
+		"should back off after repeated failures": {
+			interval: 10 * time.Minute,
+			failures: 3,
+			want:     4 * announceRetryInterval,
+		},
+		"should retry at least every interval": {
+			interval: 10 * time.Minute,
+			failures: 50,
+			want:     10 * time.Minute,
+		},
+		"should not retry before the min interval": {
+			interval:    10 * time.Minute,
+			minInterval: 5 * time.Minute,
+			failures:    1,
+			want:        5 * time.Minute,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := &announcer{
+				last:        time.Now(),
+				interval:    test.interval,
+				minInterval: test.minInterval,
+				failures:    test.failures,
+			}
+
+			got := a.wait()
+			if got > test.want || got < test.want-time.Second {
+				t.Errorf("expected to wait %s, got %s", test.want, got)
+			}
+		})
+	}
+}
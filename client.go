@@ -0,0 +1,300 @@
+package torrenty
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/xanish/torrenty/internal/dht"
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/magnet"
+	"github.com/xanish/torrenty/internal/metadata"
+	"github.com/xanish/torrenty/internal/peer"
+	"github.com/xanish/torrenty/internal/utility"
+)
+
+const (
+	clientVersion = "torrenty"
+
+	// defaultMaxPeerRequests is the number of outstanding requests advertised
+	// to peers in the extended handshake unless configured otherwise.
+	defaultMaxPeerRequests = 250
+)
+
+// Options configures a Client. The zero value is ready to use.
+type Options struct {
+	// Port is the port peers connect to, which is announced to trackers. A
+	// free port is picked when zero.
+	Port int
+
+	// PeerID identifies the client to trackers and peers. A random one is
+	// generated when zero.
+	PeerID [20]byte
+
+	// DataDir is the directory torrents are downloaded to. Defaults to the
+	// working directory.
+	DataDir string
+
+	// Logger receives the log output when set. The log output is shared by
+	// every Client of the process, so a nil Logger leaves it untouched, going
+	// to the standard logger unless another Client set one.
+	Logger *log.Logger
+
+	// MaxRequests is the number of block requests kept in flight per peer,
+	// 10 when zero.
+	MaxRequests int
+
+	// MaxPeers is the number of peers a torrent connects to at once, 30 when
+	// zero.
+	MaxPeers int
+
+	// PreferIPv6 connects to peers over IPv6 rather than IPv4 when both are
+	// available.
+	PreferIPv6 bool
+
+	// MaxPeerRequests is the number of block requests a peer may queue with
+	// us, 250 when zero.
+	MaxPeerRequests int
+
+	// Seed keeps torrents seeding once complete, until they are removed.
+	Seed bool
+
+	// DHT looks up the peers of torrents on the mainline DHT next to asking
+	// their trackers, with a DHT node listening on the UDP port of the same
+	// number as Port.
+	DHT bool
+
+	// DHTBootstrap lists the host:port addresses of the nodes the DHT is
+	// joined through, well-known public nodes when empty.
+	DHTBootstrap []string
+
+	// DHTStatePath is where the routing table of the DHT node is saved when
+	// the client is closed, and restored from when it is created, if set.
+	DHTStatePath string
+
+	// Progress draws a progress bar of each download on stderr.
+	Progress bool
+}
+
+// Client downloads and seeds torrents, accepting connections from peers on a
+// single port shared by all of them.
+type Client struct {
+	opts     Options
+	peerID   [20]byte
+	listener *peer.Listener
+
+	// ipv6 is the global IPv6 address announced to trackers, nil if the host
+	// has none.
+	ipv6 net.IP
+
+	// dht is the DHT node of the client, nil unless Options.DHT is set.
+	// dhtJoined is closed once it is done joining the DHT, which dhtStop
+	// aborts.
+	dht       *dht.Server
+	dhtJoined chan struct{}
+	dhtStop   context.CancelFunc
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	closed   bool
+}
+
+// NewClient returns a Client configured with opts, listening for peers on
+// opts.Port.
+func NewClient(opts Options) (*Client, error) {
+	if opts.Logger != nil {
+		logger.SetLogger(opts.Logger)
+	}
+
+	if opts.MaxPeerRequests <= 0 {
+		opts.MaxPeerRequests = defaultMaxPeerRequests
+	}
+
+	peerID := opts.PeerID
+	if peerID == [20]byte{} {
+		var err error
+		peerID, err = utility.PeerID()
+		if err != nil {
+			return nil, err
+		}
+		logger.Log(logger.Info, "generated peer id %x", peerID)
+	}
+
+	l, err := peer.Listen(opts.Port, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := peer.GlobalIPv6()
+	if ipv6 != nil {
+		logger.Log(logger.Info, "announcing ipv6 address %s", ipv6)
+	}
+
+	c := &Client{
+		opts:     opts,
+		peerID:   peerID,
+		listener: l,
+		ipv6:     ipv6,
+		torrents: make(map[[20]byte]*Torrent),
+	}
+
+	if opts.DHT {
+		err = c.startDHT()
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// PeerID returns the peer id of the client.
+func (c *Client) PeerID() [20]byte {
+	return c.peerID
+}
+
+// Port returns the port the client accepts connections from peers on.
+func (c *Client) Port() int {
+	return c.listener.Port()
+}
+
+// AddTorrent starts downloading the torrent described by the .torrent file
+// read from r. Cancelling ctx stops the torrent like removing it does.
+func (c *Client) AddTorrent(ctx context.Context, r io.Reader) (*Torrent, error) {
+	logger.Log(logger.Info, "parsing torrent file metadata")
+	torrent, err := metadata.New(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTorrent(ctx, c, torrent.InfoHash, torrent.Name, torrent.Size, Checking)
+	err = c.add(t)
+	if err != nil {
+		return nil, err
+	}
+
+	go t.run(func() error {
+		return t.download(torrent)
+	})
+
+	return t, nil
+}
+
+// AddMagnet starts downloading the torrent referred to by a magnet uri. Its
+// info dictionary is first fetched from peers found via the trackers and peer
+// addresses listed in the uri. Cancelling ctx stops the torrent like removing
+// it does.
+func (c *Client) AddMagnet(ctx context.Context, uri string) (*Torrent, error) {
+	logger.Log(logger.Info, "parsing magnet uri")
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTorrent(ctx, c, m.InfoHash, m.Name, 0, FetchingMetadata)
+	err = c.add(t)
+	if err != nil {
+		return nil, err
+	}
+
+	go t.run(func() error {
+		return t.downloadMagnet(m)
+	})
+
+	return t, nil
+}
+
+// Torrent returns the torrent identified by infoHash, if it was added.
+func (c *Client) Torrent(infoHash [20]byte) (*Torrent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.torrents[infoHash]
+
+	return t, ok
+}
+
+// Torrents returns every torrent added to the client.
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+
+	return torrents
+}
+
+// Remove stops the torrent identified by infoHash and waits for it to shut
+// down, or for ctx to be done. Downloaded data is kept so that the torrent can
+// be resumed later.
+func (c *Client) Remove(ctx context.Context, infoHash [20]byte) error {
+	c.mu.Lock()
+	t, ok := c.torrents[infoHash]
+	delete(c.torrents, infoHash)
+	c.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no torrent with infohash %x", infoHash)
+	}
+
+	t.stop()
+	select {
+	case <-t.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close removes every torrent and stops accepting connections from peers, and
+// stops the DHT node.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	torrents := c.torrents
+	c.torrents = make(map[[20]byte]*Torrent)
+	c.mu.Unlock()
+
+	for _, t := range torrents {
+		t.stop()
+	}
+	for _, t := range torrents {
+		<-t.Done()
+	}
+
+	if c.dht != nil {
+		c.closeDHT()
+	}
+
+	return c.listener.Close()
+}
+
+// add registers t with the client, unless the client is closed or a torrent
+// with the same info-hash was added already. The context of a torrent that is
+// not added is cancelled with the error.
+func (c *Client) add(t *Torrent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	if c.closed {
+		err = fmt.Errorf("client is closed")
+	} else if _, ok := c.torrents[t.infoHash]; ok {
+		err = fmt.Errorf("torrent with infohash %x already added", t.infoHash)
+	}
+	if err != nil {
+		// the torrent never runs, its context is released right away
+		t.cancel(err)
+		return err
+	}
+	c.torrents[t.infoHash] = t
+
+	return nil
+}
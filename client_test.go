@@ -0,0 +1,370 @@
+package torrenty
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// testTorrentFile returns a .torrent file for content split in pieces of
+// pieceLength bytes, announcing to announce.
+func testTorrentFile(t *testing.T, name string, content []byte, pieceLength int, announce string) []byte {
+	t.Helper()
+
+	var pieces []byte
+	for begin := 0; begin < len(content); begin += pieceLength {
+		sum := sha1.Sum(content[begin:min(begin+pieceLength, len(content))])
+		pieces = append(pieces, sum[:]...)
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"announce": announce,
+		"info": map[string]interface{}{
+			"name":         name,
+			"length":       len(content),
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// testTracker is an HTTP tracker returning the peer listening on seederPort to
+// every other peer, and recording the announces it receives.
+type testTracker struct {
+	url        string
+	seederPort func() int
+
+	mu        sync.Mutex
+	announces []url.Values
+}
+
+func startTracker(t *testing.T, seederPort func() int) *testTracker {
+	t.Helper()
+
+	tr := &testTracker{seederPort: seederPort}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.Lock()
+		tr.announces = append(tr.announces, r.URL.Query())
+		tr.mu.Unlock()
+
+		var peers string
+		if port := tr.seederPort(); r.URL.Query().Get("port") != strconv.Itoa(port) {
+			peers = string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)})
+		}
+
+		_ = bencode.Marshal(w, map[string]interface{}{"interval": 1, "peers": peers})
+	}))
+	t.Cleanup(srv.Close)
+	tr.url = srv.URL + "/announce"
+
+	return tr
+}
+
+// announcesFrom returns the announces received from the peer listening on
+// port.
+func (tr *testTracker) announcesFrom(port int) []url.Values {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	var announces []url.Values
+	for _, a := range tr.announces {
+		if a.Get("port") == strconv.Itoa(port) {
+			announces = append(announces, a)
+		}
+	}
+
+	return announces
+}
+
+func TestClientDownloadsFromSeedingClient(t *testing.T) {
+	content := make([]byte, 100*1024+17)
+	rand.Read(content)
+
+	var seeder *Client
+	tracker := startTracker(t, func() int {
+		return seeder.Port()
+	})
+	torrentFile := testTorrentFile(t, "file.bin", content, 32*1024, tracker.url)
+
+	seedDir, leechDir := t.TempDir(), t.TempDir()
+	err := os.WriteFile(filepath.Join(seedDir, "file.bin"), content, 0666)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	seeder, err = NewClient(Options{DataDir: seedDir, Seed: true})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *Client) {
+		_ = c.Close()
+	}(seeder)
+
+	seeding, err := seeder.AddTorrent(context.Background(), bytes.NewReader(torrentFile))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if _, err := seeder.AddTorrent(context.Background(), bytes.NewReader(torrentFile)); err == nil {
+		t.Errorf("expected adding the same torrent twice to fail")
+	}
+
+	// peers of a torrent are only accepted once it is checked and registered
+	// with the listener
+	for deadline := time.Now().Add(5 * time.Second); seeding.Stats().State != Seeding; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the seeder to start seeding")
+		}
+	}
+
+	leecher, err := NewClient(Options{DataDir: leechDir})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *Client) {
+		_ = c.Close()
+	}(leecher)
+
+	leeching, err := leecher.AddTorrent(context.Background(), bytes.NewReader(torrentFile))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if leeching.Name() != "file.bin" || leeching.Size() != len(content) {
+		t.Errorf("expected torrent file.bin of %d bytes, got %s of %d bytes", len(content), leeching.Name(), leeching.Size())
+	}
+
+	events := make(chan []Event, 1)
+	go func() {
+		var received []Event
+		for e := range leeching.Events() {
+			received = append(received, e)
+		}
+		events <- received
+	}()
+
+	select {
+	case <-leeching.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the download to complete")
+	}
+	if err := leeching.Wait(context.Background()); err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(leechDir, "file.bin"))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+
+	var (
+		states   []State
+		verified int
+		counts   = make(map[EventType]int)
+	)
+	for _, e := range <-events {
+		counts[e.Type]++
+		switch e.Type {
+		case StateChanged:
+			states = append(states, e.State)
+		case PieceVerified:
+			verified++
+		case TrackerAnnounced:
+			if e.Err != nil || e.Peers != 1 {
+				t.Errorf("expected the announce to return the seeder, got %d peers and %v", e.Peers, e.Err)
+			}
+		}
+	}
+	if want := []State{Checking, Downloading, Stopped}; !slices.Equal(states, want) {
+		t.Errorf("expected states %v, got %v", want, states)
+	}
+	if verified != 4 || counts[Completed] != 1 || counts[PeerConnected] == 0 || counts[TrackerAnnounced] == 0 {
+		t.Errorf("expected 4 verified pieces, a completion, a peer and an announce, got %v", counts)
+	}
+
+	// the leecher announced its start, completion and shutdown along with its
+	// progress
+	announces := tracker.announcesFrom(leecher.Port())
+	var announced []string
+	for _, a := range announces {
+		if a.Get("event") != "" {
+			announced = append(announced, a.Get("event"))
+		}
+	}
+	if want := []string{"started", "completed", "stopped"}; !slices.Equal(announced, want) {
+		t.Errorf("expected events %v to be announced, got %v", want, announced)
+	}
+	if first := announces[0]; first.Get("left") != strconv.Itoa(len(content)) || first.Get("downloaded") != "0" {
+		t.Errorf("expected the first announce to have everything left, got %v", first)
+	}
+	if last := announces[len(announces)-1]; last.Get("left") != "0" || last.Get("downloaded") != strconv.Itoa(len(content)) {
+		t.Errorf("expected the last announce to have everything downloaded, got %v", last)
+	}
+
+	stats := leeching.Stats()
+	if stats.State != Stopped || stats.Completed != int64(len(content)) || stats.Downloaded < int64(len(content)) || stats.ETA != 0 {
+		t.Errorf("expected the stopped torrent to have downloaded %d bytes, got %+v", len(content), stats)
+	}
+	if stats := seeding.Stats(); stats.State != Seeding || stats.Uploaded < int64(len(content)) {
+		t.Errorf("expected the seeder to have uploaded %d bytes, got %+v", len(content), stats)
+	}
+
+	// the seeder announces again once the interval of the tracker elapsed,
+	// reporting what it uploaded
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		announces := tracker.announcesFrom(seeder.Port())
+		if last := announces[len(announces)-1]; len(announces) > 1 && last.Get("uploaded") == strconv.Itoa(len(content)) {
+			if last.Get("event") != "" {
+				t.Errorf("expected a regular announce to carry no event, got %q", last.Get("event"))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the seeder to announce again")
+		}
+	}
+
+	// the seeding torrent keeps running until removed
+	if _, ok := seeder.Torrent(seeding.InfoHash()); !ok {
+		t.Errorf("expected the seeding torrent to still be running")
+	}
+	err = seeder.Remove(context.Background(), seeding.InfoHash())
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if err := seeding.Wait(context.Background()); err != nil {
+		t.Errorf("expected a complete torrent to stop cleanly, got %v", err)
+	}
+	if len(seeder.Torrents()) != 0 {
+		t.Errorf("expected no torrent to be left after removal")
+	}
+	if err := seeder.Remove(context.Background(), seeding.InfoHash()); err == nil {
+		t.Errorf("expected removing an unknown torrent to fail")
+	}
+}
+
+func TestClientReportsTrackerErrors(t *testing.T) {
+	c, err := NewClient(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *Client) {
+		_ = c.Close()
+	}(c)
+
+	content := make([]byte, 1024)
+	rand.Read(content)
+	torrentFile := testTorrentFile(t, "file.bin", content, 512, "http://127.0.0.1:1/announce")
+	tr, err := c.AddTorrent(context.Background(), bytes.NewReader(torrentFile))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	select {
+	case <-tr.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the torrent to stop")
+	}
+	if err := tr.Wait(context.Background()); err == nil {
+		t.Errorf("expected the unreachable tracker to be reported")
+	}
+}
+
+func TestClientTorrentStopsWithContext(t *testing.T) {
+	// the tracker never answers, so the torrent only stops once cancelled
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *Client) {
+		_ = c.Close()
+	}(c)
+
+	content := make([]byte, 1024)
+	rand.Read(content)
+	torrentFile := testTorrentFile(t, "file.bin", content, 512, srv.URL+"/announce")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tr, err := c.AddTorrent(ctx, bytes.NewReader(torrentFile))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer waitCancel()
+	if err := tr.Wait(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected waiting to time out while the torrent runs, got %v", err)
+	}
+
+	cancel()
+	select {
+	case <-tr.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the torrent to stop once cancelled")
+	}
+
+	err = tr.Wait(context.Background())
+	if !errors.Is(err, ErrStopped) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the torrent to be stopped by the cancelled context, got %v", err)
+	}
+	if _, ok := c.Torrent(tr.InfoHash()); ok {
+		t.Errorf("expected the stopped torrent to be removed from the client")
+	}
+}
+
+func TestClientRejectsDuplicateTorrent(t *testing.T) {
+	c, err := NewClient(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *Client) {
+		_ = c.Close()
+	}(c)
+
+	content := make([]byte, 1024)
+	rand.Read(content)
+	torrentFile := testTorrentFile(t, "file.bin", content, 512, "http://127.0.0.1:1/announce")
+
+	tr, err := c.AddTorrent(context.Background(), bytes.NewReader(torrentFile))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	_, err = c.AddTorrent(context.Background(), bytes.NewReader(torrentFile))
+	if err == nil {
+		t.Fatalf("expected adding the torrent twice to fail")
+	}
+
+	// the context of the torrent that was not added is released
+	dup := newTorrent(context.Background(), c, tr.InfoHash(), "file.bin", len(content), Checking)
+	err = c.add(dup)
+	if err == nil || dup.ctx.Err() == nil {
+		t.Errorf("expected the context of the duplicate torrent to be cancelled, got %v", err)
+	}
+}
@@ -1,22 +1,134 @@
 package main
 
 import (
-	"github.com/xanish/torrenty"
+	"context"
+	"flag"
+	"fmt"
+	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+
+	"github.com/xanish/torrenty"
 )
 
 func main() {
-	torrentPath := os.Args[1]
+	seed := flag.Bool("seed", false, "keep seeding after the download completes, until interrupted")
+	port := flag.Int("port", 6881, "port to accept connections from peers on")
+	preferIPv6 := flag.Bool("prefer-ipv6", false, "connect to peers over ipv6 rather than ipv4 when both are available")
+	useDHT := flag.Bool("dht", true, "look up peers on the dht, on the udp port of the same number as -port")
+	flag.Parse()
+
+	var err error
+	if flag.Arg(0) == "info" {
+		err = info(flag.Arg(1))
+	} else {
+		err = run(flag.Arg(0), *port, *seed, *preferIPv6, *useDHT)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(torrentPath string, port int, seed, preferIPv6, useDHT bool) error {
 	downloadPath, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
 
-	file, err := os.Open(torrentPath)
+	logFile, err := os.OpenFile(filepath.Join(downloadPath, "process.log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to open log file: %w", err)
 	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(logFile)
 
-	err = torrenty.Download(file, downloadPath+"/")
+	client, err := torrenty.NewClient(torrenty.Options{
+		Port:         port,
+		DataDir:      downloadPath,
+		Logger:       log.New(logFile, "", log.LstdFlags),
+		Seed:         seed,
+		PreferIPv6:   preferIPv6,
+		DHT:          useDHT,
+		DHTStatePath: filepath.Join(downloadPath, "dht.dat"),
+		Progress:     true,
+	})
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer func(c *torrenty.Client) {
+		_ = c.Close()
+	}(client)
+
+	// Interrupting stops the torrent, saving its progress so that the next
+	// run resumes it.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var t *torrenty.Torrent
+	if strings.HasPrefix(torrentPath, "magnet:") {
+		t, err = client.AddMagnet(ctx, torrentPath)
+	} else {
+		var file *os.File
+		file, err = os.Open(torrentPath)
+		if err != nil {
+			return err
+		}
+		defer func(f *os.File) {
+			_ = f.Close()
+		}(file)
+
+		t, err = client.AddTorrent(ctx, file)
 	}
+	if err != nil {
+		return err
+	}
+
+	return t.Wait(context.Background())
+}
+
+// info prints the torrent at torrentPath, a .torrent file or a magnet link,
+// along with the number of seeders and leechers its trackers report.
+func info(torrentPath string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var ti *torrenty.TorrentInfo
+	var err error
+	if strings.HasPrefix(torrentPath, "magnet:") {
+		ti, err = torrenty.ScrapeMagnet(ctx, torrentPath)
+	} else {
+		var file *os.File
+		file, err = os.Open(torrentPath)
+		if err != nil {
+			return err
+		}
+		defer func(f *os.File) {
+			_ = f.Close()
+		}(file)
+
+		ti, err = torrenty.Scrape(ctx, file)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name:      %s\n", ti.Name)
+	fmt.Printf("Info hash: %x\n", ti.InfoHash)
+	if ti.Size > 0 {
+		fmt.Printf("Size:      %d bytes in %d pieces\n", ti.Size, ti.Pieces)
+	}
+	fmt.Println("Trackers:")
+	for _, tr := range ti.Trackers {
+		if tr.Err != nil {
+			fmt.Printf("  %s: %s\n", tr.URL, tr.Err)
+			continue
+		}
+		fmt.Printf("  %s: %d seeders, %d leechers, downloaded %d times\n", tr.URL, tr.Seeders, tr.Leechers, tr.Completed)
+	}
+
+	return nil
 }
@@ -0,0 +1,175 @@
+package torrenty
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/xanish/torrenty/internal/dht"
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+var (
+	// dhtAnnounceInterval is the interval between the lookups of the peers
+	// of a torrent on the DHT, which announce the torrent as well.
+	dhtAnnounceInterval = 15 * time.Minute
+
+	// dhtRetryInterval is the delay before a lookup that failed or found no
+	// peer is run again.
+	dhtRetryInterval = time.Minute
+)
+
+// startDHT starts the DHT node of the client, on the UDP port of the same
+// number as the port peers connect to, with the routing table saved at
+// DHTStatePath. The DHT is joined in the background.
+func (c *Client) startDHT() error {
+	var state *dht.State
+	if c.opts.DHTStatePath != "" {
+		st, err := dht.LoadState(c.opts.DHTStatePath)
+		if err == nil {
+			state = st
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			logger.Log(logger.Warning, "starting with an empty dht routing table: %s", err)
+		}
+	}
+
+	node, err := dht.Listen(c.Port(), state)
+	if err != nil {
+		return err
+	}
+
+	bootstrap := c.opts.DHTBootstrap
+	if len(bootstrap) == 0 {
+		bootstrap = dht.DefaultBootstrap
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.dht = node
+	c.dhtStop = cancel
+	c.dhtJoined = make(chan struct{})
+	go func() {
+		defer close(c.dhtJoined)
+
+		err := node.Bootstrap(ctx, bootstrap)
+		if err != nil {
+			logger.Log(logger.Warning, "joining the dht failed: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// closeDHT stops the DHT node of the client, saving its routing table to
+// DHTStatePath.
+func (c *Client) closeDHT() {
+	c.dhtStop()
+	<-c.dhtJoined
+
+	if c.opts.DHTStatePath != "" {
+		err := c.dht.State().Save(c.opts.DHTStatePath)
+		if err != nil {
+			logger.Log(logger.Warning, "failed to save dht state: %s", err)
+		}
+	}
+
+	_ = c.dht.Close()
+}
+
+// joinedDHT waits for the DHT node of the client to be done joining the DHT.
+// It reports false if ctx is done first.
+func (c *Client) joinedDHT(ctx context.Context) bool {
+	select {
+	case <-c.dhtJoined:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// dhtSearch looks up the peers of a torrent on the DHT, announcing that we
+// accept connections for it.
+type dhtSearch struct {
+	t *Torrent
+
+	// needed signals that the download ran out of peers, so that they are
+	// looked up again right away.
+	needed chan struct{}
+}
+
+// need asks for a lookup as soon as possible, as the download ran out of
+// peers.
+func (d *dhtSearch) need() {
+	if d.needed == nil {
+		return
+	}
+
+	select {
+	case d.needed <- struct{}{}:
+	default:
+	}
+}
+
+// run looks up the peers of the torrent identified by infoHash until ctx is
+// done, delivering them to peers. Lookups run every dhtAnnounceInterval, or
+// every dhtRetryInterval while they fail or find no peer, and right away once
+// the download needs more peers.
+func (d *dhtSearch) run(ctx context.Context, infoHash [20]byte, peers chan<- []peer.Peer) {
+	c := d.t.client
+	if !c.joinedDHT(ctx) {
+		return
+	}
+
+	for {
+		wait := dhtAnnounceInterval
+		found, err := c.dht.Announce(ctx, infoHash, c.Port())
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Log(logger.Warning, "looking up peers on the dht failed: %s", err)
+			wait = dhtRetryInterval
+		} else {
+			logger.Log(logger.Info, "found %d peers on the dht", len(found))
+			if len(found) == 0 {
+				wait = dhtRetryInterval
+			}
+		}
+
+		if len(found) > 0 {
+			select {
+			case peers <- found:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.needed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// mergePeers appends the peers of more that are not in peers yet.
+func mergePeers(peers, more []peer.Peer) []peer.Peer {
+	seen := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		seen[p.String()] = true
+	}
+
+	for _, p := range more {
+		if !seen[p.String()] {
+			seen[p.String()] = true
+			peers = append(peers, p)
+		}
+	}
+
+	return peers
+}
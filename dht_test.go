@@ -0,0 +1,96 @@
+package torrenty
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xanish/torrenty/internal/dht"
+)
+
+func TestClientFindsPeersOnDHT(t *testing.T) {
+	defer func(d time.Duration) {
+		dhtRetryInterval = d
+	}(dhtRetryInterval)
+	dhtRetryInterval = 100 * time.Millisecond
+
+	router, err := dht.Listen(0, nil)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(s *dht.Server) {
+		_ = s.Close()
+	}(router)
+	bootstrap := []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(router.Port()))}
+
+	// the tracker is unreachable, so peers are only found on the dht
+	content := make([]byte, 64*1024+5)
+	rand.Read(content)
+	torrentFile := testTorrentFile(t, "file.bin", content, 16*1024, "http://127.0.0.1:1/announce")
+
+	seedDir, leechDir := t.TempDir(), t.TempDir()
+	err = os.WriteFile(filepath.Join(seedDir, "file.bin"), content, 0666)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	seeder, err := NewClient(Options{DataDir: seedDir, Seed: true, DHT: true, DHTBootstrap: bootstrap})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *Client) {
+		_ = c.Close()
+	}(seeder)
+
+	_, err = seeder.AddTorrent(context.Background(), bytes.NewReader(torrentFile))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	statePath := filepath.Join(leechDir, "dht.dat")
+	leecher, err := NewClient(Options{DataDir: leechDir, DHT: true, DHTBootstrap: bootstrap, DHTStatePath: statePath})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	leeching, err := leecher.AddTorrent(context.Background(), bytes.NewReader(torrentFile))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	select {
+	case <-leeching.Done():
+	case <-time.After(20 * time.Second):
+		t.Fatalf("expected the download to complete")
+	}
+	if err := leeching.Wait(context.Background()); err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(leechDir, "file.bin"))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+
+	// the routing table is saved on close
+	err = leecher.Close()
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	st, err := dht.LoadState(statePath)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if len(st.ID) != 20 || len(st.Nodes) == 0 {
+		t.Errorf("expected the dht state to hold the node id and the known nodes, got %q", st)
+	}
+}
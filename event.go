@@ -0,0 +1,159 @@
+package torrenty
+
+import (
+	"net"
+
+	"github.com/xanish/torrenty/internal/downloader"
+)
+
+// eventBuffer is the number of events buffered by Torrent.Events for a slow
+// reader, further events are dropped until it catches up.
+const eventBuffer = 256
+
+// State is the stage a torrent is in.
+type State int
+
+const (
+	// FetchingMetadata is the state of a magnet link whose info dictionary
+	// is being fetched from peers.
+	FetchingMetadata State = iota
+	// Checking is the state of a torrent whose existing data is verified.
+	Checking
+	// Downloading is the state of a torrent fetching pieces from peers.
+	Downloading
+	// Seeding is the state of a complete torrent uploading to peers.
+	Seeding
+	// Stopped is the state of a torrent that completed, failed or was
+	// removed.
+	Stopped
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case FetchingMetadata:
+		return "fetching metadata"
+	case Checking:
+		return "checking"
+	case Downloading:
+		return "downloading"
+	case Seeding:
+		return "seeding"
+	case Stopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// PieceVerified is emitted once a downloaded piece matched its hash and
+	// was written to disk.
+	PieceVerified EventType = iota
+	// PieceFailed is emitted when a downloaded piece did not match its hash
+	// and has to be downloaded again.
+	PieceFailed
+	// PeerConnected is emitted when a connection to a peer is established.
+	PeerConnected
+	// PeerDisconnected is emitted when a connection to a peer is closed.
+	PeerDisconnected
+	// TrackerAnnounced is emitted with the result of announcing to the
+	// trackers of the torrent.
+	TrackerAnnounced
+	// StateChanged is emitted when the torrent enters a new State.
+	StateChanged
+	// Completed is emitted once every piece of the torrent is on disk.
+	Completed
+)
+
+// String returns the name of the event type.
+func (e EventType) String() string {
+	switch e {
+	case PieceVerified:
+		return "piece verified"
+	case PieceFailed:
+		return "piece failed"
+	case PeerConnected:
+		return "peer connected"
+	case PeerDisconnected:
+		return "peer disconnected"
+	case TrackerAnnounced:
+		return "tracker announced"
+	case StateChanged:
+		return "state changed"
+	case Completed:
+		return "completed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened to a torrent, delivered by Torrent.Events.
+type Event struct {
+	Type EventType
+
+	// Piece is the index of the piece of PieceVerified and PieceFailed
+	// events.
+	Piece int
+
+	// Peer is the address of the peer of PeerConnected and PeerDisconnected
+	// events, and of the peer a PieceFailed piece was downloaded from.
+	Peer string
+
+	// Peers is the number of peers returned by the trackers, and Err the
+	// error the announce failed with, for TrackerAnnounced events.
+	Peers int
+	Err   error
+
+	// State is the state entered, for StateChanged events.
+	State State
+}
+
+// emit delivers e to the reader of the events of the torrent, dropping it if
+// the buffer is full.
+func (t *Torrent) emit(e Event) {
+	select {
+	case t.events <- e:
+	default:
+	}
+}
+
+// setState records the state the torrent entered and emits a StateChanged
+// event.
+func (t *Torrent) setState(state State) {
+	t.mu.Lock()
+	t.state = state
+	t.mu.Unlock()
+
+	t.emit(Event{Type: StateChanged, State: state})
+}
+
+// downloadEvent translates the events of the downloader.
+func (t *Torrent) downloadEvent(e downloader.Event) {
+	switch e.Type {
+	case downloader.PieceVerified:
+		t.emit(Event{Type: PieceVerified, Piece: e.Piece})
+	case downloader.PieceFailed:
+		t.emit(Event{Type: PieceFailed, Piece: e.Piece, Peer: e.Peer.String()})
+	case downloader.PeerConnected:
+		t.emit(Event{Type: PeerConnected, Peer: e.Peer.String()})
+	case downloader.PeerDisconnected:
+		t.emit(Event{Type: PeerDisconnected, Peer: e.Peer.String()})
+	case downloader.PeersNeeded:
+		t.tracker.need()
+		t.search.need()
+	case downloader.DHTNode:
+		if t.client.dht != nil {
+			t.client.dht.AddNode(&net.UDPAddr{IP: e.Peer.IP, Port: int(e.Peer.Port)})
+		}
+	case downloader.Completed:
+		t.tracker.complete()
+		t.emit(Event{Type: Completed})
+		if t.client.opts.Seed {
+			t.setState(Seeding)
+		}
+	}
+}
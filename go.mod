@@ -3,10 +3,13 @@ module github.com/xanish/torrenty
 go 1.22.5
 
 require (
-	github.com/jackpal/bencode-go v1.0.2 // indirect
+	github.com/jackpal/bencode-go v1.0.2
+	github.com/schollz/progressbar/v3 v3.14.6
+	golang.org/x/sys v0.24.0
+)
+
+require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/schollz/progressbar/v3 v3.14.6 // indirect
-	golang.org/x/sys v0.24.0 // indirect
 	golang.org/x/term v0.23.0 // indirect
 )
@@ -0,0 +1,769 @@
+// Package dht implements a node of the mainline DHT (BEP 5), which finds the
+// peers of a torrent by its info-hash without a tracker. The node runs over
+// IPv4.
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+const (
+	// alpha is the number of queries a lookup keeps in flight.
+	alpha = 3
+
+	// tokenRotation is how often the secret tokens are derived from changes.
+	// Tokens handed out with the previous secret are still accepted, so they
+	// stay valid for up to twice as long.
+	tokenRotation = 5 * time.Minute
+
+	// peerLifetime is how long a peer announced to us is handed out, unless
+	// it announces itself again.
+	peerLifetime = 30 * time.Minute
+
+	// maxValues caps the peers returned by a get_peers response, so that it
+	// fits in a single UDP packet.
+	maxValues = 50
+
+	// maxStoredTorrents and maxStoredPeers cap the info-hashes peers are
+	// stored for and the peers stored per info-hash, as any node may announce
+	// itself for arbitrary info-hashes.
+	maxStoredTorrents = 1000
+	maxStoredPeers    = 100
+
+	maxPacketSize = 65535
+)
+
+var (
+	// queryTimeout is how long a node has to answer a query.
+	queryTimeout = 5 * time.Second
+
+	// refreshInterval is how often the nodes of the routing table that were
+	// not heard from in a while are pinged.
+	refreshInterval = 5 * time.Minute
+)
+
+// DefaultBootstrap lists well-known nodes to join the DHT through.
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// ErrClosed is returned by the queries of a Server that was closed.
+var ErrClosed = errors.New("dht node closed")
+
+// ErrNoNodes is returned by lookups when no node of the DHT answered them.
+var ErrNoNodes = errors.New("no dht node answered")
+
+type transaction struct {
+	addr *net.UDPAddr
+	res  chan *krpcMessage
+}
+
+type storedPeer struct {
+	peer peer.Peer
+	at   time.Time
+}
+
+// Server is a DHT node, answering the queries of other nodes and looking up
+// and announcing the peers of torrents.
+type Server struct {
+	id   [20]byte
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	table   *table
+	pending map[string]transaction
+	nextTx  uint16
+	peers   map[[20]byte]map[string]storedPeer
+
+	// routers are the bootstrap nodes, used to join the DHT again once the
+	// routing table has no good node left.
+	routers []*net.UDPAddr
+
+	// secret and prevSecret derive the tokens handed out by get_peers, which
+	// must be presented with announce_peer.
+	secret     [16]byte
+	prevSecret [16]byte
+	rotatedAt  time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Listen starts a DHT node on the UDP port, taking the id and the nodes of
+// state when it is not nil. A random id is generated otherwise.
+func Listen(port int, state *State) (*Server, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for dht on port %d: %w", port, err)
+	}
+
+	s := &Server{
+		conn:    conn,
+		pending: make(map[string]transaction),
+		peers:   make(map[[20]byte]map[string]storedPeer),
+		closed:  make(chan struct{}),
+	}
+
+	if state != nil && len(state.ID) == len(s.id) {
+		copy(s.id[:], state.ID)
+	} else {
+		_, err = rand.Read(s.id[:])
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to generate dht node id: %w", err)
+		}
+	}
+	s.table = newTable(s.id)
+
+	if state != nil {
+		contacts, err := decodeNodes(state.Nodes)
+		if err != nil {
+			logger.Log(logger.Warning, "ignoring saved dht nodes: %s", err)
+		}
+		for _, c := range contacts {
+			s.table.update(c.id, c.addr, time.Time{})
+		}
+	}
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.serve()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.refresh()
+	}()
+
+	return s, nil
+}
+
+// ID returns the node id of the Server.
+func (s *Server) ID() [20]byte {
+	return s.id
+}
+
+// Port returns the UDP port the Server listens on.
+func (s *Server) Port() int {
+	return s.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Len returns the number of good nodes in the routing table.
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.table.len()
+}
+
+// Close stops the Server, aborting the queries in flight.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+		s.wg.Wait()
+	})
+
+	return err
+}
+
+// Bootstrap joins the DHT through the nodes at addrs, host:port addresses such
+// as the ones of DefaultBootstrap, and the nodes already in the routing table,
+// by looking up our own id. The addresses are kept to join again should every
+// node of the routing table go bad.
+func (s *Server) Bootstrap(ctx context.Context, addrs []string) error {
+	var routers []*net.UDPAddr
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			logger.Log(logger.Warning, "failed to resolve dht bootstrap node %s: %s", addr, err)
+			continue
+		}
+		routers = append(routers, udpAddr)
+	}
+
+	s.mu.Lock()
+	s.routers = routers
+	s.mu.Unlock()
+
+	nodes, _ := s.lookup(ctx, s.id, "find_node", routers)
+	if len(nodes) == 0 {
+		return fmt.Errorf("failed to join the dht: %w", ErrNoNodes)
+	}
+	logger.Log(logger.Info, "joined the dht with %d nodes", s.Len())
+
+	return nil
+}
+
+// Ping queries the node at addr, adding it to the routing table if it
+// answers.
+func (s *Server) Ping(ctx context.Context, addr *net.UDPAddr) error {
+	_, err := s.query(ctx, addr, "ping", krpcArgs{})
+
+	return err
+}
+
+// AddNode pings the node at addr in the background, such as the node of a
+// peer that sent us its DHT port, adding it to the routing table if it
+// answers. IPv6 nodes are ignored.
+func (s *Server) AddNode(addr *net.UDPAddr) {
+	if addr.IP.To4() == nil {
+		return
+	}
+
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+		defer cancel()
+
+		err := s.Ping(ctx, addr)
+		if err != nil {
+			logger.Log(logger.Debug, "dht node %s did not answer ping: %s", addr, err)
+		}
+	}()
+}
+
+// GetPeers looks up the peers of the torrent identified by infoHash.
+func (s *Server) GetPeers(ctx context.Context, infoHash [20]byte) ([]peer.Peer, error) {
+	nodes, peers := s.lookup(ctx, infoHash, "get_peers", nil)
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	return peers, nil
+}
+
+// Announce looks up the peers of the torrent identified by infoHash like
+// GetPeers does, and announces that we accept connections for it on port to
+// the closest nodes that answered.
+func (s *Server) Announce(ctx context.Context, infoHash [20]byte, port int) ([]peer.Peer, error) {
+	nodes, peers := s.lookup(ctx, infoHash, "get_peers", nil)
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	var wg sync.WaitGroup
+	var announced atomic.Int32
+	for _, n := range nodes {
+		if n.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(n *lookupNode) {
+			defer wg.Done()
+			_, err := s.query(ctx, n.addr, "announce_peer", krpcArgs{
+				InfoHash: string(infoHash[:]),
+				Port:     port,
+				Token:    n.token,
+			})
+			if err != nil {
+				logger.Log(logger.Debug, "announcing to dht node %s failed: %s", n.addr, err)
+				return
+			}
+
+			announced.Add(1)
+		}(n)
+	}
+	wg.Wait()
+
+	logger.Log(logger.Debug, "announced %x to %d dht nodes", infoHash, announced.Load())
+
+	return peers, nil
+}
+
+// lookupNode is a node met during a lookup.
+type lookupNode struct {
+	contact
+
+	queried bool
+	failed  bool
+	token   string
+}
+
+// lookup runs an iterative lookup of target, sending q to the closest nodes
+// known until the bucketSize closest nodes that answered were all queried.
+// The nodes at extra are queried first, and so are the bootstrap nodes when
+// the routing table has no good node. It returns the closest nodes that
+// answered, closest first, along with the peers returned by get_peers
+// queries.
+func (s *Server) lookup(ctx context.Context, target [20]byte, q string, extra []*net.UDPAddr) ([]*lookupNode, []peer.Peer) {
+	s.mu.Lock()
+	known := s.table.closest(target, bucketSize)
+	if len(known) == 0 && extra == nil {
+		extra = s.routers
+	}
+	s.mu.Unlock()
+
+	var nodes []*lookupNode
+	seen := make(map[string]bool)
+	add := func(c contact) {
+		if seen[c.addr.String()] {
+			return
+		}
+		seen[c.addr.String()] = true
+		nodes = append(nodes, &lookupNode{contact: c})
+	}
+
+	// The ids of the extra nodes are unknown until they answer, they are
+	// given the target as id to be queried first.
+	for _, addr := range extra {
+		add(contact{id: target, addr: addr})
+	}
+	for _, c := range known {
+		add(c)
+	}
+
+	args := krpcArgs{Target: string(target[:])}
+	if q == "get_peers" {
+		args = krpcArgs{InfoHash: string(target[:])}
+	}
+
+	type result struct {
+		node *lookupNode
+		res  *krpcMessage
+		err  error
+	}
+	results := make(chan result, alpha)
+
+	var peers []peer.Peer
+	seenPeers := make(map[string]bool)
+	inflight := 0
+	for {
+		sortLookupNodes(nodes, target)
+
+		closest := 0
+		for _, n := range nodes {
+			if inflight >= alpha || closest >= bucketSize {
+				break
+			}
+			if n.failed {
+				continue
+			}
+			closest++
+			if n.queried {
+				continue
+			}
+
+			n.queried = true
+			inflight++
+			go func(n *lookupNode) {
+				res, err := s.query(ctx, n.addr, q, args)
+				results <- result{node: n, res: res, err: err}
+			}(n)
+		}
+
+		if inflight == 0 {
+			break
+		}
+
+		r := <-results
+		inflight--
+		if r.err != nil {
+			r.node.failed = true
+			continue
+		}
+
+		copy(r.node.id[:], r.res.R.ID)
+		r.node.token = r.res.R.Token
+
+		contacts, err := decodeNodes(r.res.R.Nodes)
+		if err != nil {
+			logger.Log(logger.Debug, "ignoring nodes from dht node %s: %s", r.node.addr, err)
+		}
+		for _, c := range contacts {
+			if c.id != s.id {
+				add(c)
+			}
+		}
+
+		for _, value := range r.res.R.Values {
+			if len(value) != net.IPv4len+2 && len(value) != net.IPv6len+2 {
+				continue
+			}
+			found, err := peer.ParseCompact([]byte(value), len(value)-2)
+			if err != nil {
+				continue
+			}
+			for _, p := range found {
+				if p.Port != 0 && !seenPeers[p.String()] {
+					seenPeers[p.String()] = true
+					peers = append(peers, p)
+				}
+			}
+		}
+	}
+
+	var answered []*lookupNode
+	for _, n := range nodes {
+		if n.queried && !n.failed && len(answered) < bucketSize {
+			answered = append(answered, n)
+		}
+	}
+
+	return answered, peers
+}
+
+func sortLookupNodes(nodes []*lookupNode, target [20]byte) {
+	slices.SortStableFunc(nodes, func(a, b *lookupNode) int {
+		da, db := distance(a.id, target), distance(b.id, target)
+
+		return bytes.Compare(da[:], db[:])
+	})
+}
+
+// query sends q with args to the node at addr and waits for its response. A
+// node that answers is added to the routing table, one that does not is
+// recorded as failed.
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr, q string, args krpcArgs) (*krpcMessage, error) {
+	res := make(chan *krpcMessage, 1)
+
+	s.mu.Lock()
+	s.nextTx++
+	tx := string(binary.BigEndian.AppendUint16(nil, s.nextTx))
+	s.pending[tx] = transaction{addr: addr, res: res}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, tx)
+		s.mu.Unlock()
+	}()
+
+	args.ID = string(s.id[:])
+	packet, err := encode(queryMessage{T: tx, Y: krpcQuery, Q: q, A: args})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.conn.WriteToUDP(packet, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s query to dht node %s: %w", q, addr, err)
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	var msg *krpcMessage
+	select {
+	case msg = <-res:
+	case <-timer.C:
+		s.mu.Lock()
+		s.table.failed(addr)
+		s.mu.Unlock()
+		return nil, fmt.Errorf("dht node %s did not answer %s query in time", addr, q)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+
+	if msg.Y == krpcError {
+		return nil, fmt.Errorf("dht node %s rejected %s query: %w", addr, q, msg.err())
+	}
+
+	id, ok := nodeID(msg.R.ID)
+	if !ok {
+		return nil, fmt.Errorf("dht node %s answered %s query with an invalid id", addr, q)
+	}
+
+	s.mu.Lock()
+	s.table.update(id, addr, time.Now())
+	s.mu.Unlock()
+
+	return msg, nil
+}
+
+// serve reads the packets received from other nodes until the Server is
+// closed, answering their queries and handing the responses to the queries
+// waiting for them.
+func (s *Server) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log(logger.Debug, "failed to read dht packet: %s", err)
+			continue
+		}
+
+		if v4 := addr.IP.To4(); v4 != nil {
+			addr.IP = v4
+		}
+
+		msg, err := decode(buf[:n])
+		if err != nil {
+			logger.Log(logger.Debug, "ignoring packet from dht node %s: %s", addr, err)
+			continue
+		}
+
+		switch msg.Y {
+		case krpcQuery:
+			s.handleQuery(msg, addr)
+		case krpcResponse, krpcError:
+			s.mu.Lock()
+			tx, ok := s.pending[msg.T]
+			if ok && tx.addr.IP.Equal(addr.IP) && tx.addr.Port == addr.Port {
+				delete(s.pending, msg.T)
+				tx.res <- msg
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// handleQuery answers a query of the node at addr, and adds the node to the
+// routing table.
+func (s *Server) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	id, ok := nodeID(msg.A.ID)
+	if !ok {
+		s.sendError(msg.T, addr, errProtocol, "invalid node id")
+		return
+	}
+
+	logger.Log(logger.Debug, "received dht query %s from %s", msg.Q, addr)
+
+	now := time.Now()
+	s.mu.Lock()
+	s.table.update(id, addr, now)
+	s.mu.Unlock()
+
+	r := krpcReturn{ID: string(s.id[:])}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		target, ok := nodeID(msg.A.Target)
+		if !ok {
+			s.sendError(msg.T, addr, errProtocol, "invalid target")
+			return
+		}
+
+		s.mu.Lock()
+		r.Nodes = encodeNodes(s.table.closest(target, bucketSize))
+		s.mu.Unlock()
+	case "get_peers":
+		infoHash, ok := nodeID(msg.A.InfoHash)
+		if !ok {
+			s.sendError(msg.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+
+		s.mu.Lock()
+		r.Token = s.token(addr.IP, now)
+		r.Values = s.storedPeers(infoHash, now)
+		if len(r.Values) == 0 {
+			r.Nodes = encodeNodes(s.table.closest(infoHash, bucketSize))
+		}
+		s.mu.Unlock()
+	case "announce_peer":
+		infoHash, ok := nodeID(msg.A.InfoHash)
+		if !ok {
+			s.sendError(msg.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			s.sendError(msg.T, addr, errProtocol, "invalid port")
+			return
+		}
+
+		s.mu.Lock()
+		valid := s.validToken(msg.A.Token, addr.IP, now)
+		if valid {
+			s.storePeer(infoHash, peer.Peer{IP: addr.IP, Port: uint16(port)}, now)
+		}
+		s.mu.Unlock()
+
+		if !valid {
+			s.sendError(msg.T, addr, errProtocol, "bad token")
+			return
+		}
+	default:
+		s.sendError(msg.T, addr, errMethodUnknown, "method unknown")
+		return
+	}
+
+	s.send(addr, responseMessage{T: msg.T, Y: krpcResponse, R: r})
+}
+
+func (s *Server) sendError(tx string, addr *net.UDPAddr, code int, message string) {
+	s.send(addr, errorMessage{T: tx, Y: krpcError, E: []interface{}{code, message}})
+}
+
+func (s *Server) send(addr *net.UDPAddr, msg interface{}) {
+	packet, err := encode(msg)
+	if err == nil {
+		_, err = s.conn.WriteToUDP(packet, addr)
+	}
+	if err != nil {
+		logger.Log(logger.Debug, "failed to answer dht node %s: %s", addr, err)
+	}
+}
+
+// token returns the token handed out to the node at ip. It must be called
+// with mu held.
+func (s *Server) token(ip net.IP, now time.Time) string {
+	s.rotate(now)
+
+	return tokenFor(s.secret, ip)
+}
+
+// validToken reports whether token was handed out to the node at ip with the
+// current or the previous secret. It must be called with mu held.
+func (s *Server) validToken(token string, ip net.IP, now time.Time) bool {
+	s.rotate(now)
+
+	return token == tokenFor(s.secret, ip) || token == tokenFor(s.prevSecret, ip)
+}
+
+// rotate replaces the secret tokens are derived from once tokenRotation
+// elapsed. It must be called with mu held.
+func (s *Server) rotate(now time.Time) {
+	if !s.rotatedAt.IsZero() && now.Sub(s.rotatedAt) < tokenRotation {
+		return
+	}
+
+	s.prevSecret = s.secret
+	_, _ = rand.Read(s.secret[:])
+	s.rotatedAt = now
+}
+
+func tokenFor(secret [16]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.To16())
+
+	return string(h.Sum(nil)[:8])
+}
+
+// storePeer records that p announced itself for infoHash. It must be called
+// with mu held.
+func (s *Server) storePeer(infoHash [20]byte, p peer.Peer, now time.Time) {
+	peers, ok := s.peers[infoHash]
+	if !ok {
+		if len(s.peers) >= maxStoredTorrents {
+			logger.Log(logger.Debug, "not storing peer %s, %d info-hashes stored already", p, len(s.peers))
+			return
+		}
+		peers = make(map[string]storedPeer)
+		s.peers[infoHash] = peers
+	}
+
+	// a full info-hash makes room by dropping the peer announced longest ago
+	addr := p.String()
+	if _, ok := peers[addr]; !ok && len(peers) >= maxStoredPeers {
+		oldest := ""
+		for other, sp := range peers {
+			if oldest == "" || sp.at.Before(peers[oldest].at) {
+				oldest = other
+			}
+		}
+		delete(peers, oldest)
+	}
+
+	peers[addr] = storedPeer{peer: p, at: now}
+}
+
+// expirePeers drops the stored peers that did not announce themselves again
+// within peerLifetime. It must be called with mu held.
+func (s *Server) expirePeers(now time.Time) {
+	for infoHash, peers := range s.peers {
+		for addr, sp := range peers {
+			if now.Sub(sp.at) > peerLifetime {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
+
+// storedPeers returns the compact addresses of up to maxValues peers that
+// announced themselves for infoHash, dropping the expired ones. It must be
+// called with mu held.
+func (s *Server) storedPeers(infoHash [20]byte, now time.Time) []string {
+	var values []string
+	for addr, sp := range s.peers[infoHash] {
+		if now.Sub(sp.at) > peerLifetime {
+			delete(s.peers[infoHash], addr)
+			continue
+		}
+		if len(values) < maxValues {
+			values = append(values, string(sp.peer.Compact()))
+		}
+	}
+
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+
+	return values
+}
+
+// refresh pings the nodes of the routing table that were not heard from in
+// questionableAfter every refreshInterval, until the Server is closed, so
+// that the ones that left the DHT go bad and make room for new nodes. The
+// expired stored peers are dropped along the way.
+func (s *Server) refresh() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+
+		s.mu.Lock()
+		questionable := s.table.questionable(time.Now().Add(-questionableAfter))
+		s.expirePeers(time.Now())
+		s.mu.Unlock()
+
+		for _, c := range questionable {
+			s.AddNode(c.addr)
+		}
+	}
+}
+
+// nodeID converts a node id or info-hash received from another node.
+func nodeID(s string) ([20]byte, bool) {
+	if len(s) != 20 {
+		return [20]byte{}, false
+	}
+
+	return [20]byte([]byte(s)), true
+}
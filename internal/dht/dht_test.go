@@ -0,0 +1,291 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+// startNodes starts count DHT nodes on the loopback interface, every one of
+// them but the first joining through the first.
+func startNodes(t *testing.T, count int) []*Server {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	nodes := make([]*Server, count)
+	for i := range nodes {
+		s, err := Listen(0, nil)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+		t.Cleanup(func() {
+			_ = s.Close()
+		})
+		nodes[i] = s
+	}
+
+	router := []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(nodes[0].Port()))}
+	for _, s := range nodes[1:] {
+		err := s.Bootstrap(ctx, router)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	return nodes
+}
+
+func TestLookupAcrossNodes(t *testing.T) {
+	nodes := startNodes(t, 20)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	infoHash := [20]byte{0xaa, 0xbb}
+	peers, err := nodes[5].Announce(ctx, infoHash, 6881)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("expected no peers before the first announce, got %v", peers)
+	}
+
+	_, err = nodes[12].Announce(ctx, infoHash, 6882)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	peers, err = nodes[17].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	found := map[string]bool{}
+	for _, p := range peers {
+		found[p.String()] = true
+	}
+	for _, want := range []string{"127.0.0.1:6881", "127.0.0.1:6882"} {
+		if !found[want] {
+			t.Errorf("expected peer %s to be found, got %v", want, peers)
+		}
+	}
+
+	// another torrent has no peers
+	peers, err = nodes[17].GetPeers(ctx, [20]byte{0x01})
+	if err != nil || len(peers) != 0 {
+		t.Errorf("expected no peers for an unknown torrent, got %v %v", peers, err)
+	}
+}
+
+func TestAnnounceRequiresToken(t *testing.T) {
+	nodes := startNodes(t, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := nodes[1].query(ctx, testAddr(nodes[0].Port()), "announce_peer", krpcArgs{
+		InfoHash: string(make([]byte, 20)),
+		Port:     6881,
+		Token:    "forged",
+	})
+
+	var e *krpcErr
+	if !errors.As(err, &e) || e.Code != errProtocol {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+
+	_, err = nodes[1].query(ctx, testAddr(nodes[0].Port()), "sample_infohashes", krpcArgs{})
+	if !errors.As(err, &e) || e.Code != errMethodUnknown {
+		t.Errorf("expected an unknown method error, got %v", err)
+	}
+}
+
+func TestQueryTimesOut(t *testing.T) {
+	defer func(d time.Duration) {
+		queryTimeout = d
+	}(queryTimeout)
+	queryTimeout = 100 * time.Millisecond
+
+	s, err := Listen(0, nil)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(s *Server) {
+		_ = s.Close()
+	}(s)
+
+	// a socket that never answers
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *net.UDPConn) {
+		_ = c.Close()
+	}(silent)
+
+	s.mu.Lock()
+	s.table.update(testID(0x80), testAddr(silent.LocalAddr().(*net.UDPAddr).Port), time.Now())
+	s.mu.Unlock()
+
+	for range maxNodeFailures {
+		err = s.Ping(context.Background(), testAddr(silent.LocalAddr().(*net.UDPAddr).Port))
+		if err == nil {
+			t.Fatalf("expected ping of a silent node to fail")
+		}
+	}
+
+	if s.Len() != 0 {
+		t.Errorf("expected the silent node to go bad, got %d good nodes", s.Len())
+	}
+
+	_, err = s.GetPeers(context.Background(), [20]byte{1})
+	if !errors.Is(err, ErrNoNodes) {
+		t.Errorf("expected ErrNoNodes without good nodes, got %v", err)
+	}
+}
+
+func TestLookupSkipsMalformedValues(t *testing.T) {
+	s, err := Listen(0, nil)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(s *Server) {
+		_ = s.Close()
+	}(s)
+
+	// a node answering every query with malformed peer values next to a
+	// valid one
+	fake, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(c *net.UDPConn) {
+		_ = c.Close()
+	}(fake)
+
+	valid := peer.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := fake.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := decode(buf[:n])
+			if err != nil {
+				continue
+			}
+
+			id := testID(0x80)
+			packet, _ := encode(responseMessage{T: msg.T, Y: krpcResponse, R: krpcReturn{
+				ID:     string(id[:]),
+				Token:  "token",
+				Values: []string{"", "x", string(valid.Compact())},
+			}})
+			_, _ = fake.WriteToUDP(packet, addr)
+		}
+	}()
+
+	s.mu.Lock()
+	s.table.update(testID(0x80), testAddr(fake.LocalAddr().(*net.UDPAddr).Port), time.Now())
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peers, err := s.GetPeers(ctx, [20]byte{1})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if len(peers) != 1 || peers[0].String() != valid.String() {
+		t.Errorf("expected only peer %s to be found, got %v", valid, peers)
+	}
+}
+
+func TestStoredPeersBounded(t *testing.T) {
+	s, err := Listen(0, nil)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(s *Server) {
+		_ = s.Close()
+	}(s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the peer announced longest ago makes room for a new one
+	now := time.Now()
+	for i := range maxStoredPeers + 1 {
+		p := peer.Peer{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 6881}
+		s.storePeer([20]byte{1}, p, now.Add(time.Duration(i)*time.Second))
+	}
+	peers := s.peers[[20]byte{1}]
+	if len(peers) != maxStoredPeers {
+		t.Errorf("expected %d peers to be stored, got %d", maxStoredPeers, len(peers))
+	}
+	if _, ok := peers[peer.Peer{IP: net.IPv4(10, 0, 0, 0), Port: 6881}.String()]; ok {
+		t.Errorf("expected the oldest peer to be dropped")
+	}
+
+	// new info-hashes are ignored once full
+	for i := range maxStoredTorrents {
+		s.storePeer([20]byte{2, byte(i >> 8), byte(i)}, peer.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, now)
+	}
+	if len(s.peers) != maxStoredTorrents {
+		t.Errorf("expected %d info-hashes to be stored, got %d", maxStoredTorrents, len(s.peers))
+	}
+	last := maxStoredTorrents - 1
+	if _, ok := s.peers[[20]byte{2, byte(last >> 8), byte(last)}]; ok {
+		t.Errorf("expected the info-hash beyond the cap to be ignored")
+	}
+
+	// expired peers are swept along with the info-hashes left empty
+	s.expirePeers(now.Add(peerLifetime + maxStoredPeers*time.Second))
+	if len(s.peers) != 1 || len(s.peers[[20]byte{1}]) != 1 {
+		t.Errorf("expected only the latest peer to remain, got %d info-hashes", len(s.peers))
+	}
+}
+
+func TestStateSaveLoad(t *testing.T) {
+	nodes := startNodes(t, 4)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	err := nodes[1].State().Save(path)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	st, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	s, err := Listen(0, st)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(s *Server) {
+		_ = s.Close()
+	}(s)
+
+	if s.ID() != nodes[1].ID() {
+		t.Errorf("expected the node id to be restored")
+	}
+	if s.Len() != nodes[1].Len() || s.Len() == 0 {
+		t.Errorf("expected %d nodes to be restored, got %d", nodes[1].Len(), s.Len())
+	}
+
+	// the restored nodes are enough to look up peers without bootstrapping
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.GetPeers(ctx, [20]byte{1})
+	if err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+	}
+}
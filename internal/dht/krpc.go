@@ -0,0 +1,176 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC message types and the error codes of BEP 5.
+const (
+	krpcQuery    = "q"
+	krpcResponse = "r"
+	krpcError    = "e"
+
+	errGeneric       = 201
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// compactNodeLen is the length of the compact node info of an IPv4 node, its
+// 20 byte id followed by its compact address.
+const compactNodeLen = 26
+
+// krpcArgs holds the arguments of the queries of BEP 5, only the ones of the
+// query at hand are set.
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+// krpcReturn holds the return values of the responses of BEP 5. Nodes is the
+// compact node info of the nodes closest to the target, and Values the compact
+// addresses of the peers of an info-hash.
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+}
+
+// krpcMessage is a decoded KRPC message of any type. T is the transaction id
+// the response to a query carries back, and Y the type of the message.
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q"`
+	A krpcArgs      `bencode:"a"`
+	R krpcReturn    `bencode:"r"`
+	E []interface{} `bencode:"e"`
+}
+
+// The encoded forms of the message types, as the bencode package cannot omit
+// the parts of krpcMessage that do not belong to a message type.
+type queryMessage struct {
+	T string   `bencode:"t"`
+	Y string   `bencode:"y"`
+	Q string   `bencode:"q"`
+	A krpcArgs `bencode:"a"`
+}
+
+type responseMessage struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	R krpcReturn `bencode:"r"`
+}
+
+type errorMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	E []interface{} `bencode:"e"`
+}
+
+// krpcErr is the error carried by an error message.
+type krpcErr struct {
+	Code    int
+	Message string
+}
+
+func (e *krpcErr) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode krpc message: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decode(packet []byte) (*krpcMessage, error) {
+	msg := &krpcMessage{}
+	err := bencode.Unmarshal(bytes.NewReader(packet), msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode krpc message: %w", err)
+	}
+
+	if msg.T == "" {
+		return nil, fmt.Errorf("krpc message without transaction id")
+	}
+
+	return msg, nil
+}
+
+// err returns the error carried by an error message.
+func (m *krpcMessage) err() *krpcErr {
+	e := &krpcErr{Code: errGeneric, Message: "malformed error"}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+	if len(m.E) > 1 {
+		if message, ok := m.E[1].(string); ok {
+			e.Message = message
+		}
+	}
+
+	return e
+}
+
+// contact is a node reached at addr. Its id is zero when unknown, as for the
+// bootstrap nodes.
+type contact struct {
+	id   [20]byte
+	addr *net.UDPAddr
+}
+
+// encodeNodes returns the compact node info of the IPv4 contacts.
+func encodeNodes(contacts []contact) string {
+	buf := make([]byte, 0, len(contacts)*compactNodeLen)
+	for _, c := range contacts {
+		ip := c.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, c.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(c.addr.Port))
+	}
+
+	return string(buf)
+}
+
+// decodeNodes parses compact node info, skipping the nodes with port 0.
+func decodeNodes(nodes string) ([]contact, error) {
+	if len(nodes)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("compact node info of %d bytes is not a multiple of %d", len(nodes), compactNodeLen)
+	}
+
+	contacts := make([]contact, 0, len(nodes)/compactNodeLen)
+	for offset := 0; offset < len(nodes); offset += compactNodeLen {
+		b := []byte(nodes[offset : offset+compactNodeLen])
+		port := binary.BigEndian.Uint16(b[24:26])
+		if port == 0 {
+			continue
+		}
+
+		contacts = append(contacts, contact{
+			id:   [20]byte(b[:20]),
+			addr: &net.UDPAddr{IP: net.IP(b[20:24]), Port: int(port)},
+		})
+	}
+
+	return contacts, nil
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecodeQuery(t *testing.T) {
+	packet, err := encode(queryMessage{
+		T: "aa",
+		Y: krpcQuery,
+		Q: "get_peers",
+		A: krpcArgs{ID: "abcdefghij0123456789", InfoHash: "mnopqrstuvwxyz123456"},
+	})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	// the example of BEP 5
+	want := "d1:ad2:id20:abcdefghij01234567899:info_hash20:mnopqrstuvwxyz123456e1:q9:get_peers1:t2:aa1:y1:qe"
+	if string(packet) != want {
+		t.Fatalf("expected query to be encoded as %q, got %q", want, packet)
+	}
+
+	msg, err := decode(packet)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if msg.T != "aa" || msg.Y != krpcQuery || msg.Q != "get_peers" || msg.A.InfoHash != "mnopqrstuvwxyz123456" {
+		t.Errorf("unexpected decoded query %+v", msg)
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	msg, err := decode([]byte("d1:rd2:id20:abcdefghij01234567895:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re"))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	want := krpcReturn{ID: "abcdefghij0123456789", Token: "aoeusnth", Values: []string{"axje.u", "idhtnm"}}
+	if !reflect.DeepEqual(msg.R, want) {
+		t.Errorf("expected response %+v, got %+v", want, msg.R)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	msg, err := decode([]byte("d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	e := msg.err()
+	if msg.Y != krpcError || e.Code != errGeneric || e.Message != "A Generic Error Ocurred" {
+		t.Errorf("unexpected error %+v", e)
+	}
+}
+
+func TestEncodeDecodeNodes(t *testing.T) {
+	contacts := []contact{
+		{id: testID(1), addr: testAddr(6881)},
+		{id: testID(2), addr: testAddr(6882)},
+	}
+
+	nodes := encodeNodes(contacts)
+	if len(nodes) != 2*compactNodeLen {
+		t.Fatalf("expected %d bytes of compact node info, got %d", 2*compactNodeLen, len(nodes))
+	}
+
+	decoded, err := decodeNodes(nodes)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if len(decoded) != len(contacts) {
+		t.Fatalf("expected %d nodes, got %d", len(contacts), len(decoded))
+	}
+	for i, c := range decoded {
+		if c.id != contacts[i].id || c.addr.String() != contacts[i].addr.String() {
+			t.Errorf("expected node %d to be %x at %s, got %x at %s", i, contacts[i].id, contacts[i].addr, c.id, c.addr)
+		}
+	}
+
+	_, err = decodeNodes(nodes[1:])
+	if err == nil {
+		t.Errorf("expected truncated compact node info to fail")
+	}
+}
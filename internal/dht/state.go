@@ -0,0 +1,66 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/utility"
+)
+
+// State is the routing table of a Server saved across runs, so that a restart
+// keeps its node id and rejoins the DHT through the nodes it knew. Nodes is
+// the compact node info of the good nodes of the table.
+type State struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// State returns the id of the Server along with the good nodes of its routing
+// table.
+func (s *Server) State() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &State{
+		ID:    string(s.id[:]),
+		Nodes: encodeNodes(s.table.closest(s.id, s.table.len())),
+	}
+}
+
+// LoadState reads the state saved at path.
+func LoadState(path string) (*State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dht state: %w", err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	st := &State{}
+	err = bencode.Unmarshal(f, st)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode dht state: %w", err)
+	}
+
+	return st, nil
+}
+
+// Save writes the state to path, replacing the previous state only once the
+// new one is fully written and synced to disk.
+func (st *State) Save(path string) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *st)
+	if err != nil {
+		return fmt.Errorf("failed to encode dht state: %w", err)
+	}
+
+	err = utility.WriteFileAtomic(path, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to save dht state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package dht
+
+import (
+	"bytes"
+	"math/bits"
+	"net"
+	"slices"
+	"time"
+)
+
+const (
+	// bucketSize is the number of nodes a bucket holds, the K of Kademlia.
+	bucketSize = 8
+
+	// maxNodeFailures is the number of queries in a row a node may fail to
+	// answer before it is considered bad and replaced by the next node
+	// that fits in its bucket.
+	maxNodeFailures = 2
+
+	// questionableAfter is how long a node that was not heard from stays
+	// good, after which it is pinged by the refresh of the table.
+	questionableAfter = 15 * time.Minute
+)
+
+// node is an entry of the routing table.
+type node struct {
+	contact
+
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) bad() bool {
+	return n.failures >= maxNodeFailures
+}
+
+// table is the routing table of a node, made of a bucket for every length of
+// the prefix the ids of other nodes share with ours. Buckets hold their nodes
+// least recently seen first, and only evict the bad ones, so that long-lived
+// nodes are kept over new ones as Kademlia recommends.
+type table struct {
+	self    [20]byte
+	buckets [160][]*node
+}
+
+func newTable(self [20]byte) *table {
+	return &table{self: self}
+}
+
+// distance returns the XOR distance of a and b.
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+
+	return d
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b [20]byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return 160
+}
+
+// update records that the node with id was heard from at addr at now, adding
+// it to its bucket if there is room or a bad node to replace. It reports
+// whether the node is in the table.
+func (t *table) update(id [20]byte, addr *net.UDPAddr, now time.Time) bool {
+	if id == t.self {
+		return false
+	}
+
+	i := commonPrefixLen(t.self, id)
+	bucket := t.buckets[i]
+	for j, n := range bucket {
+		if n.id != id {
+			continue
+		}
+
+		n.addr = addr
+		n.lastSeen = now
+		n.failures = 0
+		t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), n)
+
+		return true
+	}
+
+	n := &node{contact: contact{id: id, addr: addr}, lastSeen: now}
+	if len(bucket) < bucketSize {
+		t.buckets[i] = append(bucket, n)
+		return true
+	}
+
+	for j, old := range bucket {
+		if old.bad() {
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), n)
+			return true
+		}
+	}
+
+	return false
+}
+
+// failed records that the node at addr did not answer a query.
+func (t *table) failed(addr *net.UDPAddr) {
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if n.addr.IP.Equal(addr.IP) && n.addr.Port == addr.Port {
+				n.failures++
+			}
+		}
+	}
+}
+
+// closest returns up to count nodes of the table that are not bad, closest to
+// target first.
+func (t *table) closest(target [20]byte, count int) []contact {
+	var contacts []contact
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if !n.bad() {
+				contacts = append(contacts, n.contact)
+			}
+		}
+	}
+
+	sortByDistance(contacts, target)
+
+	return contacts[:min(count, len(contacts))]
+}
+
+// questionable returns the nodes not heard from since before.
+func (t *table) questionable(before time.Time) []contact {
+	var contacts []contact
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if n.lastSeen.Before(before) {
+				contacts = append(contacts, n.contact)
+			}
+		}
+	}
+
+	return contacts
+}
+
+// len returns the number of nodes in the table that are not bad.
+func (t *table) len() int {
+	count := 0
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if !n.bad() {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// sortByDistance sorts contacts closest to target first.
+func sortByDistance(contacts []contact, target [20]byte) {
+	slices.SortStableFunc(contacts, func(a, b contact) int {
+		da, db := distance(a.id, target), distance(b.id, target)
+
+		return bytes.Compare(da[:], db[:])
+	})
+}
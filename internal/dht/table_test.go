@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testID returns an id starting with the given bytes.
+func testID(prefix ...byte) [20]byte {
+	var id [20]byte
+	copy(id[:], prefix)
+
+	return id
+}
+
+func testAddr(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: port}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	tests := []struct {
+		a, b [20]byte
+		want int
+	}{
+		{testID(0x00), testID(0x80), 0},
+		{testID(0x00), testID(0x01), 7},
+		{testID(0xff, 0x00), testID(0xff, 0x40), 9},
+		{testID(0x12), testID(0x12), 160},
+	}
+
+	for _, test := range tests {
+		got := commonPrefixLen(test.a, test.b)
+		if got != test.want {
+			t.Errorf("expected common prefix length of %x and %x to be %d, got %d", test.a[:2], test.b[:2], test.want, got)
+		}
+	}
+}
+
+func TestTableKeepsGoodNodes(t *testing.T) {
+	tb := newTable(testID(0x00))
+	now := time.Now()
+
+	// every id starting with a set bit falls in the first bucket
+	for i := 0; i < bucketSize; i++ {
+		if !tb.update(testID(0x80, byte(i)), testAddr(1000+i), now) {
+			t.Fatalf("expected node %d to be added", i)
+		}
+	}
+
+	if tb.update(testID(0x80, 0xff), testAddr(2000), now) {
+		t.Fatalf("expected a full bucket of good nodes to reject a new node")
+	}
+
+	// a node that keeps failing is replaced
+	for range maxNodeFailures {
+		tb.failed(testAddr(1003))
+	}
+	if !tb.update(testID(0x80, 0xff), testAddr(2000), now) {
+		t.Fatalf("expected the new node to replace the bad one")
+	}
+
+	if tb.len() != bucketSize {
+		t.Errorf("expected %d nodes in the table, got %d", bucketSize, tb.len())
+	}
+	for _, c := range tb.closest(testID(0x80, 0x03), bucketSize) {
+		if c.id == testID(0x80, 0x03) {
+			t.Errorf("expected the bad node to be gone")
+		}
+	}
+
+	// our own id is never added
+	if tb.update(testID(0x00), testAddr(3000), now) {
+		t.Errorf("expected our own id to be rejected")
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	tb := newTable(testID(0x00))
+	now := time.Now()
+	for i, prefix := range []byte{0x01, 0x10, 0x11, 0x80, 0xf0} {
+		tb.update(testID(prefix), testAddr(1000+i), now)
+	}
+
+	closest := tb.closest(testID(0x10), 3)
+	want := []byte{0x10, 0x11, 0x01}
+	if len(closest) != len(want) {
+		t.Fatalf("expected %d nodes, got %d", len(want), len(closest))
+	}
+	for i, c := range closest {
+		if c.id != testID(want[i]) {
+			t.Errorf("expected node %d to be %x, got %x", i, want[i], c.id[0])
+		}
+	}
+}
@@ -2,170 +2,468 @@ package downloader
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"fmt"
-	"math"
-	"net"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/xanish/torrenty/internal/logger"
 	"github.com/xanish/torrenty/internal/metadata"
 	"github.com/xanish/torrenty/internal/peer"
-	"github.com/xanish/torrenty/internal/utility"
+	"github.com/xanish/torrenty/internal/picker"
+	"github.com/xanish/torrenty/internal/storage"
 )
 
-const maxDownloadBlockSize = 16 * 1024
+const (
+	maxDownloadBlockSize = 16 * 1024
 
-type work struct {
-	id     int
-	hash   [20]byte
-	size   int
-	result []byte
+	// defaultMaxRequests is the number of block requests kept in flight per
+	// peer unless configured otherwise.
+	defaultMaxRequests = 10
+
+	// maxUploadBlockSize is the largest block a peer may request from us,
+	// larger requests are considered abusive and close the connection.
+	maxUploadBlockSize = 128 * 1024
+)
+
+// Options configures a download.
+type Options struct {
+	// Extensions are negotiated with every peer that supports the extension
+	// protocol.
+	Extensions *peer.Extensions
+
+	// Incoming delivers inbound connections, which are served like the ones
+	// to the peers of the torrent.
+	Incoming <-chan *peer.Connection
+
+	// Peers delivers peers discovered while the download runs, such as the
+	// ones returned by later announces. They are added to the peers of the
+	// torrent connected to as needed.
+	Peers <-chan []peer.Peer
+
+	// MaxPeers is the number of peers connected to at once, including the
+	// inbound connections. Defaults to defaultMaxPeers.
+	MaxPeers int
+
+	// PreferIPv6 connects to the IPv6 peers before the IPv4 ones, instead of
+	// the other way around.
+	PreferIPv6 bool
+
+	// Seed keeps the download seeding once complete, until the context of
+	// the download is cancelled. Otherwise Download returns as soon as every
+	// piece has been downloaded.
+	Seed bool
+
+	// Progress draws a progress bar of the download on stderr.
+	Progress bool
+
+	// Partial lists the blocks of unfinished pieces already present in
+	// storage, as recorded in the resume data. They are not requested again.
+	Partial []PartialPiece
+
+	// ResumePath is where the fast-resume data of the download is saved as
+	// pieces are written, at most once every resumeInterval, and when the
+	// download stops, if set. Saving requires the storage to report the stats
+	// of its files, as storage.Files does.
+	ResumePath string
+
+	// MaxRequests is the number of block requests kept in flight per peer,
+	// lowered to the queue length the peer advertises. Defaults to
+	// defaultMaxRequests.
+	MaxRequests int
+
+	// Events is called with the events of the download as they happen, if
+	// set. It is called from the goroutines of the download and must not
+	// block.
+	Events func(Event)
+
+	// Stats is updated with the transfers of the download, if set.
+	Stats *Stats
 }
 
-func retry(w *work, jobs chan<- *work) bool {
-	channelClosed := false
+// EventType identifies the kind of an Event.
+type EventType int
 
-	defer func() {
-		if recover() != nil {
-			channelClosed = true
-		}
-	}()
+const (
+	// PieceVerified is emitted once a downloaded piece matched its hash and
+	// was written to storage.
+	PieceVerified EventType = iota
+	// PieceFailed is emitted when a downloaded piece did not match its hash.
+	PieceFailed
+	// PeerConnected is emitted when a connection to a peer is established.
+	PeerConnected
+	// PeerDisconnected is emitted when a connection to a peer is closed.
+	PeerDisconnected
+	// Completed is emitted once every piece has been downloaded.
+	Completed
+	// PeersNeeded is emitted when no peer is connected or left to connect
+	// to, asking for new peers to be delivered on Options.Peers.
+	PeersNeeded
+	// DHTNode is emitted when a peer sends us the port of its DHT node.
+	DHTNode
+)
+
+// Event is something that happened during a download.
+type Event struct {
+	Type EventType
 
-	w.result = make([]byte, w.size)
-	jobs <- w
+	// Piece is the index of the piece of PieceVerified and PieceFailed
+	// events.
+	Piece int
 
-	return channelClosed
+	// Peer is the peer of PeerConnected and PeerDisconnected events, and the
+	// peer a PieceFailed piece was downloaded from. For DHTNode events it is
+	// the address of the DHT node, the IP of the peer with the UDP port it
+	// sent.
+	Peer peer.Peer
 }
 
-func executeWorker(id int, torrent metadata.Metadata, peerID [20]byte, peer peer.Peer, jobs chan *work, results chan<- *work) error {
-	logger.Log(logger.Debug, "[worker:%d] connecting to peer %s", id, peer.String())
-	conn, err := peer.Connect(torrent.InfoHash, peerID)
-	if err != nil {
-		return fmt.Errorf("[worker:%d] connecting to peer %s failed: %w", id, peer.String(), err)
-	}
-	defer func(Conn net.Conn) {
-		_ = Conn.Close()
-	}(conn.Conn)
+// Stats counts the transfers of a download. Its counters are updated while
+// the download runs and may be read concurrently.
+type Stats struct {
+	// Downloaded is the number of piece bytes received from peers, including
+	// the blocks of pieces that failed verification.
+	Downloaded atomic.Int64
 
-	// Client connections start out as "choked" and "not interested"
-	err = conn.SendUnChoke()
-	err = conn.SendInterested()
-	if err != nil {
-		return fmt.Errorf("[worker:%d] sending interested message to peer %s failed: %w", id, peer.String(), err)
-	}
+	// Uploaded is the number of piece bytes sent to peers.
+	Uploaded atomic.Int64
 
-	err = conn.ReadMessage(0, nil)
-	if err != nil {
-		return fmt.Errorf("[worker:%d] reading response for message<interested> from peer %s failed: %w", id, peer.String(), err)
+	// Completed is the number of bytes of the verified pieces in storage.
+	Completed atomic.Int64
+
+	// Peers is the number of connected peers.
+	Peers atomic.Int64
+}
+
+// session holds the state shared by the workers of a single torrent.
+type session struct {
+	torrent metadata.Metadata
+	peerID  [20]byte
+	opts    Options
+	storage storage.Storage
+
+	picker *picker.Picker
+
+	// blocksMu guards the pieces being downloaded, along with the active
+	// pieces and outstanding requests of every worker.
+	blocksMu sync.Mutex
+	pieces   map[int]*piece
+	partial  map[int]string
+
+	// resumeSavedAt is when the resume data was last saved. It is only used
+	// by the goroutine running Download.
+	resumeSavedAt time.Time
+
+	// mu guards the connections of the workers, along with the peers last
+	// sent to each of them with ut_pex and when each of them last sent a
+	// ut_pex message we accepted.
+	mu          sync.Mutex
+	conns       map[*peer.Connection]bool
+	pexSent     map[*peer.Connection]map[string]peer.Peer
+	pexReceived map[*peer.Connection]time.Time
+	finished    chan struct{}
+
+	// exchanged delivers the peers received with ut_pex to the goroutine
+	// managing the peers.
+	exchanged chan []peer.Peer
+
+	// exits reports the workers that stopped to the goroutine managing the
+	// peers, which reports on failed when the download cannot go on.
+	exits  chan exit
+	failed chan error
+
+	// wg tracks the goroutines of the workers, so that the session only
+	// finishes once every one of them returned.
+	wg sync.WaitGroup
+}
+
+// upload serves the block requests of the remote peer as they arrive, until
+// done is closed.
+func (s *session) upload(conn *peer.Connection, done <-chan struct{}) error {
+	for {
+		select {
+		case <-conn.Requested():
+		case <-done:
+			return nil
+		}
+
+		err := s.serve(conn)
+		if err != nil {
+			return err
+		}
 	}
+}
 
-	for job := range jobs {
-		// continue to next piece of work if this peer does not have the piece
-		exists := utility.PieceExists(job.id, conn.Bitfield)
-		if !exists {
-			logger.Log(logger.Debug, "[worker:%d] peer %s does not have piece for job %d", id, peer.String(), job.id)
-			retry(job, jobs)
-			continue
+// serve answers the pending block requests of the remote peer with data read
+// from storage, one at a time so that requests the peer cancels in the
+// meantime are skipped. Requests for pieces we do not have are dropped.
+func (s *session) serve(conn *peer.Connection) error {
+	for {
+		req, ok := conn.NextRequest()
+		if !ok {
+			return nil
 		}
 
-		// download piece block-by-block
-		numBlocks := int(math.Ceil(float64(job.size) / float64(maxDownloadBlockSize)))
-		for i := 0; i < numBlocks; i++ {
-			adjustedBlockSize := maxDownloadBlockSize
-			if i == numBlocks-1 {
-				adjustedBlockSize = job.size - ((numBlocks - 1) * maxDownloadBlockSize)
-			}
-
-			err = conn.SendRequest(job.id, i*maxDownloadBlockSize, adjustedBlockSize)
-			if err != nil {
-				retry(job, jobs)
-				logger.Log(logger.Error, "[worker:%d] sending message<request> to peer %s failed: %s", id, peer.String(), err)
-				return nil
-			}
-
-			err = conn.ReadMessage(job.id, job.result)
-			if err != nil {
-				retry(job, jobs)
-				logger.Log(logger.Error, "[worker:%d] reading response for message<request> from peer %s failed: %s", id, peer.String(), err)
-				// just break here so that worker can continue fetching more jobs instead of exiting
-				break
-			}
+		if req.Index < 0 || req.Index >= len(s.torrent.Pieces) {
+			return fmt.Errorf("peer requested invalid piece %d", req.Index)
 		}
 
-		// check piece integrity
-		hash := sha1.Sum(job.result)
-		if !bytes.Equal(hash[:], job.hash[:]) {
-			retry(job, jobs)
-			logger.Log(logger.Info, "[worker:%d] integrity check for piece %d downloaded from %s failed", id, job.id, peer.String())
-			logger.Log(logger.Info, "[worker:%d] expected piece hash to be %x got %x", id, job.hash[:], hash[:])
+		if req.Length <= 0 || req.Length > maxUploadBlockSize || req.Begin < 0 || req.Begin+req.Length > s.torrent.PieceSize(req.Index) {
+			return fmt.Errorf("peer requested invalid block of %d bytes at %d of piece %d", req.Length, req.Begin, req.Index)
+		}
 
-			// TODO: temp ack-ing to see if some peers stop sending the same piece over and over
-			err = conn.SendHave(job.id)
+		if !s.storage.IsComplete(req.Index) {
+			logger.Log(logger.Debug, "peer %s requested piece %d which we do not have", conn.Peer.String(), req.Index)
 			continue
-		} else {
-			logger.Log(logger.Info, "[worker:%d] piece %d verified successfully", id, job.id)
-			results <- job
 		}
 
-		// inform peer you got the piece
-		err = conn.SendHave(job.id)
+		block := make([]byte, req.Length)
+		err := s.storage.ReadBlock(req.Index, req.Begin, block)
 		if err != nil {
-			return fmt.Errorf("[worker:%d] sending message<have> to peer %s failed: %w", id, peer.String(), err)
+			return fmt.Errorf("failed reading block of piece %d: %w", req.Index, err)
 		}
+
+		err = conn.SendPiece(req.Index, req.Begin, block)
+		if err != nil {
+			return err
+		}
+		s.opts.Stats.Uploaded.Add(int64(req.Length))
+		logger.Log(logger.Debug, "sent block %d of piece %d to peer %s", req.Begin, req.Index, conn.Peer.String())
 	}
+}
 
-	return nil
+// track registers a connection so that it is notified of new pieces and closed
+// once the session finishes. It reports false if the session already finished,
+// and fails if another connection to the same peer id is registered, as a peer
+// reachable on both IPv4 and IPv6 is only connected to once.
+func (s *session) track(conn *peer.Connection) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isFinished() {
+		return false, nil
+	}
+	for other := range s.conns {
+		if other.PeerID == conn.PeerID {
+			return false, fmt.Errorf("%w %s, connected through %s already", errDuplicatePeer, conn.Peer.String(), other.Peer.String())
+		}
+	}
+	s.conns[conn] = true
+	s.opts.Stats.Peers.Add(1)
+	s.emit(Event{Type: PeerConnected, Peer: conn.Peer})
+
+	return true, nil
 }
 
-func Download(peerID [20]byte, torrent metadata.Metadata, w *os.File) error {
-	jobs := make(chan *work, len(torrent.Pieces))
-	done := make(chan *work, len(torrent.Peers))
-	for index, hash := range torrent.Pieces {
-		pieceSize := torrent.PieceLength
-		numPieces := int(math.Ceil(float64(torrent.Size) / float64(pieceSize)))
-		if index == numPieces-1 {
-			pieceSize = torrent.Size % torrent.PieceLength
+func (s *session) untrack(conn *peer.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	delete(s.pexSent, conn)
+	delete(s.pexReceived, conn)
+	s.opts.Stats.Peers.Add(-1)
+	s.emit(Event{Type: PeerDisconnected, Peer: conn.Peer})
+}
+
+// emit reports e to the Events callback of the download, if set.
+func (s *session) emit(e Event) {
+	if s.opts.Events != nil {
+		s.opts.Events(e)
+	}
+}
+
+func (s *session) isFinished() bool {
+	select {
+	case <-s.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+// ownBitfield returns a copy of the bitfield of pieces we have, and whether we
+// have any piece at all.
+func (s *session) ownBitfield() ([]byte, bool) {
+	bitfield := s.storage.Bitfield()
+
+	return bitfield, !bytes.Equal(bitfield, make([]byte, len(bitfield)))
+}
+
+// markDone marks the piece at index complete in storage and announces it to
+// every connected peer.
+func (s *session) markDone(index int) error {
+	err := s.storage.MarkComplete(index)
+	if err != nil {
+		return fmt.Errorf("failed marking piece %d complete: %w", index, err)
+	}
+	s.picker.Done(index)
+
+	s.mu.Lock()
+	conns := make([]*peer.Connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		err := conn.SendHave(index)
+		if err != nil {
+			logger.Log(logger.Debug, "sending message<have> to peer %s failed: %s", conn.Peer.String(), err)
 		}
-		jobs <- &work{index, hash, pieceSize, make([]byte, pieceSize)}
 	}
 
-	for id, remotePeer := range torrent.Peers {
-		logger.Log(logger.Info, "starting worker %d with peer %s", id, remotePeer.String())
-		go func() {
-			// TODO: try to use some pattern here to restart broken workers
-			err := executeWorker(id, torrent, peerID, remotePeer, jobs, done)
-			if err != nil {
-				logger.Log(logger.Error, "[worker:%d] failed with error: %s", id, err)
-			}
-		}()
+	return nil
+}
+
+// finish stops the session, closing every connection so that blocked workers
+// return, and waits for the workers to exit.
+func (s *session) finish() {
+	s.mu.Lock()
+	close(s.finished)
+	for conn := range s.conns {
+		_ = conn.Conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// spawn runs fn in a goroutine tracked by the session.
+func (s *session) spawn(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// Download fetches every piece of the torrent from its peers and writes the
+// verified pieces to store, skipping the pieces it already has marked complete.
+// Requests from peers are answered with the complete pieces, and once every
+// piece has been downloaded Download keeps seeding if opts.Seed is set, until
+// ctx is cancelled. Cancelling ctx before the download completes makes
+// Download return the error of ctx, and running out of peers to download from
+// makes it return ErrNoPeers. Either way every connection is closed and
+// every worker has exited by the time Download returns.
+func Download(ctx context.Context, peerID [20]byte, torrent metadata.Metadata, store storage.Storage, opts Options) error {
+	if opts.MaxRequests <= 0 {
+		opts.MaxRequests = defaultMaxRequests
+	}
+	if opts.MaxPeers <= 0 {
+		opts.MaxPeers = defaultMaxPeers
+	}
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+
+	s := &session{
+		torrent:     torrent,
+		peerID:      peerID,
+		opts:        opts,
+		storage:     store,
+		picker:      picker.New(len(torrent.Pieces)),
+		pieces:      make(map[int]*piece),
+		partial:     make(map[int]string),
+		conns:       make(map[*peer.Connection]bool),
+		pexSent:     make(map[*peer.Connection]map[string]peer.Peer),
+		pexReceived: make(map[*peer.Connection]time.Time),
+		finished:    make(chan struct{}),
+		exchanged:   make(chan []peer.Peer),
+		exits:       make(chan exit),
+		failed:      make(chan error, 1),
+	}
+	defer s.finish()
+
+	// peers are exchanged with the ones supporting the extension protocol
+	if opts.Extensions != nil {
+		opts.Extensions.Register(pexExtension, s.handlePEX)
+		s.spawn(s.exchangePeers)
+	}
+
+	// cancelling the context of the session aborts the connection attempts
+	// of the workers
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer s.saveResume(true)
+
+	for _, p := range opts.Partial {
+		s.partial[p.Index] = p.Blocks
+	}
+
+	donePieces, doneBytes := 0, 0
+	for index := range torrent.Pieces {
+		if store.IsComplete(index) {
+			s.picker.Done(index)
+			donePieces++
+			doneBytes += torrent.PieceSize(index)
+		}
 	}
+	if donePieces > 0 {
+		logger.Log(logger.Info, "resuming with %d of %d pieces already downloaded", donePieces, len(torrent.Pieces))
+	}
+	opts.Stats.Completed.Store(int64(doneBytes))
+
+	done := make(chan *piece, len(torrent.Peers))
 
-	donePieces := 0
-	bar := progressbar.DefaultBytes(
-		int64(torrent.Size),
-		"Downloading "+torrent.Name,
-	)
+	pool := newPool(opts.MaxPeers, opts.PreferIPv6)
+	pool.add(torrent.Peers, time.Now())
+	s.spawn(func() {
+		s.manage(ctx, pool, done)
+	})
+
+	bar := progressbar.DefaultBytesSilent(int64(torrent.Size))
+	if opts.Progress {
+		bar = progressbar.DefaultBytes(int64(torrent.Size), "Downloading "+torrent.Name)
+	}
+	_ = bar.Add(doneBytes)
 	for donePieces < len(torrent.Pieces) {
-		res := <-done
-		offset := int64(res.id * torrent.PieceLength)
-		_, err := w.WriteAt(res.result, offset)
+		var res *piece
+		select {
+		case res = <-done:
+		case err := <-s.failed:
+			logger.Log(logger.Info, "download failed with %d of %d pieces downloaded", donePieces, len(torrent.Pieces))
+			return err
+		case <-ctx.Done():
+			logger.Log(logger.Info, "download stopped with %d of %d pieces downloaded", donePieces, len(torrent.Pieces))
+			return ctx.Err()
+		}
+
+		if store.IsComplete(res.index) {
+			continue
+		}
+
+		err := store.WriteBlock(res.index, 0, res.data)
+		if err != nil {
+			return fmt.Errorf("failed writing piece %d: %w", res.index, err)
+		}
+		err = s.markDone(res.index)
 		if err != nil {
-			return fmt.Errorf("failed writing response for piece %d at offset  %d: %w", res.id, offset, err)
+			return err
 		}
+		s.saveResume(false)
 
-		_ = bar.Add(torrent.PieceLength)
+		_ = bar.Add(len(res.data))
 		donePieces++
+		opts.Stats.Completed.Add(int64(len(res.data)))
+		s.emit(Event{Type: PieceVerified, Piece: res.index})
 
 		percent := float64(donePieces) / float64(len(torrent.Pieces)) * 100
-		logger.Log(logger.Info, "downloaded piece %d", res.id)
+		logger.Log(logger.Info, "downloaded piece %d", res.index)
 		logger.Log(logger.Info, "progress: (%0.2f%%)", percent)
 	}
 
-	close(jobs)
-	close(done)
 	_ = bar.Close()
+	// the last pieces are recorded right away rather than when seeding stops
+	s.saveResume(true)
+	s.emit(Event{Type: Completed})
+
+	if opts.Seed {
+		logger.Log(logger.Info, "download complete, seeding until stopped")
+		<-ctx.Done()
+	}
 
 	return nil
 }
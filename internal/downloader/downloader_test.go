@@ -0,0 +1,774 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xanish/torrenty/internal/handshake"
+	"github.com/xanish/torrenty/internal/message"
+	"github.com/xanish/torrenty/internal/metadata"
+	"github.com/xanish/torrenty/internal/peer"
+	"github.com/xanish/torrenty/internal/picker"
+	"github.com/xanish/torrenty/internal/storage"
+)
+
+// memStorage returns an in-memory storage for the torrent holding data, which
+// may be nil to start empty.
+func memStorage(t *testing.T, torrent metadata.Metadata, data []byte) *storage.Memory {
+	t.Helper()
+
+	store := storage.NewMemory(torrent)
+	for index := 0; index*torrent.PieceLength < len(data); index++ {
+		begin := index * torrent.PieceLength
+		err := store.WriteBlock(index, 0, data[begin:begin+torrent.PieceSize(index)])
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	return store
+}
+
+// stored returns the data held by store for the torrent.
+func stored(t *testing.T, torrent metadata.Metadata, store storage.Storage) []byte {
+	t.Helper()
+
+	data := make([]byte, torrent.Size)
+	for index := range torrent.Pieces {
+		begin := index * torrent.PieceLength
+		err := store.ReadBlock(index, 0, data[begin:begin+torrent.PieceSize(index)])
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	return data
+}
+
+// testTorrent returns a torrent made of random content split in pieces of
+// pieceLength bytes.
+func testTorrent(size, pieceLength int) (metadata.Metadata, []byte) {
+	content := make([]byte, size)
+	rand.Read(content)
+
+	torrent := metadata.Metadata{
+		Name:        "test",
+		Size:        size,
+		PieceLength: pieceLength,
+		InfoHash:    [20]byte{1, 2, 3},
+	}
+	for begin := 0; begin < size; begin += pieceLength {
+		torrent.Pieces = append(torrent.Pieces, sha1.Sum(content[begin:min(begin+pieceLength, size)]))
+	}
+
+	return torrent, content
+}
+
+// fakeSeeder is a remote peer that has every piece of content. Requests are
+// collected until the client stops sending them for a moment and are then
+// answered in reverse order.
+type fakeSeeder struct {
+	content     []byte
+	pieceLength int
+
+	// startChoked delays the first UnChoke until the client has been idle
+	// for a moment, neverUnchoke keeps the client choked forever, and
+	// chokeAfter chokes the client once after that many blocks, discarding
+	// the requests not answered yet.
+	startChoked  bool
+	neverUnchoke bool
+	chokeAfter   int
+
+	// stall never answers any request.
+	stall bool
+
+	// id is the peer id of the seeder, derived from its port unless set.
+	id [20]byte
+
+	mu             sync.Mutex
+	maxOutstanding int
+	requestsChoked int
+	cancels        int
+	blocks         int
+	requested      map[int]bool
+}
+
+func startFakeSeeder(t *testing.T, s *fakeSeeder) peer.Peer {
+	return listenFakeSeeder(t, s, "127.0.0.1:0")
+}
+
+// listenFakeSeeder starts s on the given address.
+func listenFakeSeeder(t *testing.T, s *fakeSeeder, address string) peer.Peer {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	addr := l.Addr().(*net.TCPAddr)
+	if s.id == [20]byte{} {
+		s.id = [20]byte{9, byte(addr.Port >> 8), byte(addr.Port)}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (s *fakeSeeder) serve(conn net.Conn) {
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	req, err := handshake.Unmarshal(conn)
+	if err != nil {
+		return
+	}
+
+	res := handshake.New(req.InfoHash, s.id)
+	marshaled, _ := res.Marshal()
+	_, _ = conn.Write(marshaled)
+
+	numPieces := (len(s.content) + s.pieceLength - 1) / s.pieceLength
+	bitfield := make([]byte, (numPieces+7)/8)
+	for i := range bitfield {
+		bitfield[i] = 0xff
+	}
+	_, _ = conn.Write(message.NewBitfield(bitfield).Marshal())
+
+	choked := s.startChoked || s.neverUnchoke
+	unchokedOnce := !choked
+	if !choked {
+		_, _ = conn.Write(message.NewUnChoke().Marshal())
+	}
+
+	messages := make(chan *message.Message)
+	go func() {
+		defer close(messages)
+		for {
+			msg, err := message.Unmarshal(conn)
+			if err != nil {
+				return
+			}
+			messages <- msg
+		}
+	}()
+
+	answered, chokedOnce := 0, false
+	var pending []*message.Message
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			if msg != nil && msg.ID == message.Cancel {
+				s.mu.Lock()
+				s.cancels++
+				s.mu.Unlock()
+			}
+			if msg == nil || msg.ID != message.Request || s.stall {
+				continue
+			}
+			s.mu.Lock()
+			if !unchokedOnce {
+				s.requestsChoked++
+			}
+			if s.requested == nil {
+				s.requested = make(map[int]bool)
+			}
+			index, _, _, _ := message.ParseRequest(msg)
+			s.requested[index] = true
+			s.blocks++
+			s.mu.Unlock()
+			pending = append(pending, msg)
+		case <-time.After(20 * time.Millisecond):
+			if choked {
+				// requests made while choked are discarded
+				pending = nil
+				if !s.neverUnchoke {
+					choked, unchokedOnce = false, true
+					_, _ = conn.Write(message.NewUnChoke().Marshal())
+				}
+				continue
+			}
+
+			s.mu.Lock()
+			s.maxOutstanding = max(s.maxOutstanding, len(pending))
+			s.mu.Unlock()
+
+			for i := len(pending) - 1; i >= 0; i-- {
+				if s.chokeAfter > 0 && answered == s.chokeAfter && !chokedOnce {
+					choked, chokedOnce = true, true
+					_, _ = conn.Write(message.NewChoke().Marshal())
+					break
+				}
+
+				index, begin, length, _ := message.ParseRequest(pending[i])
+				offset := index*s.pieceLength + begin
+				_, _ = conn.Write(message.NewPiece(index, begin, s.content[offset:offset+length]).Marshal())
+				answered++
+			}
+			pending = nil
+		}
+	}
+}
+
+func TestDownloadPipelinesRequests(t *testing.T) {
+	torrent, content := testTorrent(200*1024+123, 64*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	out := memStorage(t, torrent, nil)
+	err := Download(context.Background(), [20]byte{7}, torrent, out, Options{MaxRequests: 6})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if !bytes.Equal(stored(t, torrent, out), content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if seeder.maxOutstanding != 6 {
+		t.Errorf("expected 6 requests to be in flight, got %d", seeder.maxOutstanding)
+	}
+}
+
+func TestDownloadReportsEvents(t *testing.T) {
+	torrent, content := testTorrent(100*1024, 32*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	var (
+		mu     sync.Mutex
+		events []EventType
+	)
+	stats := &Stats{}
+	err := Download(context.Background(), [20]byte{7}, torrent, memStorage(t, torrent, nil), Options{
+		Stats: stats,
+		Events: func(e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e.Type)
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	counts := make(map[EventType]int)
+	for _, e := range events {
+		counts[e]++
+	}
+	if counts[PieceVerified] != len(torrent.Pieces) {
+		t.Errorf("expected %d verified pieces, got %d", len(torrent.Pieces), counts[PieceVerified])
+	}
+	if counts[PeerConnected] != 1 || counts[PeerDisconnected] != 1 {
+		t.Errorf("expected the peer to connect and disconnect once, got %v", counts)
+	}
+	if counts[Completed] != 1 {
+		t.Errorf("expected the download to complete once, got %d", counts[Completed])
+	}
+
+	if stats.Completed.Load() != int64(len(content)) || stats.Downloaded.Load() != int64(len(content)) {
+		t.Errorf("expected %d bytes downloaded and completed, got %d and %d", len(content), stats.Downloaded.Load(), stats.Completed.Load())
+	}
+	if stats.Peers.Load() != 0 {
+		t.Errorf("expected no peer to be left connected, got %d", stats.Peers.Load())
+	}
+}
+
+func TestDownloadConnectsToDiscoveredPeers(t *testing.T) {
+	torrent, content := testTorrent(100*1024, 32*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	remote := startFakeSeeder(t, seeder)
+
+	// the download starts without peers, they are found while it runs
+	peers := make(chan []peer.Peer, 1)
+	peers <- []peer.Peer{remote, remote}
+
+	out := memStorage(t, torrent, nil)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Download(context.Background(), [20]byte{7}, torrent, out, Options{Peers: peers})
+	}()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the download to complete from the discovered peer")
+	}
+
+	if !bytes.Equal(stored(t, torrent, out), content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+}
+
+// deadPeer returns the address of a peer refusing connections.
+func deadPeer(t *testing.T) peer.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	_ = l.Close()
+
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestDownloadReplacesFailedPeers(t *testing.T) {
+	torrent, content := testTorrent(100*1024, 32*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	torrent.Peers = []peer.Peer{deadPeer(t), startFakeSeeder(t, seeder)}
+
+	// only one peer is connected to at a time, the seeder once the dead peer
+	// failed
+	out := memStorage(t, torrent, nil)
+	err := Download(context.Background(), [20]byte{7}, torrent, out, Options{MaxPeers: 1})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if !bytes.Equal(stored(t, torrent, out), content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+}
+
+func TestDownloadRunsOutOfPeers(t *testing.T) {
+	retry, timeout := peerRetryInterval, noPeersTimeout
+	peerRetryInterval, noPeersTimeout = 10*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() {
+		peerRetryInterval, noPeersTimeout = retry, timeout
+	})
+
+	torrent, _ := testTorrent(100*1024, 32*1024)
+	torrent.Peers = []peer.Peer{deadPeer(t)}
+
+	var mu sync.Mutex
+	needed := 0
+	events := func(e Event) {
+		if e.Type == PeersNeeded {
+			mu.Lock()
+			needed++
+			mu.Unlock()
+		}
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Download(context.Background(), [20]byte{7}, torrent, memStorage(t, torrent, nil), Options{Events: events})
+	}()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrNoPeers) {
+			t.Fatalf("expected error to be %v, got %v", ErrNoPeers, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the download to fail once the peer was retired")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if needed != 1 {
+		t.Errorf("expected peers to be asked for once, got %d", needed)
+	}
+}
+
+func TestDownloadRejectsInboundPeersOverMaxPeers(t *testing.T) {
+	torrent, content := testTorrent(100*1024, 32*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, stall: true}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	connected := make(chan struct{}, 1)
+	events := func(e Event) {
+		if e.Type == PeerConnected {
+			connected <- struct{}{}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	incoming := make(chan *peer.Connection)
+	go func() {
+		out := memStorage(t, torrent, nil)
+		errs <- Download(ctx, [20]byte{7}, torrent, out, Options{MaxPeers: 1, Incoming: incoming, Events: events})
+	}()
+	defer func() {
+		cancel()
+		<-errs
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the seeder to be connected")
+	}
+
+	// the only peer slot is taken by the seeder
+	local, remote := net.Pipe()
+	defer func(remote net.Conn) {
+		_ = remote.Close()
+	}(remote)
+	incoming <- &peer.Connection{Conn: local, Peer: peer.Peer{IP: net.IPv4(127, 0, 0, 2), Port: 6881}, Inbound: true}
+
+	_ = remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := remote.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected the inbound connection to be closed, got %v", err)
+	}
+}
+
+func TestDownloadConnectsToDualStackPeerOnce(t *testing.T) {
+	torrent, content := testTorrent(100*1024, 32*1024)
+
+	tests := map[string]struct {
+		preferIPv6 bool
+	}{
+		"should download over ipv4 by default":   {},
+		"should download over ipv6 if preferred": {preferIPv6: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			probe, err := net.Listen("tcp", "[::1]:0")
+			if err != nil {
+				t.Skipf("ipv6 is not available: %v", err)
+			}
+			_ = probe.Close()
+
+			// the same seeder listens on both families
+			v4 := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, id: [20]byte{9, 4, 6}}
+			v6 := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, id: v4.id}
+			torrent.Peers = []peer.Peer{listenFakeSeeder(t, v6, "[::1]:0"), startFakeSeeder(t, v4)}
+
+			var mu sync.Mutex
+			var connected []peer.Peer
+			events := func(e Event) {
+				if e.Type == PeerConnected {
+					mu.Lock()
+					connected = append(connected, e.Peer)
+					mu.Unlock()
+				}
+			}
+
+			out := memStorage(t, torrent, nil)
+			err = Download(context.Background(), [20]byte{7}, torrent, out, Options{PreferIPv6: test.preferIPv6, Events: events})
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+
+			if !bytes.Equal(stored(t, torrent, out), content) {
+				t.Errorf("expected downloaded data to match the content")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(connected) != 1 || connected[0].IsIPv6() != test.preferIPv6 {
+				t.Errorf("expected to connect once over the preferred family, got %v", connected)
+			}
+		})
+	}
+}
+
+func TestDownloadRespectsChoke(t *testing.T) {
+	torrent, content := testTorrent(200*1024+123, 64*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, startChoked: true, chokeAfter: 5}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	out := memStorage(t, torrent, nil)
+	err := Download(context.Background(), [20]byte{7}, torrent, out, Options{MaxRequests: 4})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if !bytes.Equal(stored(t, torrent, out), content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if seeder.requestsChoked != 0 {
+		t.Errorf("expected no requests before being unchoked, got %d", seeder.requestsChoked)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	torrent, content := testTorrent(100*1024+7, 32*1024)
+	data := bytes.Clone(content)
+	data[32*1024+5] ^= 0xff
+
+	store := memStorage(t, torrent, data)
+	err := Verify(context.Background(), torrent, store)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if have, want := store.Bitfield(), []byte{0b10110000}; !bytes.Equal(have, want) {
+		t.Errorf("expected every piece but the corrupted one to be verified, got %08b", have)
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	torrent, content := testTorrent(128*1024, 32*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	// pieces 0 and 2 survived an interrupted run
+	data := make([]byte, len(content))
+	copy(data[0:32*1024], content)
+	copy(data[64*1024:96*1024], content[64*1024:])
+	out := memStorage(t, torrent, data)
+
+	err := Verify(context.Background(), torrent, out)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	err = Download(context.Background(), [20]byte{7}, torrent, out, Options{})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if !bytes.Equal(stored(t, torrent, out), content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if len(seeder.requested) != 2 || !seeder.requested[1] || !seeder.requested[3] {
+		t.Errorf("expected only the missing pieces 1 and 3 to be requested, got %v", seeder.requested)
+	}
+}
+
+func TestDownloadEndgame(t *testing.T) {
+	torrent, content := testTorrent(8*32*1024, 32*1024)
+	fast := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	slow := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, stall: true}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, fast), startFakeSeeder(t, slow)}
+
+	out := memStorage(t, torrent, nil)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Download(context.Background(), [20]byte{7}, torrent, out, Options{MaxRequests: 4})
+	}()
+
+	// without endgame mode the pieces picked for the stalling peer are never
+	// downloaded
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the download to complete despite the stalling peer")
+	}
+
+	if !bytes.Equal(stored(t, torrent, out), content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+
+	// the cancels are sent before the download completes, but may not have
+	// been read by the stalling peer yet
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		slow.mu.Lock()
+		cancels := slow.cancels
+		slow.mu.Unlock()
+
+		if cancels > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the requests to the stalling peer to be cancelled")
+		}
+	}
+}
+
+func TestDownloadCancel(t *testing.T) {
+	torrent, content := testTorrent(64*1024, 32*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, stall: true}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Download(ctx, [20]byte{7}, torrent, memStorage(t, torrent, nil), Options{})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the download to stop")
+	}
+}
+
+func TestVerifyCancel(t *testing.T) {
+	torrent, content := testTorrent(64*1024, 32*1024)
+	out := memStorage(t, torrent, content)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := Verify(ctx, torrent, out)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if out.IsComplete(0) || out.IsComplete(1) {
+		t.Errorf("expected no piece to be verified once cancelled")
+	}
+}
+
+func TestWorkerUnchokeTimeout(t *testing.T) {
+	timeout := unchokeTimeout
+	unchokeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		unchokeTimeout = timeout
+	})
+
+	torrent, content := testTorrent(64*1024, 16*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, neverUnchoke: true}
+	remote := startFakeSeeder(t, seeder)
+
+	s := &session{
+		torrent:  torrent,
+		opts:     Options{MaxRequests: 4, Stats: &Stats{}},
+		picker:   picker.New(len(torrent.Pieces)),
+		storage:  memStorage(t, torrent, nil),
+		pieces:   make(map[int]*piece),
+		conns:    make(map[*peer.Connection]bool),
+		finished: make(chan struct{}),
+	}
+
+	_, err := s.executeWorker(context.Background(), 0, remote, make(chan *piece))
+	if err == nil || !strings.Contains(err.Error(), "did not unchoke") {
+		t.Errorf("expected the worker to give up on the choking peer, got %v", err)
+	}
+}
+
+func TestWorkerRequestTimeout(t *testing.T) {
+	timeout := requestTimeout
+	requestTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		requestTimeout = timeout
+	})
+
+	torrent, content := testTorrent(64*1024, 16*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength, stall: true}
+	remote := startFakeSeeder(t, seeder)
+
+	s := &session{
+		torrent:  torrent,
+		opts:     Options{MaxRequests: 4, Stats: &Stats{}},
+		picker:   picker.New(len(torrent.Pieces)),
+		storage:  memStorage(t, torrent, nil),
+		pieces:   make(map[int]*piece),
+		conns:    make(map[*peer.Connection]bool),
+		finished: make(chan struct{}),
+	}
+
+	_, err := s.executeWorker(context.Background(), 0, remote, make(chan *piece))
+	if err == nil || !strings.Contains(err.Error(), "did not answer our requests") {
+		t.Errorf("expected the worker to give up on the stalling peer, got %v", err)
+	}
+
+	// the pieces requested from the peer can be picked for other peers
+	if missing := s.picker.Missing(); missing != len(torrent.Pieces) {
+		t.Errorf("expected every piece to be released, got %d missing", missing)
+	}
+}
+
+func TestUploadHonoursCancel(t *testing.T) {
+	torrent, content := testTorrent(64*1024, 32*1024)
+	local, remote := net.Pipe()
+	defer func(local, remote net.Conn) {
+		_ = local.Close()
+		_ = remote.Close()
+	}(local, remote)
+
+	s := &session{
+		torrent: torrent,
+		opts:    Options{Stats: &Stats{}},
+		storage: memStorage(t, torrent, content),
+	}
+	_ = s.storage.MarkComplete(0)
+	_ = s.storage.MarkComplete(1)
+	conn := &peer.Connection{Conn: local, PeerChoked: false}
+	w := &worker{conn: conn}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		_ = s.upload(conn, done)
+	}()
+
+	send := func(msg *message.Message) {
+		go func() {
+			_, _ = remote.Write(msg.Marshal())
+		}()
+
+		_, err := s.readMessage(w)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	// The first block is picked up right away, and sending it blocks until it
+	// is read below. The requests made meanwhile stay queued, so that the
+	// second one can be cancelled before it is served.
+	send(message.NewRequest(0, 0, maxDownloadBlockSize))
+	send(message.NewRequest(0, maxDownloadBlockSize, maxDownloadBlockSize))
+	send(message.NewCancel(0, maxDownloadBlockSize, maxDownloadBlockSize))
+	send(message.NewRequest(1, 0, maxDownloadBlockSize))
+
+	for _, want := range []struct{ index, begin int }{{0, 0}, {1, 0}} {
+		msg, err := message.Unmarshal(remote)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+
+		index, begin, block, err := message.ParseBlock(msg)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+		if index != want.index || begin != want.begin {
+			t.Errorf("expected block %d of piece %d, got block %d of piece %d", want.begin, want.index, begin, index)
+		}
+
+		offset := index*torrent.PieceLength + begin
+		if !bytes.Equal(block, content[offset:offset+maxDownloadBlockSize]) {
+			t.Errorf("expected block %d of piece %d to match the content", begin, index)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+const (
+	// pexExtension is the name of the peer exchange extension (BEP 11),
+	// negotiated through the extension protocol.
+	pexExtension = "ut_pex"
+
+	// maxPEXPeers is the most peers added, and the most dropped, by a single
+	// ut_pex message. Peers beyond it are sent with the next messages, and
+	// ignored when received.
+	maxPEXPeers = 50
+
+	// pexReachable flags an added peer that accepts incoming connections, as
+	// we connected to it. The other flags (encryption, seed, utp, holepunch)
+	// are never set.
+	pexReachable = 0x10
+)
+
+// pexInterval is the interval between the ut_pex messages sent to a peer. The
+// messages a peer sends sooner than half of it after the previous one are
+// ignored, as the de-facto spec allows at most one message per minute.
+var pexInterval = time.Minute
+
+// pexMessage is the payload of a ut_pex message. Added and Dropped hold the
+// compact addresses of IPv4 peers, and Added6 and Dropped6 the ones of IPv6
+// peers. AddedF and Added6F hold a byte of flags per added peer.
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// add appends p to the added peers of the message.
+func (m *pexMessage) add(p peer.Peer) {
+	if p.IP.To4() != nil {
+		m.Added += string(p.Compact())
+		m.AddedF += string(rune(pexReachable))
+	} else {
+		m.Added6 += string(p.Compact())
+		m.Added6F += string(rune(pexReachable))
+	}
+}
+
+// drop appends p to the dropped peers of the message.
+func (m *pexMessage) drop(p peer.Peer) {
+	if p.IP.To4() != nil {
+		m.Dropped += string(p.Compact())
+	} else {
+		m.Dropped6 += string(p.Compact())
+	}
+}
+
+// peers returns the peers added by the message, up to maxPEXPeers of each IP
+// family. Peers without a port are skipped.
+func (m *pexMessage) peers() ([]peer.Peer, error) {
+	added, err := peer.ParseCompact([]byte(m.Added), 4)
+	if err != nil {
+		return nil, fmt.Errorf("invalid added peers: %w", err)
+	}
+	added6, err := peer.ParseCompact([]byte(m.Added6), 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid added6 peers: %w", err)
+	}
+
+	var peers []peer.Peer
+	for _, family := range [][]peer.Peer{added, added6} {
+		for _, p := range family[:min(len(family), maxPEXPeers)] {
+			if p.Port != 0 {
+				peers = append(peers, p)
+			}
+		}
+	}
+
+	return peers, nil
+}
+
+// pexDiff builds the message telling a peer that was last told about sent
+// about the peers connected now, leaving out the peer itself at self. At most
+// maxPEXPeers peers are added and dropped, and sent is updated to what the
+// peer has been told. It reports false when there is nothing to tell.
+func pexDiff(sent, connected map[string]peer.Peer, self string) (pexMessage, bool) {
+	msg := pexMessage{}
+	added, dropped := 0, 0
+	for addr, p := range connected {
+		if _, ok := sent[addr]; ok || addr == self || added == maxPEXPeers {
+			continue
+		}
+		msg.add(p)
+		sent[addr] = p
+		added++
+	}
+	for addr, p := range sent {
+		if _, ok := connected[addr]; ok || dropped == maxPEXPeers {
+			continue
+		}
+		msg.drop(p)
+		delete(sent, addr)
+		dropped++
+	}
+
+	return msg, added+dropped > 0
+}
+
+// exchangePeers sends the changes to the connected peers to every peer that
+// supports ut_pex each pexInterval, until the session finishes.
+func (s *session) exchangePeers() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.finished:
+			return
+		}
+
+		s.sendPEX()
+	}
+}
+
+// sendPEX sends a ut_pex message to every connected peer that supports it and
+// has something to be told. Only the peers we connected to are advertised, as
+// the address of an inbound peer is not one it accepts connections on.
+func (s *session) sendPEX() {
+	type outgoing struct {
+		conn    *peer.Connection
+		payload []byte
+	}
+
+	s.mu.Lock()
+	connected := make(map[string]peer.Peer)
+	for conn := range s.conns {
+		if !conn.Inbound {
+			connected[conn.Peer.String()] = conn.Peer
+		}
+	}
+
+	var out []outgoing
+	for conn := range s.conns {
+		if !conn.SupportsExtension(pexExtension) {
+			continue
+		}
+
+		sent, ok := s.pexSent[conn]
+		if !ok {
+			sent = make(map[string]peer.Peer)
+			s.pexSent[conn] = sent
+		}
+		msg, ok := pexDiff(sent, connected, conn.Peer.String())
+		if !ok {
+			continue
+		}
+
+		var payload bytes.Buffer
+		err := bencode.Marshal(&payload, msg)
+		if err != nil {
+			logger.Log(logger.Error, "failed to encode ut_pex message: %s", err)
+			continue
+		}
+		out = append(out, outgoing{conn: conn, payload: payload.Bytes()})
+	}
+	s.mu.Unlock()
+
+	for _, o := range out {
+		err := o.conn.SendExtended(pexExtension, o.payload)
+		if err != nil {
+			logger.Log(logger.Debug, "sending ut_pex message to peer %s failed: %s", o.conn.Peer.String(), err)
+		}
+	}
+}
+
+// handlePEX processes a ut_pex message received from the peer of conn, handing
+// the peers it adds to the goroutine managing the pool. Messages arriving
+// before the connection is tracked, or sooner than pexInterval/2 after the
+// previous one, are ignored. Dropped peers are not acted upon, as they may
+// still be reachable by us.
+func (s *session) handlePEX(conn *peer.Connection, payload []byte) error {
+	now := time.Now()
+	s.mu.Lock()
+	last, ok := s.pexReceived[conn]
+	if !s.conns[conn] || (ok && now.Sub(last) < pexInterval/2) {
+		s.mu.Unlock()
+		logger.Log(logger.Debug, "ignoring ut_pex message from peer %s", conn.Peer.String())
+		return nil
+	}
+	s.pexReceived[conn] = now
+	s.mu.Unlock()
+
+	msg := pexMessage{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &msg)
+	if err != nil {
+		return fmt.Errorf("failed to decode ut_pex message: %w", err)
+	}
+
+	peers, err := msg.peers()
+	if err != nil {
+		return fmt.Errorf("failed to decode ut_pex message: %w", err)
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	logger.Log(logger.Debug, "peer %s exchanged %d peers", conn.Peer.String(), len(peers))
+	select {
+	case s.exchanged <- peers:
+	case <-s.finished:
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/handshake"
+	"github.com/xanish/torrenty/internal/message"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+func TestPEXDiff(t *testing.T) {
+	a := peer.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	b := peer.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	c := peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+	connected := map[string]peer.Peer{a.String(): a, b.String(): b, c.String(): c}
+
+	// the peer told about is left out
+	sent := map[string]peer.Peer{}
+	msg, ok := pexDiff(sent, connected, a.String())
+	if !ok {
+		t.Fatalf("expected peers to be added")
+	}
+	if msg.Added != string(b.Compact()) || msg.AddedF != "\x10" || msg.Added6 != string(c.Compact()) || msg.Added6F != "\x10" {
+		t.Errorf("expected b and c to be added as reachable, got %+v", msg)
+	}
+
+	_, ok = pexDiff(sent, connected, a.String())
+	if ok {
+		t.Errorf("expected nothing to tell without changes")
+	}
+
+	delete(connected, c.String())
+	msg, ok = pexDiff(sent, connected, a.String())
+	if !ok || msg.Added != "" || msg.Dropped6 != string(c.Compact()) {
+		t.Errorf("expected c to be dropped, got %+v", msg)
+	}
+
+	// additions are capped, the rest are sent with the next message
+	connected = map[string]peer.Peer{}
+	for i := range maxPEXPeers + 10 {
+		p := peer.Peer{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 6881}
+		connected[p.String()] = p
+	}
+	sent = map[string]peer.Peer{}
+	msg, _ = pexDiff(sent, connected, "")
+	if len(msg.Added) != maxPEXPeers*6 {
+		t.Errorf("expected %d peers to be added, got %d", maxPEXPeers, len(msg.Added)/6)
+	}
+	msg, _ = pexDiff(sent, connected, "")
+	if len(msg.Added) != 10*6 {
+		t.Errorf("expected the remaining 10 peers to be added, got %d", len(msg.Added)/6)
+	}
+}
+
+func TestPEXMessagePeers(t *testing.T) {
+	a := peer.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	c := peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6882}
+	msg := pexMessage{}
+	msg.add(a)
+	msg.add(c)
+	msg.add(peer.Peer{IP: net.IPv4(10, 0, 0, 3)})
+
+	var payload bytes.Buffer
+	err := bencode.Marshal(&payload, msg)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	decoded := pexMessage{}
+	err = bencode.Unmarshal(&payload, &decoded)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	peers, err := decoded.peers()
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if len(peers) != 2 || peers[0].String() != a.String() || peers[1].String() != c.String() {
+		t.Errorf("expected peers %s and %s without the one lacking a port, got %v", a, c, peers)
+	}
+
+	_, err = (&pexMessage{Added: "short"}).peers()
+	if err == nil {
+		t.Errorf("expected truncated added peers to fail")
+	}
+}
+
+func TestHandlePEXRateLimit(t *testing.T) {
+	s := &session{
+		conns:       make(map[*peer.Connection]bool),
+		pexReceived: make(map[*peer.Connection]time.Time),
+		finished:    make(chan struct{}),
+		exchanged:   make(chan []peer.Peer, 2),
+	}
+	conn := &peer.Connection{}
+	s.conns[conn] = true
+
+	msg := pexMessage{}
+	msg.add(peer.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	var payload bytes.Buffer
+	_ = bencode.Marshal(&payload, msg)
+
+	for range 2 {
+		err := s.handlePEX(conn, payload.Bytes())
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	if len(s.exchanged) != 1 {
+		t.Errorf("expected the second message to be ignored, got %d deliveries", len(s.exchanged))
+	}
+
+	// messages are accepted again after half the interval
+	s.pexReceived[conn] = time.Now().Add(-pexInterval / 2)
+	_ = s.handlePEX(conn, payload.Bytes())
+	if len(s.exchanged) != 2 {
+		t.Errorf("expected the later message to be accepted, got %d deliveries", len(s.exchanged))
+	}
+}
+
+// startPEXPeer starts a remote peer that has no piece and supports ut_pex. It
+// tells the client about added once connected, and delivers the ut_pex
+// messages of the client on received.
+func startPEXPeer(t *testing.T, added peer.Peer, numPieces int, received chan<- pexMessage) peer.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func(conn net.Conn) {
+			_ = conn.Close()
+		}(conn)
+
+		req, err := handshake.Unmarshal(conn)
+		if err != nil {
+			return
+		}
+		res := handshake.New(req.InfoHash, [20]byte{8})
+		marshaled, _ := res.Marshal()
+		_, _ = conn.Write(marshaled)
+
+		var hs bytes.Buffer
+		_ = bencode.Marshal(&hs, peer.ExtendedHandshake{M: map[string]int{pexExtension: 1}})
+		_, _ = conn.Write(message.NewExtended(0, hs.Bytes()).Marshal())
+		_, _ = conn.Write(message.NewBitfield(make([]byte, (numPieces+7)/8)).Marshal())
+
+		msg := pexMessage{}
+		msg.add(added)
+		var payload bytes.Buffer
+		_ = bencode.Marshal(&payload, msg)
+		_, _ = conn.Write(message.NewExtended(1, payload.Bytes()).Marshal())
+
+		for {
+			msg, err := message.Unmarshal(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != message.Extended {
+				continue
+			}
+
+			id, payload, _ := message.ParseExtended(msg)
+			pm := pexMessage{}
+			if id != 1 || bencode.Unmarshal(bytes.NewReader(payload), &pm) != nil {
+				continue
+			}
+			select {
+			case received <- pm:
+			default:
+			}
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestDownloadExchangesPeers(t *testing.T) {
+	defer func(d time.Duration) {
+		pexInterval = d
+	}(pexInterval)
+	pexInterval = 50 * time.Millisecond
+
+	torrent, content := testTorrent(100*1024, 32*1024)
+	seeder := startFakeSeeder(t, &fakeSeeder{content: content, pieceLength: torrent.PieceLength})
+
+	// the seeder is only known through the peer exchanging it
+	received := make(chan pexMessage, 10)
+	torrent.Peers = []peer.Peer{startPEXPeer(t, seeder, len(torrent.Pieces), received)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := memStorage(t, torrent, nil)
+	completed := make(chan struct{})
+	opts := Options{
+		Extensions: peer.NewExtensions(),
+		Seed:       true,
+		Events: func(e Event) {
+			if e.Type == Completed {
+				close(completed)
+			}
+		},
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Download(ctx, [20]byte{7}, torrent, out, opts)
+	}()
+
+	// once connected to the seeder, it is exchanged with the other peer
+	timeout := time.After(10 * time.Second)
+	for advertised := false; !advertised; {
+		select {
+		case msg := <-received:
+			advertised = msg.Added == string(seeder.Compact()) && msg.AddedF == "\x10"
+		case err := <-errs:
+			t.Fatalf("expected the download to keep seeding, got %v", err)
+		case <-timeout:
+			t.Fatalf("expected the seeder to be exchanged")
+		}
+	}
+
+	select {
+	case <-completed:
+	case <-timeout:
+		t.Fatalf("expected the download to complete from the exchanged seeder")
+	}
+
+	cancel()
+	<-errs
+	if !bytes.Equal(stored(t, torrent, out), content) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+}
@@ -0,0 +1,307 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+const (
+	// defaultMaxPeers is the number of peers connected to at once unless
+	// configured otherwise.
+	defaultMaxPeers = 30
+
+	// maxPeerFailures is the number of times in a row a peer may fail before
+	// it is retired and never connected to again.
+	maxPeerFailures = 3
+)
+
+var (
+	// peerRetryInterval is the delay before connecting again to a peer that
+	// failed, doubled after every further failure.
+	peerRetryInterval = 30 * time.Second
+
+	// noPeersTimeout is how long a download waits for new peers once no peer
+	// is connected or left to connect to, before failing with ErrNoPeers.
+	noPeersTimeout = 2 * time.Minute
+
+	// fallbackDelay is the head start of the peers of the preferred IP family
+	// over the others, so that a peer reachable on both is connected to
+	// through the preferred family.
+	fallbackDelay = 300 * time.Millisecond
+)
+
+// ErrNoPeers is returned by Download when no peer is connected or left to
+// connect to, and no new one turned up in time.
+var ErrNoPeers = errors.New("no usable peers left")
+
+// errDuplicatePeer is the error of a worker connected to a peer id that
+// another worker is connected to, typically through the other IP family.
+var errDuplicatePeer = errors.New("duplicate connection to peer")
+
+// candidate is a peer the pool may connect to.
+type candidate struct {
+	peer peer.Peer
+
+	// failures counts the times in a row the worker of the peer failed, and
+	// retryAt is when the peer may be connected to (again). A retired peer is
+	// never connected to again, and an active one has a worker.
+	failures int
+	retryAt  time.Time
+	retired  bool
+	active   bool
+}
+
+// pool holds the peers of a download and decides which ones to connect to,
+// keeping up to target connections. It is only used by the goroutine managing
+// the workers of the session.
+type pool struct {
+	target     int
+	preferIPv6 bool
+	candidates map[string]*candidate
+	order      []*candidate
+
+	// outbound and inbound count the workers of the connections to and from
+	// peers.
+	outbound int
+	inbound  int
+}
+
+func newPool(target int, preferIPv6 bool) *pool {
+	return &pool{
+		target:     target,
+		preferIPv6: preferIPv6,
+		candidates: make(map[string]*candidate),
+	}
+}
+
+// add adds the peers that are not known yet as candidates at now. Peers are
+// connected to in the order they were added, the ones of the preferred IP
+// family first and the others after fallbackDelay.
+func (p *pool) add(peers []peer.Peer, now time.Time) {
+	for _, remote := range peers {
+		addr := remote.String()
+		if _, ok := p.candidates[addr]; ok {
+			continue
+		}
+
+		c := &candidate{peer: remote}
+		if remote.IsIPv6() != p.preferIPv6 {
+			c.retryAt = now.Add(fallbackDelay)
+		}
+		p.candidates[addr] = c
+		p.order = append(p.order, c)
+	}
+}
+
+// next returns the candidate to connect to next and marks it active, unless
+// target connections are active already or no candidate is due at now. The
+// candidates of the preferred IP family are connected to first.
+func (p *pool) next(now time.Time) (*candidate, bool) {
+	if p.full() {
+		return nil, false
+	}
+
+	for _, preferred := range []bool{true, false} {
+		for _, c := range p.order {
+			if c.active || c.retired || c.retryAt.After(now) {
+				continue
+			}
+			if (c.peer.IsIPv6() == p.preferIPv6) != preferred {
+				continue
+			}
+
+			c.active = true
+			p.outbound++
+
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// full reports whether target connections are active, counting both the
+// outbound and the inbound ones.
+func (p *pool) full() bool {
+	return p.outbound+p.inbound >= p.target
+}
+
+// exited records that the worker of c stopped with err, after receiving the
+// given number of bytes from the peer. A nil c stands for an inbound
+// connection. A peer that fails is connected to again after a backoff, unless
+// it failed maxPeerFailures times in a row without sending us anything or we
+// are connected to it through another address.
+func (p *pool) exited(c *candidate, received int, err error, now time.Time) {
+	if c == nil {
+		p.inbound--
+		return
+	}
+
+	p.outbound--
+	c.active = false
+	if received > 0 {
+		c.failures = 0
+	}
+	if err == nil {
+		return
+	}
+
+	c.failures++
+	if c.failures >= maxPeerFailures || errors.Is(err, errDuplicatePeer) {
+		c.retired = true
+		logger.Log(logger.Info, "retiring peer %s after %d failures: %s", c.peer.String(), c.failures, err)
+		return
+	}
+	c.retryAt = now.Add(peerRetryInterval << (c.failures - 1))
+}
+
+// starved reports whether no peer is connected and no candidate is left to
+// connect to.
+func (p *pool) starved() bool {
+	if p.outbound+p.inbound > 0 {
+		return false
+	}
+
+	for _, c := range p.order {
+		if !c.retired {
+			return false
+		}
+	}
+
+	return true
+}
+
+// wake returns when the first candidate waiting out its backoff is due, or
+// the zero time if there is none.
+func (p *pool) wake() time.Time {
+	var wake time.Time
+	for _, c := range p.order {
+		if c.active || c.retired || c.retryAt.IsZero() {
+			continue
+		}
+		if wake.IsZero() || c.retryAt.Before(wake) {
+			wake = c.retryAt
+		}
+	}
+
+	return wake
+}
+
+// exit reports a worker that stopped to the goroutine managing the pool.
+type exit struct {
+	candidate *candidate
+	received  int
+	err       error
+}
+
+// manage runs the workers of the session until it finishes. Connections to the
+// candidates of pool are kept up to its target while pieces are missing, and
+// the inbound connections are served as long as the target is not reached.
+// Peers delivered on Options.Peers or received with ut_pex become candidates.
+// Once no peer is connected or left to connect to, more peers are asked for
+// with a PeersNeeded event, and the download fails with ErrNoPeers unless one
+// turns up within noPeersTimeout.
+func (s *session) manage(ctx context.Context, pool *pool, results chan<- *piece) {
+	id := 0
+	var starvedAt time.Time
+	for {
+		now := time.Now()
+		for s.picker.Remaining() > 0 {
+			c, ok := pool.next(now)
+			if !ok {
+				break
+			}
+
+			s.dial(ctx, id, c, results)
+			id++
+		}
+
+		wake := pool.wake()
+		if pool.starved() && s.picker.Remaining() > 0 {
+			if starvedAt.IsZero() {
+				starvedAt = now
+				logger.Log(logger.Warning, "no usable peers left, waiting for new ones")
+				s.emit(Event{Type: PeersNeeded})
+			}
+
+			deadline := starvedAt.Add(noPeersTimeout)
+			if !now.Before(deadline) {
+				s.failed <- ErrNoPeers
+				return
+			}
+			if wake.IsZero() || deadline.Before(wake) {
+				wake = deadline
+			}
+		} else {
+			starvedAt = time.Time{}
+		}
+
+		// without anything due the timeout channel stays nil and never fires
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !wake.IsZero() {
+			timer = time.NewTimer(time.Until(wake))
+			timeout = timer.C
+		}
+
+		select {
+		case peers := <-s.opts.Peers:
+			pool.add(peers, time.Now())
+		case peers := <-s.exchanged:
+			pool.add(peers, time.Now())
+		case conn := <-s.opts.Incoming:
+			if pool.full() {
+				logger.Log(logger.Info, "rejecting inbound peer %s, %d peers connected already", conn.Peer.String(), pool.target)
+				_ = conn.Conn.Close()
+			} else {
+				pool.inbound++
+				s.accept(id, conn, results)
+				id++
+			}
+		case e := <-s.exits:
+			pool.exited(e.candidate, e.received, e.err, time.Now())
+		case <-timeout:
+		case <-s.finished:
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// dial starts a worker connecting to the peer of c.
+func (s *session) dial(ctx context.Context, id int, c *candidate, results chan<- *piece) {
+	logger.Log(logger.Info, "starting worker %d with peer %s", id, c.peer.String())
+	s.spawn(func() {
+		received, err := s.executeWorker(ctx, id, c.peer, results)
+		if err != nil {
+			logger.Log(logger.Error, "[worker:%d] failed with error: %s", id, err)
+		}
+		s.exited(exit{candidate: c, received: received, err: err})
+	})
+}
+
+// accept starts a worker serving an inbound connection.
+func (s *session) accept(id int, conn *peer.Connection, results chan<- *piece) {
+	logger.Log(logger.Info, "starting worker %d with inbound peer %s", id, conn.Peer.String())
+	s.spawn(func() {
+		received, err := s.work(id, conn, results)
+		if err != nil {
+			logger.Log(logger.Error, "[worker:%d] failed with error: %s", id, err)
+		}
+		s.exited(exit{received: received, err: err})
+	})
+}
+
+// exited reports a worker that stopped to the goroutine managing the pool.
+func (s *session) exited(e exit) {
+	select {
+	case s.exits <- e:
+	case <-s.finished:
+	}
+}
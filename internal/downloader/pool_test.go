@@ -0,0 +1,149 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+func TestPool(t *testing.T) {
+	errFailed := errors.New("connection refused")
+	first := peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	second := peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6882}
+	third := peer.Peer{IP: net.IPv6loopback, Port: 6883}
+	now := time.Now()
+
+	tests := map[string]struct {
+		target     int
+		preferIPv6 bool
+		peers      []peer.Peer
+		run        func(p *pool)
+		want       []peer.Peer
+		starved    bool
+	}{
+		"should connect to new peers in order": {
+			target: 5,
+			peers:  []peer.Peer{first, second, first},
+			want:   []peer.Peer{first, second},
+		},
+		"should connect to ipv4 peers first": {
+			target: 5,
+			peers:  []peer.Peer{third, first},
+			want:   []peer.Peer{first, third},
+		},
+		"should connect to ipv6 peers first if preferred": {
+			target:     5,
+			preferIPv6: true,
+			peers:      []peer.Peer{first, third, second},
+			want:       []peer.Peer{third, first, second},
+		},
+		"should give the preferred family a head start": {
+			target: 5,
+			run: func(p *pool) {
+				p.add([]peer.Peer{third, first}, now)
+			},
+			want: []peer.Peer{first},
+		},
+		"should not connect to more peers than the target": {
+			target: 1,
+			peers:  []peer.Peer{first, second},
+			want:   []peer.Peer{first},
+		},
+		"should count inbound connections towards the target": {
+			target: 1,
+			peers:  []peer.Peer{first},
+			run: func(p *pool) {
+				p.inbound++
+			},
+		},
+		"should back off from a failed peer": {
+			target: 5,
+			peers:  []peer.Peer{first, second},
+			run: func(p *pool) {
+				c, _ := p.next(now)
+				p.exited(c, 0, errFailed, now)
+			},
+			want: []peer.Peer{second},
+		},
+		"should retry a failed peer after the backoff": {
+			target: 5,
+			peers:  []peer.Peer{first},
+			run: func(p *pool) {
+				c, _ := p.next(now)
+				p.exited(c, 0, errFailed, now.Add(-peerRetryInterval))
+			},
+			want: []peer.Peer{first},
+		},
+		"should retire a peer that keeps failing": {
+			target: 5,
+			peers:  []peer.Peer{first},
+			run: func(p *pool) {
+				for i := 0; i < maxPeerFailures; i++ {
+					c, _ := p.next(now.Add(time.Hour))
+					p.exited(c, 0, errFailed, now)
+				}
+			},
+			starved: true,
+		},
+		"should retire a peer connected to through another address": {
+			target: 5,
+			peers:  []peer.Peer{first},
+			run: func(p *pool) {
+				c, _ := p.next(now)
+				p.exited(c, 0, fmt.Errorf("%w %s", errDuplicatePeer, first), now.Add(-time.Hour))
+			},
+			starved: true,
+		},
+		"should not retire a peer that sent data": {
+			target: 5,
+			peers:  []peer.Peer{first},
+			run: func(p *pool) {
+				for i := 0; i < maxPeerFailures; i++ {
+					c, _ := p.next(now.Add(time.Hour))
+					p.exited(c, 1024, errFailed, now.Add(-time.Hour))
+				}
+			},
+			want: []peer.Peer{first},
+		},
+		"should starve without peers": {
+			target:  5,
+			starved: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newPool(test.target, test.preferIPv6)
+			p.add(test.peers, now.Add(-fallbackDelay))
+			if test.run != nil {
+				test.run(p)
+			}
+
+			var got []peer.Peer
+			for {
+				c, ok := p.next(now)
+				if !ok {
+					break
+				}
+				got = append(got, c.peer)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("expected to connect to %v, got %v", test.want, got)
+			}
+			for i := range got {
+				if got[i].String() != test.want[i].String() {
+					t.Errorf("expected to connect to %v, got %v", test.want, got)
+				}
+			}
+
+			if p.starved() != test.starved {
+				t.Errorf("expected starved to be %t, got %t", test.starved, p.starved())
+			}
+		})
+	}
+}
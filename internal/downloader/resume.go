@@ -0,0 +1,224 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/storage"
+	"github.com/xanish/torrenty/internal/utility"
+)
+
+// resumeInterval is the least time between two saves of the resume data while
+// pieces are written, as every save syncs the files of the torrent to disk.
+var resumeInterval = 30 * time.Second
+
+// PartialPiece records the blocks of a piece that were written to storage
+// before the piece was complete. Blocks is a bitfield of the blocks of the
+// piece.
+type PartialPiece struct {
+	Index  int    `bencode:"index"`
+	Blocks string `bencode:"blocks"`
+}
+
+// ResumeData is the fast-resume state of a download. It is saved next to the
+// download as pieces are written, and trusted on restart instead of verifying
+// every piece as long as the files of the torrent were not modified since.
+type ResumeData struct {
+	InfoHash string             `bencode:"info-hash"`
+	Bitfield string             `bencode:"bitfield"`
+	Files    []storage.FileStat `bencode:"files"`
+	Partial  []PartialPiece     `bencode:"partial"`
+}
+
+// LoadResume reads the resume data saved at path.
+func LoadResume(path string) (*ResumeData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open resume data: %w", err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	r := &ResumeData{}
+	err = bencode.Unmarshal(f, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode resume data: %w", err)
+	}
+
+	return r, nil
+}
+
+// Save writes the resume data to path atomically, by writing it to a
+// temporary file first and renaming it over path once it is synced.
+func (r *ResumeData) Save(path string) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *r)
+	if err != nil {
+		return fmt.Errorf("failed to encode resume data: %w", err)
+	}
+
+	err = utility.WriteFileAtomic(path, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to save resume data: %w", err)
+	}
+
+	return nil
+}
+
+// Matches reports whether the resume data belongs to the torrent identified
+// by infoHash made of numPieces pieces, and whether its files still have the
+// stats recorded when it was saved.
+func (r *ResumeData) Matches(infoHash [20]byte, numPieces int, stats []storage.FileStat) bool {
+	if r.InfoHash != string(infoHash[:]) || len(r.Bitfield) != (numPieces+7)/8 || len(r.Files) != len(stats) {
+		return false
+	}
+
+	for i, stat := range stats {
+		if r.Files[i] != stat {
+			return false
+		}
+	}
+
+	return true
+}
+
+// saveResume saves the resume data of the session to opts.ResumePath, if set.
+// When final is set, the blocks received for the pieces still in progress are
+// written to storage first and recorded as partial pieces. Otherwise nothing
+// is saved within resumeInterval of the previous save.
+func (s *session) saveResume(final bool) {
+	if s.opts.ResumePath == "" {
+		return
+	}
+	if !final && time.Since(s.resumeSavedAt) < resumeInterval {
+		return
+	}
+	s.resumeSavedAt = time.Now()
+
+	st, ok := s.storage.(storage.Stater)
+	if !ok {
+		logger.Log(logger.Warning, "not saving resume data, storage does not report file stats")
+		return
+	}
+
+	bitfield, _ := s.ownBitfield()
+	r := &ResumeData{
+		InfoHash: string(s.torrent.InfoHash[:]),
+		Bitfield: string(bitfield),
+	}
+
+	if final {
+		partial, err := s.flushPartial()
+		if err != nil {
+			logger.Log(logger.Warning, "failed to write partial pieces: %s", err)
+		} else {
+			r.Partial = partial
+		}
+	}
+
+	// the stats are taken once the data is on disk, as syncing may update the
+	// modification times
+	err := s.storage.Flush()
+	var stats []storage.FileStat
+	if err == nil {
+		stats, err = st.Stat()
+	}
+	if err == nil {
+		r.Files = stats
+		err = r.Save(s.opts.ResumePath)
+	}
+	if err != nil {
+		logger.Log(logger.Warning, "failed to save resume data: %s", err)
+	}
+}
+
+// flushPartial writes the blocks received for the pieces in progress to
+// storage, and returns them as partial pieces.
+func (s *session) flushPartial() ([]PartialPiece, error) {
+	type block struct {
+		index, begin int
+		data         []byte
+	}
+
+	var (
+		blocks  []block
+		partial []PartialPiece
+	)
+
+	s.blocksMu.Lock()
+	for index, p := range s.pieces {
+		if p.finished || p.received == 0 {
+			continue
+		}
+
+		received := make([]byte, (len(p.blocks)+7)/8)
+		for i, state := range p.blocks {
+			if state != blockReceived {
+				continue
+			}
+
+			begin, length := p.block(i)
+			blocks = append(blocks, block{
+				index: index,
+				begin: begin,
+				data:  bytes.Clone(p.data[begin : begin+length]),
+			})
+			utility.SetPiece(i, received)
+		}
+		partial = append(partial, PartialPiece{Index: index, Blocks: string(received)})
+	}
+	s.blocksMu.Unlock()
+
+	for _, b := range blocks {
+		err := s.storage.WriteBlock(b.index, b.begin, b.data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return partial, nil
+}
+
+// restore fills a newly picked piece with the blocks recorded for it as a
+// partial piece, reading them back from storage. It must be called with
+// blocksMu held.
+func (s *session) restore(p *piece) {
+	blocks, ok := s.partial[p.index]
+	if !ok {
+		return
+	}
+	delete(s.partial, p.index)
+
+	// a piece with every block recorded would never be requested, and thus
+	// never verified, so it is downloaded again instead
+	restored := 0
+	for i := range p.blocks {
+		if utility.PieceExists(i, []byte(blocks)) {
+			restored++
+		}
+	}
+	if restored == len(p.blocks) {
+		return
+	}
+
+	for i := range p.blocks {
+		if !utility.PieceExists(i, []byte(blocks)) {
+			continue
+		}
+
+		begin, length := p.block(i)
+		err := s.storage.ReadBlock(p.index, begin, p.data[begin:begin+length])
+		if err != nil {
+			logger.Log(logger.Warning, "failed to restore block %d of piece %d: %s", begin, p.index, err)
+			continue
+		}
+
+		p.blocks[i] = blockReceived
+		p.received++
+	}
+}
@@ -0,0 +1,238 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xanish/torrenty/internal/metadata"
+	"github.com/xanish/torrenty/internal/peer"
+	"github.com/xanish/torrenty/internal/storage"
+)
+
+// testTorrentFiles opens the single file of torrent inside a temporary
+// directory.
+func testTorrentFiles(t *testing.T, torrent *metadata.Metadata) (*storage.Files, string) {
+	t.Helper()
+
+	torrent.Files = []metadata.File{{Path: []string{torrent.Name}, Length: torrent.Size}}
+
+	dir := t.TempDir()
+	f, err := storage.OpenFiles(dir, *torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+
+	return f, dir
+}
+
+func TestResumeDataSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.resume")
+
+	saved := &ResumeData{
+		InfoHash: string(bytes.Repeat([]byte{1}, 20)),
+		Bitfield: "\xa0",
+		Files:    []storage.FileStat{{Length: 10, MTime: 1700000000123456789}, {Length: 0, MTime: 42}},
+		Partial:  []PartialPiece{{Index: 1, Blocks: "\x80"}},
+	}
+	for range 2 {
+		// the second save replaces the first one
+		err := saved.Save(path)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only the resume data to be left in the directory, got %d entries", len(entries))
+	}
+
+	loaded, err := LoadResume(path)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("expected %+v to be loaded, got %+v", saved, loaded)
+	}
+
+	var infoHash [20]byte
+	copy(infoHash[:], saved.InfoHash)
+
+	tests := []struct {
+		name      string
+		infoHash  [20]byte
+		numPieces int
+		stats     []storage.FileStat
+		want      bool
+	}{
+		{
+			name:      "should match unmodified files",
+			infoHash:  infoHash,
+			numPieces: 3,
+			stats:     saved.Files,
+			want:      true,
+		},
+		{
+			name:      "should not match another torrent",
+			infoHash:  [20]byte{2},
+			numPieces: 3,
+			stats:     saved.Files,
+		},
+		{
+			name:      "should not match a bitfield of the wrong length",
+			infoHash:  infoHash,
+			numPieces: 9,
+			stats:     saved.Files,
+		},
+		{
+			name:      "should not match a modified file",
+			infoHash:  infoHash,
+			numPieces: 3,
+			stats:     []storage.FileStat{{Length: 10, MTime: 1700000000123456790}, {Length: 0, MTime: 42}},
+		},
+		{
+			name:      "should not match a different set of files",
+			infoHash:  infoHash,
+			numPieces: 3,
+			stats:     saved.Files[:1],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loaded.Matches(tt.infoHash, tt.numPieces, tt.stats); got != tt.want {
+				t.Errorf("expected Matches to return %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDownloadSavesResumeData(t *testing.T) {
+	torrent, content := testTorrent(128*1024, 32*1024)
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	out, dir := testTorrentFiles(t, &torrent)
+	path := filepath.Join(dir, "test.resume")
+
+	err := Download(context.Background(), [20]byte{7}, torrent, out, Options{ResumePath: path})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	resume, err := LoadResume(path)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	stats, err := out.Stat()
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if !resume.Matches(torrent.InfoHash, len(torrent.Pieces), stats) {
+		t.Errorf("expected resume data to match the downloaded files")
+	}
+	if resume.Bitfield != "\xf0" || len(resume.Partial) != 0 {
+		t.Errorf("expected every piece to be recorded as complete, got %x with %d partial pieces", resume.Bitfield, len(resume.Partial))
+	}
+}
+
+func TestSaveResumeThrottles(t *testing.T) {
+	torrent, _ := testTorrent(128*1024, 32*1024)
+	out, dir := testTorrentFiles(t, &torrent)
+	path := filepath.Join(dir, "test.resume")
+
+	s := &session{
+		torrent: torrent,
+		opts:    Options{ResumePath: path},
+		storage: out,
+		pieces:  map[int]*piece{},
+	}
+	s.saveResume(false)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the first save to write the resume data, got %v", err)
+	}
+
+	// saves within resumeInterval of the previous one are skipped, unless
+	// final
+	_ = os.Remove(path)
+	s.saveResume(false)
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the second save to be skipped, got %v", err)
+	}
+
+	s.saveResume(true)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the final save to write the resume data, got %v", err)
+	}
+}
+
+func TestResumePartialPieces(t *testing.T) {
+	torrent, content := testTorrent(128*1024, 32*1024)
+	out, dir := testTorrentFiles(t, &torrent)
+	path := filepath.Join(dir, "test.resume")
+
+	// the first block of piece 1 and the second block of piece 3 were received
+	// when the download was interrupted
+	p1 := newPiece(1, torrent.Pieces[1], torrent.PieceLength)
+	copy(p1.data, content[32*1024:48*1024])
+	p1.blocks[0], p1.received = blockReceived, 1
+	p3 := newPiece(3, torrent.Pieces[3], torrent.PieceLength)
+	copy(p3.data[16*1024:], content[112*1024:])
+	p3.blocks[1], p3.received = blockReceived, 1
+
+	s := &session{
+		torrent: torrent,
+		opts:    Options{ResumePath: path},
+		storage: out,
+		pieces:  map[int]*piece{1: p1, 3: p3, 2: newPiece(2, torrent.Pieces[2], torrent.PieceLength)},
+	}
+	_ = out.MarkComplete(0)
+	s.saveResume(true)
+
+	resume, err := LoadResume(path)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if resume.Bitfield != "\x80" || len(resume.Partial) != 2 {
+		t.Fatalf("expected piece 0 and two partial pieces to be recorded, got %x and %+v", resume.Bitfield, resume.Partial)
+	}
+
+	// the partial blocks are requested no more when the download resumes, the
+	// complete pieces are already marked in storage
+	seeder := &fakeSeeder{content: content, pieceLength: torrent.PieceLength}
+	torrent.Peers = []peer.Peer{startFakeSeeder(t, seeder)}
+
+	err = Download(context.Background(), [20]byte{7}, torrent, out, Options{
+		Partial: resume.Partial,
+	})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	buf := make([]byte, len(content))
+	_, err = out.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	// piece 0 was never written, it is only recorded as complete
+	if !bytes.Equal(buf[32*1024:], content[32*1024:]) {
+		t.Errorf("expected downloaded data to match the content")
+	}
+
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if seeder.blocks != 4 {
+		t.Errorf("expected only the 4 missing blocks to be requested, got %d", seeder.blocks)
+	}
+}
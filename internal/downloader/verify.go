@@ -0,0 +1,74 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/xanish/torrenty/internal/metadata"
+	"github.com/xanish/torrenty/internal/storage"
+)
+
+// Verify hashes every piece of the torrent found in store against the piece
+// hashes of the torrent, spreading the work over one goroutine per CPU. The
+// pieces that match are marked complete, so that Download only fetches the
+// missing ones. Cancelling ctx stops the verification and makes Verify return
+// the error of ctx.
+func Verify(ctx context.Context, torrent metadata.Metadata, store storage.Storage) error {
+	indexes := make(chan int)
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, torrent.PieceLength)
+			for index := range indexes {
+				data := buf[:torrent.PieceSize(index)]
+				err := store.ReadBlock(index, 0, data)
+				if err == nil && hashMatches(data, torrent.Pieces[index]) {
+					err = store.MarkComplete(index)
+				}
+
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed verifying piece %d: %w", index, err)
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	fed := 0
+	for fed < len(torrent.Pieces) && ctx.Err() == nil {
+		select {
+		case indexes <- fed:
+			fed++
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if fed < len(torrent.Pieces) {
+		return ctx.Err()
+	}
+
+	return firstErr
+}
+
+func hashMatches(data []byte, hash [20]byte) bool {
+	sum := sha1.Sum(data)
+
+	return bytes.Equal(sum[:], hash[:])
+}
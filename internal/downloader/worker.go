@@ -0,0 +1,639 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/message"
+	"github.com/xanish/torrenty/internal/peer"
+	"github.com/xanish/torrenty/internal/utility"
+)
+
+var (
+	// unchokeTimeout is how long a peer may keep choking us while we are
+	// interested in the pieces it has before the connection is dropped.
+	unchokeTimeout = 60 * time.Second
+
+	// requestTimeout is how long a peer that unchoked us may leave our
+	// requests unanswered before the connection is dropped.
+	requestTimeout = 60 * time.Second
+)
+
+type blockState uint8
+
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// piece is a piece being downloaded block by block. Its blocks are requested
+// by a single worker, except in endgame mode where every worker whose peer has
+// the piece joins in.
+type piece struct {
+	index    int
+	hash     [20]byte
+	data     []byte
+	blocks   []blockState
+	received int
+
+	// requesters holds the workers each block is outstanding at, and holders
+	// the number of workers downloading the piece. A piece is finished once
+	// every block has been received and it is handed out for verification.
+	requesters [][]*worker
+	holders    int
+	finished   bool
+}
+
+func newPiece(index int, hash [20]byte, size int) *piece {
+	numBlocks := (size + maxDownloadBlockSize - 1) / maxDownloadBlockSize
+
+	return &piece{
+		index:      index,
+		hash:       hash,
+		data:       make([]byte, size),
+		blocks:     make([]blockState, numBlocks),
+		requesters: make([][]*worker, numBlocks),
+	}
+}
+
+// block returns the begin offset and length of the block at i.
+func (p *piece) block(i int) (int, int) {
+	begin := i * maxDownloadBlockSize
+
+	return begin, min(maxDownloadBlockSize, len(p.data)-begin)
+}
+
+// verify reports whether the downloaded data matches the hash of the piece.
+func (p *piece) verify() bool {
+	return hashMatches(p.data, p.hash)
+}
+
+// request identifies an outstanding block request by the piece index and the
+// begin offset of the block.
+type request struct {
+	index int
+	begin int
+}
+
+// cancel is a block request to withdraw from the peer of a worker, once the
+// block arrived from another peer.
+type cancel struct {
+	conn *peer.Connection
+	req  peer.BlockRequest
+}
+
+// worker downloads pieces from and uploads pieces to a single peer.
+type worker struct {
+	id   int
+	conn *peer.Connection
+
+	// available holds the pieces of the peer accounted for in the picker.
+	available []byte
+
+	// active holds the pieces being downloaded from the peer, and requests
+	// the blocks requested from the peer that have not arrived yet. Both are
+	// guarded by the blocksMu of the session, as other workers cancel the
+	// requests of blocks they receive first in endgame mode.
+	active   []*piece
+	requests map[request]bool
+	endgame  bool
+
+	// received is the number of piece bytes received from the peer.
+	received int
+}
+
+// executeWorker connects to peer and works the connection, returning the
+// number of piece bytes received from the peer along with the error the
+// worker stopped with.
+func (s *session) executeWorker(ctx context.Context, id int, peer peer.Peer, results chan<- *piece) (int, error) {
+	logger.Log(logger.Debug, "[worker:%d] connecting to peer %s", id, peer.String())
+	conn, err := peer.Connect(ctx, s.torrent.InfoHash, s.peerID, s.opts.Extensions)
+	if err != nil {
+		return 0, fmt.Errorf("[worker:%d] connecting to peer %s failed: %w", id, peer.String(), err)
+	}
+
+	return s.work(id, conn, results)
+}
+
+// work downloads pieces from an established connection and serves the
+// requests of the remote peer, until every piece has been downloaded and the
+// peer disconnects or the session is stopped. It returns the number of piece
+// bytes received from the peer.
+func (s *session) work(id int, conn *peer.Connection, results chan<- *piece) (int, error) {
+	defer func(Conn net.Conn) {
+		_ = Conn.Close()
+	}(conn.Conn)
+
+	peer := conn.Peer
+	// inbound peers are not required to send their bitfield first
+	if conn.Bitfield == nil {
+		conn.Bitfield = make([]byte, (len(s.torrent.Pieces)+7)/8)
+	}
+
+	ok, err := s.track(conn)
+	if err != nil {
+		return 0, fmt.Errorf("[worker:%d] %w", id, err)
+	}
+	if !ok {
+		return 0, nil
+	}
+	defer s.untrack(conn)
+
+	w := &worker{
+		id:        id,
+		conn:      conn,
+		available: bytes.Clone(conn.Bitfield),
+		requests:  make(map[request]bool),
+	}
+	s.picker.AddBitfield(w.available)
+	defer func() {
+		s.picker.RemoveBitfield(w.available)
+		s.release(w)
+	}()
+
+	// Requests of the peer are served from their own goroutine, so that they
+	// are queued while a block is being sent and can still be cancelled.
+	uploading := make(chan struct{})
+	defer close(uploading)
+	s.spawn(func() {
+		err := s.upload(conn, uploading)
+		if err != nil {
+			logger.Log(logger.Error, "[worker:%d] serving requests of peer %s failed: %s", id, peer.String(), err)
+			_ = conn.Conn.Close()
+		}
+	})
+
+	// Let the peer know which pieces it can request from us.
+	if bitfield, ok := s.ownBitfield(); ok {
+		err := conn.SendBitField(bitfield)
+		if err != nil {
+			return w.received, fmt.Errorf("[worker:%d] sending bitfield to peer %s failed: %w", id, peer.String(), err)
+		}
+	}
+
+	// Tell peers running a DHT node about ours, and learn about theirs in
+	// return. The port may have arrived along with the bitfield.
+	if ext := s.opts.Extensions; ext != nil && ext.DHTPort != 0 && conn.SupportsDHT() {
+		err := conn.SendPort(int(ext.DHTPort))
+		if err != nil {
+			return w.received, fmt.Errorf("[worker:%d] sending port to peer %s failed: %w", id, peer.String(), err)
+		}
+	}
+	s.dhtNode(conn)
+
+	// Client connections start out as "choked" and "not interested"
+	err = conn.SendUnChoke()
+	if err != nil {
+		return w.received, fmt.Errorf("[worker:%d] sending unchoke message to peer %s failed: %w", id, peer.String(), err)
+	}
+
+	err = conn.SendInterested()
+	if err != nil {
+		return w.received, fmt.Errorf("[worker:%d] sending interested message to peer %s failed: %w", id, peer.String(), err)
+	}
+
+	// chokedSince is when the peer started choking us while having pieces we
+	// need, and idleSince when it last answered our outstanding requests.
+	var chokedSince, idleSince time.Time
+	for s.picker.Remaining() > 0 {
+		// Requests are only sent while the peer is not choking us. A peer that
+		// does not unchoke us in time while it has pieces we need, or that
+		// stops answering our requests, is dropped, so that the pieces we were
+		// downloading from it can be fetched from other peers.
+		if !conn.AmChoked {
+			// keep the request queue of the peer filled, if the peer has none
+			// of the pieces we still need this waits for it to announce new
+			// ones
+			err = s.fillRequests(w)
+			if err != nil {
+				return w.received, fmt.Errorf("[worker:%d] sending message<request> to peer %s failed: %w", id, peer.String(), err)
+			}
+		}
+
+		now := time.Now()
+		deadline := time.Time{}
+		switch {
+		case conn.AmChoked && conn.AmInterested && s.picker.Needs(conn.Bitfield):
+			if chokedSince.IsZero() {
+				chokedSince = now
+			}
+			idleSince = time.Time{}
+			deadline = chokedSince.Add(unchokeTimeout)
+		case !conn.AmChoked && s.outstanding(w):
+			if idleSince.IsZero() {
+				idleSince = now
+			}
+			chokedSince = time.Time{}
+			deadline = idleSince.Add(requestTimeout)
+		default:
+			chokedSince, idleSince = time.Time{}, time.Time{}
+		}
+		_ = conn.Conn.SetReadDeadline(deadline)
+
+		msg, err := s.readMessage(w)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !chokedSince.IsZero() {
+				return w.received, fmt.Errorf("[worker:%d] peer %s did not unchoke us within %s", id, peer.String(), unchokeTimeout)
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && !idleSince.IsZero() {
+				return w.received, fmt.Errorf("[worker:%d] peer %s did not answer our requests within %s", id, peer.String(), requestTimeout)
+			}
+			return w.received, fmt.Errorf("[worker:%d] reading message from peer %s failed: %w", id, peer.String(), err)
+		}
+
+		if msg != nil && msg.ID == message.Choke {
+			s.discardRequests(w)
+			continue
+		}
+
+		if msg == nil || msg.ID != message.Piece {
+			continue
+		}
+		idleSince = time.Time{}
+
+		p, err := s.receive(w, msg)
+		if err != nil {
+			return w.received, fmt.Errorf("[worker:%d] receiving block from peer %s failed: %w", id, peer.String(), err)
+		}
+		if p == nil {
+			continue
+		}
+
+		// check piece integrity
+		if !p.verify() {
+			s.picker.Abort(p.index)
+			s.emit(Event{Type: PieceFailed, Piece: p.index, Peer: peer})
+			logger.Log(logger.Info, "[worker:%d] integrity check for piece %d downloaded from %s failed", id, p.index, peer.String())
+			continue
+		}
+
+		logger.Log(logger.Info, "[worker:%d] piece %d verified successfully", id, p.index)
+		select {
+		case results <- p:
+		case <-s.finished:
+			return w.received, nil
+		}
+	}
+
+	// Every piece has been downloaded, keep seeding to the peer until it
+	// disconnects or the session is stopped.
+	_ = conn.Conn.SetReadDeadline(time.Time{})
+	err = conn.SendNotInterested()
+	if err != nil {
+		return w.received, fmt.Errorf("[worker:%d] sending not interested message to peer %s failed: %w", id, peer.String(), err)
+	}
+
+	for {
+		_, err = s.readMessage(w)
+		if err != nil {
+			if s.isFinished() {
+				return w.received, nil
+			}
+			return w.received, fmt.Errorf("[worker:%d] reading message from peer %s failed: %w", id, peer.String(), err)
+		}
+	}
+}
+
+// maxRequests returns the number of block requests to keep in flight to the
+// peer of w.
+func (s *session) maxRequests(w *worker) int {
+	remote := w.conn.RemoteExtensions
+	if remote != nil && remote.Reqq > 0 {
+		return min(s.opts.MaxRequests, remote.Reqq)
+	}
+
+	return s.opts.MaxRequests
+}
+
+// fillRequests requests blocks from the peer of w until the configured number
+// of requests is in flight, starting on a new piece from the picker once every
+// block of the active pieces has been requested.
+//
+// Once no piece is left to pick, so that every remaining piece is being
+// downloaded, w enters endgame mode: it joins the pieces of other workers its
+// peer has and requests their outstanding blocks as well, so that a single slow
+// peer does not hold up the end of the download.
+func (s *session) fillRequests(w *worker) error {
+	var requests []peer.BlockRequest
+
+	s.blocksMu.Lock()
+	cancels := s.prune(w)
+	for len(w.requests) < s.maxRequests(w) {
+		p, i, ok := w.nextBlock(false)
+		if !ok {
+			index, picked := s.picker.Pick(w.conn.Bitfield)
+			if picked {
+				p := newPiece(index, s.torrent.Pieces[index], s.torrent.PieceSize(index))
+				s.restore(p)
+				s.pieces[index] = p
+				w.hold(p)
+				continue
+			}
+
+			if s.picker.Missing() > 0 {
+				break
+			}
+
+			if !w.endgame {
+				w.endgame = true
+				logger.Log(logger.Debug, "[worker:%d] entering endgame mode", w.id)
+			}
+			s.join(w)
+
+			p, i, ok = w.nextBlock(true)
+			if !ok {
+				break
+			}
+		}
+
+		begin, length := p.block(i)
+		p.blocks[i] = blockRequested
+		p.requesters[i] = append(p.requesters[i], w)
+		w.requests[request{p.index, begin}] = true
+		requests = append(requests, peer.BlockRequest{Index: p.index, Begin: begin, Length: length})
+	}
+	s.blocksMu.Unlock()
+
+	sendCancels(cancels)
+	for _, req := range requests {
+		err := w.conn.SendRequest(req.Index, req.Begin, req.Length)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// join adds every unfinished piece the peer of w has to the active pieces of
+// w. It must be called with blocksMu held.
+func (s *session) join(w *worker) {
+	for index, p := range s.pieces {
+		if !p.finished && utility.PieceExists(index, w.conn.Bitfield) && !slices.Contains(w.active, p) {
+			w.hold(p)
+		}
+	}
+}
+
+// prune drops the finished pieces from the active pieces of w and returns the
+// requests that are still outstanding for them. It must be called with
+// blocksMu held.
+func (s *session) prune(w *worker) []cancel {
+	var cancels []cancel
+	w.active = slices.DeleteFunc(w.active, func(p *piece) bool {
+		if !p.finished {
+			return false
+		}
+
+		for i := range p.blocks {
+			begin, length := p.block(i)
+			if w.requests[request{p.index, begin}] {
+				delete(w.requests, request{p.index, begin})
+				p.requesters[i] = slices.DeleteFunc(p.requesters[i], w.is)
+				cancels = append(cancels, cancel{w.conn, peer.BlockRequest{Index: p.index, Begin: begin, Length: length}})
+			}
+		}
+		p.holders--
+
+		return true
+	})
+
+	return cancels
+}
+
+// outstanding reports whether blocks requested from the peer of w have not
+// arrived yet.
+func (s *session) outstanding(w *worker) bool {
+	s.blocksMu.Lock()
+	defer s.blocksMu.Unlock()
+
+	return len(w.requests) > 0
+}
+
+// discardRequests marks every outstanding block request as missing again. A
+// peer discards the requests it has not served when it chokes us, so they
+// have to be sent again once it unchokes us.
+func (s *session) discardRequests(w *worker) {
+	s.blocksMu.Lock()
+	defer s.blocksMu.Unlock()
+
+	for _, p := range w.active {
+		w.forget(p)
+	}
+
+	clear(w.requests)
+	logger.Log(logger.Debug, "[worker:%d] choked by peer %s, pending requests discarded", w.id, w.conn.Peer.String())
+}
+
+// release drops every active piece of a worker that stopped. Pieces no other
+// worker is downloading are returned to the picker.
+func (s *session) release(w *worker) {
+	s.blocksMu.Lock()
+	defer s.blocksMu.Unlock()
+
+	for _, p := range w.active {
+		w.forget(p)
+		p.holders--
+		if p.holders == 0 && !p.finished {
+			delete(s.pieces, p.index)
+			s.picker.Abort(p.index)
+		}
+	}
+
+	w.active = nil
+	clear(w.requests)
+}
+
+// receive stores the block carried by a Piece message in the active piece it
+// was requested for, and cancels the requests for the same block made to other
+// peers. Blocks that were not requested, or that arrived from another peer
+// first, are ignored. Once every block of a piece has been received the piece
+// is returned.
+func (s *session) receive(w *worker, msg *message.Message) (*piece, error) {
+	index, begin, block, err := message.ParseBlock(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.blocksMu.Lock()
+	p, cancels, err := s.store(w, index, begin, block)
+	s.blocksMu.Unlock()
+
+	sendCancels(cancels)
+
+	return p, err
+}
+
+// store is the part of receive that must be called with blocksMu held.
+func (s *session) store(w *worker, index, begin int, block []byte) (*piece, []cancel, error) {
+	req := request{index, begin}
+	if !w.requests[req] {
+		logger.Log(logger.Debug, "[worker:%d] ignoring unrequested block %d of piece %d", w.id, begin, index)
+		return nil, nil, nil
+	}
+
+	p := w.piece(index)
+	i := begin / maxDownloadBlockSize
+	delete(w.requests, req)
+	p.requesters[i] = slices.DeleteFunc(p.requesters[i], w.is)
+
+	if p.blocks[i] == blockReceived {
+		return nil, nil, nil
+	}
+
+	_, length := p.block(i)
+	if len(block) != length {
+		if len(p.requesters[i]) == 0 {
+			p.blocks[i] = blockMissing
+		}
+		return nil, nil, fmt.Errorf("expected block %d of piece %d to have %d bytes, got %d", begin, index, length, len(block))
+	}
+
+	s.opts.Stats.Downloaded.Add(int64(len(block)))
+	w.received += len(block)
+	copy(p.data[begin:], block)
+	p.blocks[i] = blockReceived
+	p.received++
+
+	// the other peers the block was requested from in endgame mode lost
+	cancels := make([]cancel, 0, len(p.requesters[i]))
+	for _, other := range p.requesters[i] {
+		delete(other.requests, req)
+		cancels = append(cancels, cancel{other.conn, peer.BlockRequest{Index: index, Begin: begin, Length: length}})
+	}
+	p.requesters[i] = nil
+
+	if p.received < len(p.blocks) {
+		return nil, cancels, nil
+	}
+
+	p.finished = true
+	p.holders--
+	delete(s.pieces, index)
+	w.active = slices.DeleteFunc(w.active, func(candidate *piece) bool {
+		return candidate == p
+	})
+
+	return p, cancels, nil
+}
+
+// sendCancels withdraws block requests that are no longer needed.
+func sendCancels(cancels []cancel) {
+	for _, c := range cancels {
+		err := c.conn.SendCancel(c.req.Index, c.req.Begin, c.req.Length)
+		if err != nil {
+			logger.Log(logger.Debug, "sending message<cancel> to peer %s failed: %s", c.conn.Peer.String(), err)
+		}
+	}
+}
+
+// hold adds p to the active pieces of w.
+func (w *worker) hold(p *piece) {
+	w.active = append(w.active, p)
+	p.holders++
+}
+
+// piece returns the active piece of w at index.
+func (w *worker) piece(index int) *piece {
+	for _, p := range w.active {
+		if p.index == index {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// forget removes w from the requesters of the blocks of p. Blocks that are
+// no longer requested from any peer become missing again.
+func (w *worker) forget(p *piece) {
+	for i, state := range p.blocks {
+		if state != blockRequested {
+			continue
+		}
+
+		p.requesters[i] = slices.DeleteFunc(p.requesters[i], w.is)
+		if len(p.requesters[i]) == 0 {
+			p.blocks[i] = blockMissing
+		}
+	}
+}
+
+func (w *worker) is(other *worker) bool {
+	return w == other
+}
+
+// nextBlock returns the first block of the active pieces that has not been
+// requested yet. In endgame mode, when dup is set, blocks outstanding at other
+// peers are returned once no block is missing.
+func (w *worker) nextBlock(dup bool) (*piece, int, bool) {
+	for _, p := range w.active {
+		for i, state := range p.blocks {
+			if state == blockMissing {
+				return p, i, true
+			}
+		}
+	}
+
+	if !dup {
+		return nil, 0, false
+	}
+
+	for _, p := range w.active {
+		for i, state := range p.blocks {
+			if state == blockRequested && !slices.ContainsFunc(p.requesters[i], w.is) {
+				return p, i, true
+			}
+		}
+	}
+
+	return nil, 0, false
+}
+
+// readMessage reads the next message of the peer of w, keeping the picker up
+// to date with the pieces the peer announces.
+func (s *session) readMessage(w *worker) (*message.Message, error) {
+	msg, err := w.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case msg == nil:
+	case msg.ID == message.Have:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return nil, err
+		}
+		if !utility.PieceExists(index, w.available) {
+			utility.SetPiece(index, w.available)
+			s.picker.AddHave(index)
+		}
+	case msg.ID == message.Bitfield:
+		s.picker.RemoveBitfield(w.available)
+		w.available = bytes.Clone(w.conn.Bitfield)
+		s.picker.AddBitfield(w.available)
+	case msg.ID == message.Port:
+		s.dhtNode(w.conn)
+	}
+
+	return msg, nil
+}
+
+// dhtNode reports the DHT node of the peer of conn with a DHTNode event, once
+// the peer sent its port.
+func (s *session) dhtNode(conn *peer.Connection) {
+	if conn.DHTPort == 0 {
+		return
+	}
+
+	s.emit(Event{Type: DHTNode, Peer: peer.Peer{IP: conn.Peer.IP, Port: conn.DHTPort}})
+}
@@ -8,6 +8,16 @@ import (
 
 const bufLength = 49
 
+// Protocol is the protocol identifier (Pstr) of BitTorrent handshakes.
+const Protocol = "BitTorrent protocol"
+
+// extensionProtocolBit is set in the sixth reserved byte to advertise support
+// for the extension protocol (BEP 10).
+const extensionProtocolBit = 0x10
+
+// dhtBit is set in the last reserved byte to advertise a DHT node (BEP 5).
+const dhtBit = 0x01
+
 // Handshake is a required message and must be the first message transmitted
 // by the client. It is (49 + len(Pstr)) bytes long.
 // Handshake: <PstrLen><Pstr><Reserved><InfoHash><PeerID>
@@ -16,9 +26,10 @@ const bufLength = 49
 //
 // Pstr: String identifier of the protocol (eg. BitTorrent protocol).
 //
-// Reserved: eight (8) reserved bytes. All current implementations use all
-// zeroes. Each bit in these bytes can be used to change the behavior of the
-// protocol.
+// Reserved: eight (8) reserved bytes. Each bit in these bytes can be used to
+// change the behavior of the protocol. We set bit 0x10 of the sixth byte to
+// advertise support for the extension protocol, and bit 0x01 of the last byte
+// when running a DHT node.
 //
 // InfoHash: 20-byte SHA1 hash of the info key in the metainfo file. This is
 // the same hash that is transmitted in tracker requests.
@@ -36,13 +47,29 @@ type Handshake struct {
 // peerID.
 func New(infoHash, peerID [20]byte) Handshake {
 	return Handshake{
-		Pstr:     "BitTorrent protocol",
-		Reserved: [8]byte{0x00, 0x00, 0x00, 0x00},
+		Pstr:     Protocol,
+		Reserved: [8]byte{0x00, 0x00, 0x00, 0x00, 0x00, extensionProtocolBit, 0x00, 0x00},
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
 }
 
+// SupportsExtensions reports whether the handshake advertises support for the
+// extension protocol.
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&extensionProtocolBit != 0
+}
+
+// SetDHT advertises that we run a DHT node.
+func (h *Handshake) SetDHT() {
+	h.Reserved[7] |= dhtBit
+}
+
+// SupportsDHT reports whether the handshake advertises a DHT node.
+func (h *Handshake) SupportsDHT() bool {
+	return h.Reserved[7]&dhtBit != 0
+}
+
 // Marshal converts the handshake metadata into a serialized byte form that can
 // be transmitted via the connection.
 func (h *Handshake) Marshal() ([]byte, error) {
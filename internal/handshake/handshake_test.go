@@ -13,7 +13,7 @@ func TestNew(t *testing.T) {
 	got := New(infoHash, peerID)
 	want := Handshake{
 		Pstr:     "BitTorrent protocol",
-		Reserved: [8]byte{0x00, 0x00, 0x00, 0x00},
+		Reserved: [8]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00},
 		InfoHash: [20]byte{6, 113, 44, 71, 91, 121, 93, 30, 30, 115, 54, 33, 113, 104, 85, 108, 101, 76, 27, 11},
 		PeerID:   [20]byte{2, 69, 110, 76, 7, 82, 70, 59, 76, 87, 10, 20, 89, 109, 16, 62, 90, 11, 9, 64},
 	}
@@ -23,6 +23,30 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestHandshake_SupportsExtensions(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	if !h.SupportsExtensions() {
+		t.Errorf("expected handshake to advertise the extension protocol")
+	}
+
+	h.Reserved = [8]byte{}
+	if h.SupportsExtensions() {
+		t.Errorf("expected handshake with zeroed reserved bytes to not advertise the extension protocol")
+	}
+}
+
+func TestHandshake_SupportsDHT(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	if h.SupportsDHT() {
+		t.Errorf("expected handshake to not advertise a dht node by default")
+	}
+
+	h.SetDHT()
+	if !h.SupportsDHT() || !h.SupportsExtensions() {
+		t.Errorf("expected handshake to advertise a dht node along with the extension protocol, got %x", h.Reserved)
+	}
+}
+
 func TestHandshake_Marshal(t *testing.T) {
 	h := New(
 		[20]byte{6, 113, 44, 71, 91, 121, 93, 30, 30, 115, 54, 33, 113, 104, 85, 108, 101, 76, 27, 11},
@@ -30,7 +54,7 @@ func TestHandshake_Marshal(t *testing.T) {
 	)
 
 	got, err := h.Marshal()
-	want := []byte{0x13, 0x42, 0x69, 0x74, 0x54, 0x6f, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x20, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x71, 0x2c, 0x47, 0x5b, 0x79, 0x5d, 0x1e, 0x1e, 0x73, 0x36, 0x21, 0x71, 0x68, 0x55, 0x6c, 0x65, 0x4c, 0x1b, 0xb, 0x2, 0x45, 0x6e, 0x4c, 0x7, 0x52, 0x46, 0x3b, 0x4c, 0x57, 0xa, 0x14, 0x59, 0x6d, 0x10, 0x3e, 0x5a, 0xb, 0x9, 0x40}
+	want := []byte{0x13, 0x42, 0x69, 0x74, 0x54, 0x6f, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x20, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x10, 0x0, 0x0, 0x6, 0x71, 0x2c, 0x47, 0x5b, 0x79, 0x5d, 0x1e, 0x1e, 0x73, 0x36, 0x21, 0x71, 0x68, 0x55, 0x6c, 0x65, 0x4c, 0x1b, 0xb, 0x2, 0x45, 0x6e, 0x4c, 0x7, 0x52, 0x46, 0x3b, 0x4c, 0x57, 0xa, 0x14, 0x59, 0x6d, 0x10, 0x3e, 0x5a, 0xb, 0x9, 0x40}
 
 	if err != nil {
 		t.Fatalf("expected error to be nil, got \"%v\"", err)
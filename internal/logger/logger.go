@@ -3,6 +3,7 @@ package logger
 import (
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 // LogLevel type
@@ -17,12 +18,16 @@ const (
 )
 
 // logger variable
-var logger *log.Logger = log.Default()
+var logger atomic.Pointer[log.Logger]
 var fatalFunc = os.Exit
 
-// SetLogger allows setting a custom logger for testing
-func setLogger(l *log.Logger) {
-	logger = l
+func init() {
+	logger.Store(log.Default())
+}
+
+// SetLogger sets the logger every message is written to.
+func SetLogger(l *log.Logger) {
+	logger.Store(l)
 }
 
 // SetFatalFunc allows setting a custom fatal function for testing
@@ -46,7 +51,7 @@ func Log(level LogLevel, message string, args ...interface{}) {
 		prefix = "[FATAL] "
 	}
 
-	logger.Printf(prefix+message, args...)
+	logger.Load().Printf(prefix+message, args...)
 	if prefix == "[FATAL] " {
 		fatalFunc(1)
 	}
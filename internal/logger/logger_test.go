@@ -55,7 +55,7 @@ func TestLog(t *testing.T) {
 		t.Run(tt.message, func(t *testing.T) {
 			var buf bytes.Buffer
 			mockLogger := log.New(&buf, "", 0)
-			setLogger(mockLogger)
+			SetLogger(mockLogger)
 
 			// Set a custom fatal function that triggers a panic
 			setFatalFunc(func(int) {
@@ -65,7 +65,7 @@ func TestLog(t *testing.T) {
 			log.SetOutput(&buf)
 
 			// restore default logger after test
-			defer setLogger(log.Default())
+			defer SetLogger(log.Default())
 
 			if tt.shouldPanic {
 				defer func() {
@@ -0,0 +1,136 @@
+// Package magnet exports utilities that allow parsing magnet links and fetching
+// the torrent metadata they refer to from peers.
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+const btihPrefix = "urn:btih:"
+
+// Magnet holds the parameters of a magnet link.
+//
+// InfoHash: the info-hash of the torrent taken from the "xt" parameter.
+//
+// Name: the display name suggested by the "dn" parameter.
+//
+// Trackers: the tracker urls listed in "tr" parameters.
+//
+// WebSeeds: the web seed urls listed in "ws" parameters.
+//
+// Peers: the peer addresses listed in "x.pe" parameters.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	WebSeeds []string
+	Peers    []peer.Peer
+}
+
+// Parse parses a magnet uri. Only BitTorrent info-hashes (urn:btih) are
+// supported, either hex or base32 encoded.
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse magnet uri: %w", err)
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected scheme to be magnet, got %q", u.Scheme)
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse magnet parameters: %w", err)
+	}
+
+	m := &Magnet{
+		Name:     params.Get("dn"),
+		Trackers: params["tr"],
+		WebSeeds: params["ws"],
+	}
+
+	found := false
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+			continue
+		}
+
+		m.InfoHash, err = parseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+
+	if !found {
+		return nil, fmt.Errorf("magnet uri does not contain a btih info-hash")
+	}
+
+	for _, addr := range params["x.pe"] {
+		p, err := parsePeer(addr)
+		if err != nil {
+			return nil, err
+		}
+		m.Peers = append(m.Peers, p)
+	}
+
+	return m, nil
+}
+
+// parseInfoHash decodes an info-hash encoded either as 40 hex characters or as
+// 32 base32 characters.
+func parseInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("expected info-hash of 40 hex or 32 base32 characters, got %d", len(encoded))
+	}
+
+	if err != nil {
+		return infoHash, fmt.Errorf("failed to decode info-hash %q: %w", encoded, err)
+	}
+
+	copy(infoHash[:], decoded)
+
+	return infoHash, nil
+}
+
+// parsePeer parses a peer address of the form ip:port.
+func parsePeer(addr string) (peer.Peer, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return peer.Peer{}, fmt.Errorf("failed to parse peer address %q: %w", addr, err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return peer.Peer{}, fmt.Errorf("expected peer address %q to contain an ip", addr)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return peer.Peer{}, fmt.Errorf("failed to parse port of peer address %q: %w", addr, err)
+	}
+
+	return peer.Peer{IP: ip, Port: uint16(p)}, nil
+}
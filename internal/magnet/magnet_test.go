@@ -0,0 +1,210 @@
+package magnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/handshake"
+	"github.com/xanish/torrenty/internal/message"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+func TestParse(t *testing.T) {
+	infoHash := [20]byte{0xc1, 0x2f, 0xe1, 0xc0, 0x6b, 0xba, 0x25, 0x4a, 0x9d, 0xc9, 0xf5, 0x19, 0xb3, 0x35, 0xaa, 0x7c, 0x13, 0x67, 0xa8, 0x8a}
+
+	tests := map[string]struct {
+		uri      string
+		name     string
+		trackers int
+		seeds    int
+		peers    []string
+	}{
+		"should parse a hex info-hash with every parameter": {
+			uri:      "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=Some+File&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr=http%3A%2F%2Ft.example.org%2Fannounce&ws=http%3A%2F%2Fseed.example.com%2Ffile&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:6882",
+			name:     "Some File",
+			trackers: 2,
+			seeds:    1,
+			peers:    []string{"10.0.0.1:6881", "[2001:db8::1]:6882"},
+		},
+		"should parse a base32 info-hash": {
+			uri: "magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK",
+		},
+		"should pick the btih among several exact topics": {
+			uri: "magnet:?xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C&xt=urn:btih:C12FE1C06BBA254A9DC9F519B335AA7C1367A88A",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := Parse(tt.uri)
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+
+			if m.InfoHash != infoHash {
+				t.Errorf("expected info-hash to be %x, got %x", infoHash, m.InfoHash)
+			}
+
+			if m.Name != tt.name || len(m.Trackers) != tt.trackers || len(m.WebSeeds) != tt.seeds {
+				t.Errorf("unexpected magnet %+v", m)
+			}
+
+			if len(m.Peers) != len(tt.peers) {
+				t.Fatalf("expected %d peers, got %d", len(tt.peers), len(m.Peers))
+			}
+
+			for i, p := range tt.peers {
+				if m.Peers[i].String() != p {
+					t.Errorf("expected peer %d to be %s, got %s", i, p, m.Peers[i].String())
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"should fail on a non magnet uri":       "http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"should fail without a btih":            "magnet:?dn=file",
+		"should fail on a short info-hash":      "magnet:?xt=urn:btih:c12fe1",
+		"should fail on an invalid hex":         "magnet:?xt=urn:btih:z12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"should fail on a peer without an ip":   "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=host:1",
+		"should fail on a peer without a port":  "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=10.0.0.1",
+		"should fail on a peer with a bad port": "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=10.0.0.1:99999",
+	}
+
+	for name, uri := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(uri)
+			if err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+		})
+	}
+}
+
+// serveMetadata accepts a single connection and serves info over ut_metadata.
+func serveMetadata(t *testing.T, l net.Listener, info []byte) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	req, err := handshake.Unmarshal(conn)
+	if err != nil {
+		t.Errorf("failed to read handshake: %v", err)
+		return
+	}
+
+	res := handshake.New(req.InfoHash, [20]byte{9})
+	marshaled, _ := res.Marshal()
+	_, _ = conn.Write(marshaled)
+
+	var hs bytes.Buffer
+	_ = bencode.Marshal(&hs, peer.ExtendedHandshake{M: map[string]int{utMetadata: 3}, MetadataSize: len(info)})
+	_, _ = conn.Write(message.NewBitfield([]byte{0xff}).Marshal())
+	_, _ = conn.Write(message.NewExtended(0, hs.Bytes()).Marshal())
+
+	remoteID := 0
+	for {
+		msg, err := message.Unmarshal(conn)
+		if err != nil {
+			return
+		}
+
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			continue
+		}
+
+		if id == 0 {
+			theirs := peer.ExtendedHandshake{}
+			_ = bencode.Unmarshal(bytes.NewReader(payload), &theirs)
+			remoteID = theirs.M[utMetadata]
+			continue
+		}
+
+		if id != 3 {
+			continue
+		}
+
+		mm := metadataMessage{}
+		_ = bencode.Unmarshal(bytes.NewReader(payload), &mm)
+
+		var data bytes.Buffer
+		_ = bencode.Marshal(&data, metadataMessage{MsgType: metadataData, Piece: mm.Piece, TotalSize: len(info)})
+		begin := mm.Piece * metadataPieceSize
+		data.Write(info[begin:min(begin+metadataPieceSize, len(info))])
+		_, _ = conn.Write(message.NewExtended(uint8(remoteID), data.Bytes()).Marshal())
+	}
+}
+
+func TestFetch(t *testing.T) {
+	info := []byte("d6:lengthi1e4:name" + strings.Repeat("x", 40000) + "e")
+	infoHash := sha1.Sum(info)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func(l net.Listener) {
+		_ = l.Close()
+	}(l)
+	go serveMetadata(t, l, info)
+
+	addr := l.Addr().(*net.TCPAddr)
+	got, err := Fetch(context.Background(), infoHash, [20]byte{1}, 6881, []peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if !bytes.Equal(got, info) {
+		t.Errorf("expected fetched metadata to match the info dictionary")
+	}
+}
+
+func TestFetchAborts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func(l net.Listener) {
+		_ = l.Close()
+	}(l)
+
+	// the peer accepts the connection but never answers the handshake
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func(conn net.Conn) {
+			_ = conn.Close()
+		}(conn)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	addr := l.Addr().(*net.TCPAddr)
+	start := time.Now()
+	_, err = Fetch(ctx, [20]byte{1}, [20]byte{2}, 6881, []peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the fetch to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the fetch to abort promptly, took %s", elapsed)
+	}
+}
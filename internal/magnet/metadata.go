@@ -0,0 +1,221 @@
+package magnet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+const (
+	// utMetadata is the name of the metadata exchange extension.
+	utMetadata = "ut_metadata"
+
+	// metadataPieceSize is the size of the pieces the info dictionary is split
+	// into by the ut_metadata extension.
+	metadataPieceSize = 16 * 1024
+	maxMetadataSize   = 8 * 1024 * 1024
+
+	maxFetchers  = 5
+	fetchTimeout = 60 * time.Second
+)
+
+// ut_metadata message types.
+const (
+	metadataRequest = iota
+	metadataData
+	metadataReject
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// metadataFetch collects the pieces of the info dictionary received from a
+// single peer.
+type metadataFetch struct {
+	info      []byte
+	received  []bool
+	remaining int
+}
+
+// Fetch downloads the info dictionary of the torrent identified by infoHash
+// from peers using the ut_metadata extension (BEP 9). Several peers are tried
+// concurrently and the first info dictionary matching infoHash is returned.
+// Cancelling ctx closes the connections to the peers and aborts the fetch.
+func Fetch(ctx context.Context, infoHash, peerID [20]byte, port uint16, peers []peer.Peer) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers to fetch metadata from")
+	}
+
+	candidates := make(chan peer.Peer, len(peers))
+	for _, p := range peers {
+		candidates <- p
+	}
+	close(candidates)
+
+	workers := min(maxFetchers, len(peers))
+	results := make(chan []byte, workers)
+
+	// the remaining fetches are cancelled once one of them succeeds
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range candidates {
+				if fetchCtx.Err() != nil {
+					return
+				}
+
+				info, err := fetchFromPeer(fetchCtx, p, infoHash, peerID, port)
+				if err != nil {
+					logger.Log(logger.Debug, "fetching metadata from peer %s failed: %s", p.String(), err)
+					continue
+				}
+
+				results <- info
+				return
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	info, ok := <-results
+	cancel()
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("fetching metadata aborted: %w", err)
+		}
+
+		return nil, fmt.Errorf("failed to fetch metadata from %d peers", len(peers))
+	}
+
+	return info, nil
+}
+
+// fetchFromPeer downloads the info dictionary from a single peer and verifies
+// it against infoHash.
+func fetchFromPeer(ctx context.Context, p peer.Peer, infoHash, peerID [20]byte, port uint16) ([]byte, error) {
+	f := &metadataFetch{}
+	ext := peer.NewExtensions()
+	ext.Port = port
+	ext.Register(utMetadata, f.handle)
+
+	conn, err := p.Connect(ctx, infoHash, peerID, ext)
+	if err != nil {
+		return nil, err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn.Conn)
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Conn.Close()
+	})
+	defer stop()
+
+	_ = conn.Conn.SetDeadline(time.Now().Add(fetchTimeout))
+
+	// wait for the extended handshake of the peer if it did not arrive along
+	// with its bitfield
+	for conn.RemoteExtensions == nil {
+		_, err = conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !conn.SupportsExtension(utMetadata) {
+		return nil, fmt.Errorf("peer does not support %s", utMetadata)
+	}
+
+	size := conn.RemoteExtensions.MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("peer advertised invalid metadata size %d", size)
+	}
+
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	f.info = make([]byte, size)
+	f.received = make([]bool, numPieces)
+	f.remaining = numPieces
+
+	for i := 0; i < numPieces; i++ {
+		var req bytes.Buffer
+		err = bencode.Marshal(&req, metadataMessage{MsgType: metadataRequest, Piece: i})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode metadata request: %w", err)
+		}
+
+		err = conn.SendExtended(utMetadata, req.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for f.remaining > 0 {
+		_, err = conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha1.Sum(f.info)
+	if hash != infoHash {
+		return nil, fmt.Errorf("expected metadata hash to be %x, got %x", infoHash, hash)
+	}
+
+	return f.info, nil
+}
+
+// handle processes a ut_metadata message received from the peer.
+func (f *metadataFetch) handle(_ *peer.Connection, payload []byte) error {
+	// The payload is a bencoded dictionary, followed by the piece data for data
+	// messages.
+	br := bufio.NewReader(bytes.NewReader(payload))
+	mm := metadataMessage{}
+	err := bencode.Unmarshal(br, &mm)
+	if err != nil {
+		return fmt.Errorf("failed to decode metadata message: %w", err)
+	}
+
+	switch mm.MsgType {
+	case metadataReject:
+		return fmt.Errorf("peer rejected request for metadata piece %d", mm.Piece)
+	case metadataData:
+		if mm.Piece < 0 || mm.Piece >= len(f.received) {
+			return fmt.Errorf("received unexpected metadata piece %d", mm.Piece)
+		}
+
+		data, _ := io.ReadAll(br)
+		begin := mm.Piece * metadataPieceSize
+		if len(data) != min(metadataPieceSize, len(f.info)-begin) {
+			return fmt.Errorf("received %d bytes for metadata piece %d", len(data), mm.Piece)
+		}
+
+		copy(f.info[begin:], data)
+		if !f.received[mm.Piece] {
+			f.received[mm.Piece] = true
+			f.remaining--
+		}
+	}
+
+	return nil
+}
@@ -20,6 +20,14 @@ const (
 	Port
 )
 
+// Extended is the message ID reserved for the extension protocol (BEP 10).
+const Extended = 20
+
+// maxLength caps the length of a received message, which is chosen by the
+// remote peer. It fits the bitfield of a torrent with 2 million pieces, well
+// beyond a block or an extended message.
+const maxLength = 256 * 1024
+
 type Message struct {
 	ID      uint8
 	Payload []byte
@@ -52,6 +60,8 @@ func (m *Message) name() string {
 		messageType = "Cancel"
 	case Port:
 		messageType = "Port"
+	case Extended:
+		messageType = "Extended"
 	}
 
 	return messageType
@@ -101,6 +111,10 @@ func Unmarshal(r io.Reader) (*Message, error) {
 		return nil, nil
 	}
 
+	if length > maxLength {
+		return nil, fmt.Errorf("message length %d exceeds the limit of %d", length, maxLength)
+	}
+
 	payloadBuf := make([]byte, length)
 	_, err = io.ReadFull(r, payloadBuf)
 	if err != nil {
@@ -174,6 +188,23 @@ func ParsePiece(index int, out []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock returns the piece index, begin offset and data of the block
+// carried by a Piece message. The data shares the payload of msg.
+func ParseBlock(msg *Message) (int, int, []byte, error) {
+	if msg.ID != Piece {
+		return 0, 0, nil, fmt.Errorf("expected message<piece> but got %s", msg)
+	}
+
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("expected payload to have at-least 8 bytes, got %d", len(msg.Payload))
+	}
+
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+
+	return index, begin, msg.Payload[8:], nil
+}
+
 func ParseCancel(msg *Message) (int, int, int, error) {
 	if msg.ID != Cancel {
 		return 0, 0, 0, fmt.Errorf("expected message<cancel> but got %s", msg)
@@ -190,6 +221,32 @@ func ParseCancel(msg *Message) (int, int, int, error) {
 	return parsedIndex, parsedBegin, parsedLength, nil
 }
 
+// ParsePort returns the UDP port of the DHT node of the remote peer carried by
+// a Port message.
+func ParsePort(msg *Message) (uint16, error) {
+	if msg.ID != Port {
+		return 0, fmt.Errorf("expected message<port> but got %s", msg)
+	}
+
+	if len(msg.Payload) != 2 {
+		return 0, fmt.Errorf("expected payload length to be 2, got %d", len(msg.Payload))
+	}
+
+	return binary.BigEndian.Uint16(msg.Payload), nil
+}
+
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != Extended {
+		return 0, nil, fmt.Errorf("expected message<extended> but got %s", msg)
+	}
+
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("expected payload to have at-least 1 byte, got %d", len(msg.Payload))
+	}
+
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
 func NewChoke() *Message {
 	return &Message{ID: Choke}
 }
@@ -254,3 +311,11 @@ func NewPort(port int) *Message {
 
 	return &Message{ID: Port, Payload: payload}
 }
+
+func NewExtended(id uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+
+	return &Message{ID: Extended, Payload: buf}
+}
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"bytes"
 	"log"
 	"testing"
 )
@@ -21,6 +22,7 @@ func TestMessageType(t *testing.T) {
 		{"should be a valid msg Piece id", NewPiece(0, 0, []byte{}).ID, Piece},
 		{"should be a valid msg Cancel id", NewCancel(0, 0, 128).ID, Cancel},
 		{"should be a valid msg Port id", NewPort(8080).ID, Port},
+		{"should be a valid msg Extended id", NewExtended(1, []byte{}).ID, Extended},
 	}
 
 	for _, tt := range tests {
@@ -48,6 +50,7 @@ func TestMessagePayload(t *testing.T) {
 		{"should be a valid msg Piece payload", len(NewPiece(1, 2, []byte{1, 2, 3, 4}).Payload), 12},
 		{"should be a valid msg Cancel payload", len(NewCancel(1, 2, 128).Payload), 12},
 		{"should be a valid msg Port payload", len(NewPort(8080).Payload), 2},
+		{"should be a valid msg Extended payload", len(NewExtended(1, []byte{1, 2, 3}).Payload), 4},
 	}
 
 	for _, tt := range tests {
@@ -59,3 +62,50 @@ func TestMessagePayload(t *testing.T) {
 		})
 	}
 }
+
+func TestParseBlock(t *testing.T) {
+	index, begin, block, err := ParseBlock(NewPiece(3, 16384, []byte{1, 2, 3, 4}))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if index != 3 || begin != 16384 || !bytes.Equal(block, []byte{1, 2, 3, 4}) {
+		t.Errorf("unexpected block %d %d %v", index, begin, block)
+	}
+
+	_, _, _, err = ParseBlock(NewHave(3))
+	if err == nil {
+		t.Errorf("expected an error for a non piece message")
+	}
+}
+
+func TestUnmarshalLength(t *testing.T) {
+	msg, err := Unmarshal(bytes.NewReader(NewBitfield(make([]byte, 1024)).Marshal()))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if msg.ID != Bitfield || len(msg.Payload) != 1024 {
+		t.Errorf("unexpected message %s", msg)
+	}
+
+	// the length is rejected before the payload is read
+	_, err = Unmarshal(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF, Piece}))
+	if err == nil {
+		t.Errorf("expected an error for a message exceeding the length limit")
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	port, err := ParsePort(NewPort(6881))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if port != 6881 {
+		t.Errorf("expected port 6881, got %d", port)
+	}
+
+	_, err = ParsePort(&Message{ID: Port, Payload: []byte{1}})
+	if err == nil {
+		t.Errorf("expected an error for a truncated payload")
+	}
+}
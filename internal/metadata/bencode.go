@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// errKeyNotFound is returned by rawDictValue for a key missing from the
+// dictionary.
+var errKeyNotFound = errors.New("not found")
+
+// rawDictValue returns the bencoded bytes of the value stored under key in the
+// top level dictionary of data, exactly as they appear in data.
+func rawDictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("expected a bencoded dictionary")
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		k, next, err := readString(data, pos)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dictionary key: %w", err)
+		}
+
+		end, err := skipValue(data, next)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value for key %q: %w", k, err)
+		}
+
+		if string(k) == key {
+			return data[next:end], nil
+		}
+		pos = end
+	}
+
+	if pos >= len(data) {
+		return nil, fmt.Errorf("unterminated dictionary")
+	}
+
+	return nil, fmt.Errorf("key %q %w", key, errKeyNotFound)
+}
+
+// skipValue returns the offset just past the bencoded value starting at pos.
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("unexpected end of data at offset %d", pos)
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer at offset %d", pos)
+		}
+
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			if c == 'd' {
+				_, next, err := readString(data, pos)
+				if err != nil {
+					return 0, err
+				}
+				pos = next
+			}
+
+			next, err := skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+
+		if pos >= len(data) {
+			return 0, fmt.Errorf("unterminated list or dictionary")
+		}
+
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, next, err := readString(data, pos)
+
+		return next, err
+	default:
+		return 0, fmt.Errorf("unexpected byte %q at offset %d", c, pos)
+	}
+}
+
+// readString reads the bencoded string starting at pos and returns its
+// contents along with the offset just past it.
+func readString(data []byte, pos int) ([]byte, int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon < 0 {
+		return nil, 0, fmt.Errorf("malformed string at offset %d", pos)
+	}
+
+	length, err := strconv.Atoi(string(data[pos : pos+colon]))
+	if err != nil || length < 0 {
+		return nil, 0, fmt.Errorf("malformed string length at offset %d", pos)
+	}
+
+	start := pos + colon + 1
+	if length > len(data)-start {
+		return nil, 0, fmt.Errorf("string at offset %d exceeds data length", pos)
+	}
+
+	return data[start : start+length], start + length, nil
+}
@@ -4,53 +4,75 @@ package metadata
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/logger"
 	"github.com/xanish/torrenty/internal/peer"
 )
 
 const (
 	sha1HashLen = 20
 	timeout     = 5 * time.Second
+
+	// maxLookups caps the host names resolved for a single tracker response,
+	// the peers beyond it are skipped.
+	maxLookups = 50
 )
 
-type pieceInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-}
+// lookupIP resolves the host names that trackers return in place of the IP
+// address of a peer.
+var lookupIP = net.DefaultResolver.LookupIP
 
-// hash generates the sha1 hash of the piece info which forms the info_hash
-// passed to trackers to uniquely identify the torrent being downloaded.
-func (pi pieceInfo) hash() ([20]byte, error) {
-	var encoded bytes.Buffer
-	err := bencode.Marshal(&encoded, pi)
-	if err != nil {
-		return [20]byte{}, fmt.Errorf("failed to encode piece info: %w", err)
-	}
+type fileInfo struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
 
-	return sha1.Sum(encoded.Bytes()), nil
+type pieceInfo struct {
+	Pieces      string     `bencode:"pieces"`
+	PieceLength int        `bencode:"piece length"`
+	Length      int        `bencode:"length"`
+	Name        string     `bencode:"name"`
+	Files       []fileInfo `bencode:"files"`
 }
 
 type baseInfo struct {
-	Announce string    `bencode:"announce"`
-	Info     pieceInfo `bencode:"info"`
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	Info         pieceInfo  `bencode:"info"`
+}
+
+// File describes a single file of the torrent. Path holds the components of
+// the file path relative to the download directory, and Offset is the position
+// of the first byte of the file in the concatenated piece stream.
+type File struct {
+	Path   []string `json:"path"`
+	Length int      `json:"length"`
+	Offset int      `json:"offset"`
 }
 
 type Metadata struct {
 	Name            string      `json:"name"`
 	Size            int         `json:"size"`
+	Files           []File      `json:"files"`
 	Announce        string      `json:"announce"`
+	Trackers        [][]string  `json:"trackers"`
 	InfoHash        [20]byte    `json:"infoHash"`
 	Pieces          [][20]byte  `json:"pieces"`
 	PieceLength     int         `json:"pieceLength"`
@@ -58,6 +80,75 @@ type Metadata struct {
 	RefreshInterval int         `json:"refreshInterval"`
 }
 
+// PieceSize returns the length of the piece at index. All pieces are of
+// PieceLength bytes except the last one, which may be shorter.
+func (m *Metadata) PieceSize(index int) int {
+	begin := index * m.PieceLength
+	end := begin + m.PieceLength
+	if end > m.Size {
+		end = m.Size
+	}
+
+	return end - begin
+}
+
+// Event is the lifecycle event of a download reported with an announce. The
+// values are the ones of the UDP tracker protocol.
+type Event int
+
+const (
+	// EventNone is reported by the regular announces of a running download.
+	EventNone Event = iota
+	// EventCompleted is reported once, when the download completes.
+	EventCompleted
+	// EventStarted is reported by the first announce of a download.
+	EventStarted
+	// EventStopped is reported when the download is shut down.
+	EventStopped
+)
+
+// String returns the name of the event as sent to HTTP trackers, which is
+// empty for EventNone.
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// Progress is the state of the download reported to trackers with an
+// announce. Uploaded and Downloaded count the bytes transferred since the
+// download started, and Left the bytes still missing.
+type Progress struct {
+	Event      Event
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+
+	// IPv6 is the global IPv6 address of the client, if it has one. It is
+	// sent to HTTP trackers, so that they hand it out to IPv6 peers even when
+	// the announce reaches them over IPv4 (BEP 7).
+	IPv6 net.IP
+}
+
+// left returns the number of bytes reported to trackers as left to download.
+// The size of a torrent added from a magnet link is unknown until its info
+// dictionary has been fetched, in which case a non-zero value is reported so
+// that trackers do not mistake us for a seeder.
+func (m *Metadata) left(p Progress) int64 {
+	if len(m.Pieces) == 0 {
+		return 1
+	}
+
+	return p.Left
+}
+
 func (m *Metadata) SetPeers(peers []peer.Peer) {
 	m.Peers = peers
 }
@@ -66,47 +157,200 @@ func (m *Metadata) SetRefreshInterval(duration int) {
 	m.RefreshInterval = duration
 }
 
-func (m *Metadata) trackerURL(peerID [20]byte, port uint16) (string, error) {
-	baseUrl, err := url.Parse(m.Announce)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse announce url: %w", err)
-	}
-
+func (m *Metadata) trackerURL(baseUrl *url.URL, peerID [20]byte, port uint16, p Progress) string {
 	params := url.Values{
 		"info_hash":  []string{string(m.InfoHash[:])},
 		"peer_id":    []string{string(peerID[:])},
 		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"uploaded":   []string{strconv.FormatInt(p.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(p.Downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(m.Size)},
+		"left":       []string{strconv.FormatInt(m.left(p), 10)},
+	}
+	if p.Event != EventNone {
+		params.Set("event", p.Event.String())
+	}
+	if p.IPv6 != nil {
+		params.Set("ipv6", p.IPv6.String())
 	}
 
-	baseUrl.RawQuery = params.Encode()
+	u := *baseUrl
+	u.RawQuery = params.Encode()
 
-	return baseUrl.String(), nil
+	return u.String()
 }
 
+// rawResponse is the response of an HTTP tracker. Its peers are decoded on
+// their own by extractResponsePeers, as they come in two formats.
 type rawResponse struct {
 	Interval      int    `bencode:"interval"`
-	Peers         string `bencode:"peers"`
+	MinInterval   int    `bencode:"min interval"`
+	Peers6        string `bencode:"peers6,omitempty"`
 	FailureReason string `bencode:"failure reason,omitempty"`
 }
 
+// rawPeer is an entry of the peers list of a tracker response in the original
+// dictionary model, sent by trackers ignoring the compact parameter.
+type rawPeer struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+// Response is the answer of the trackers to an announce. RefreshInterval is
+// the number of seconds to wait before the next regular announce, and
+// MinInterval, if not zero, the number of seconds to wait at least before
+// announcing again.
 type Response struct {
 	Peers           []peer.Peer
 	RefreshInterval int
+	MinInterval     int
+}
+
+// SyncWithTracker announces the client to the trackers of the torrent and
+// fetches the list of peers sharing it. Following BEP 12 the trackers within a
+// tier are tried in order until one responds, and the responding tracker is
+// moved to the front of its tier. Every tier is queried, and the peers from all
+// reachable tiers are merged. The trackers are told about the progress of the
+// download. Cancelling ctx aborts the pending announces.
+func (m *Metadata) SyncWithTracker(ctx context.Context, peerID [20]byte, port uint16, p Progress) (*Response, error) {
+	return m.SyncWithTrackerFunc(ctx, peerID, port, p, nil)
+}
+
+// SyncWithTrackerFunc is like SyncWithTracker but also hands the peers of
+// every tier to found as soon as the tier responds, leaving out the ones
+// handed over already, so that a slow tier does not hold up the peers of the
+// others. Calls to found are not concurrent, and found may be nil.
+func (m *Metadata) SyncWithTrackerFunc(ctx context.Context, peerID [20]byte, port uint16, p Progress, found func([]peer.Peer)) (*Response, error) {
+	if len(m.Trackers) == 0 && m.Announce != "" {
+		m.Trackers = [][]string{{m.Announce}}
+	}
+
+	if len(m.Trackers) == 0 {
+		return nil, fmt.Errorf("torrent does not list any trackers")
+	}
+
+	type tierResult struct {
+		res *Response
+		err error
+	}
+
+	// Tiers are queried concurrently so that an unresponsive tracker in one tier
+	// does not delay the others. Each goroutine only reorders its own tier.
+	results := make([]tierResult, len(m.Trackers))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	handed := make(map[string]bool)
+	for i := range m.Trackers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := m.syncWithTier(ctx, m.Trackers[i], peerID, port, p)
+			results[i] = tierResult{res: res, err: err}
+			if err != nil || found == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			var fresh []peer.Peer
+			for _, p := range res.Peers {
+				if !handed[p.String()] {
+					handed[p.String()] = true
+					fresh = append(fresh, p)
+				}
+			}
+			if len(fresh) > 0 {
+				found(fresh)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	merged := &Response{}
+	seen := make(map[string]bool)
+	errs := make([]error, 0, len(results))
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs, result.err)
+			continue
+		}
+
+		if merged.RefreshInterval == 0 {
+			merged.RefreshInterval = result.res.RefreshInterval
+		}
+		merged.MinInterval = max(merged.MinInterval, result.res.MinInterval)
+
+		for _, p := range result.res.Peers {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+		}
+	}
+
+	if len(errs) == len(results) {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("syncing with trackers aborted: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("failed to sync with any tracker: %w", errors.Join(errs...))
+	}
+
+	return merged, nil
+}
+
+// syncWithTier tries the trackers of a tier in order and promotes the first one
+// that responds to the front of the tier.
+func (m *Metadata) syncWithTier(ctx context.Context, tier []string, peerID [20]byte, port uint16, p Progress) (*Response, error) {
+	errs := make([]error, 0, len(tier))
+	for i, tracker := range tier {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		res, err := m.syncWithTracker(ctx, tracker, peerID, port, p)
+		if err != nil {
+			logger.Log(logger.Warning, "failed to sync with tracker %s: %s", tracker, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		copy(tier[1:i+1], tier[:i])
+		tier[0] = tracker
+
+		return res, nil
+	}
+
+	return nil, errors.Join(errs...)
 }
 
-func (m *Metadata) SyncWithTracker(peerID [20]byte, port uint16) (*Response, error) {
+// syncWithTracker announces to a single tracker, selecting the protocol from
+// the scheme of its url.
+func (m *Metadata) syncWithTracker(ctx context.Context, tracker string, peerID [20]byte, port uint16, p Progress) (*Response, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse announce url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return m.syncWithHTTPTracker(ctx, u, peerID, port, p)
+	case "udp":
+		return m.syncWithUDPTracker(ctx, u, peerID, port, p)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+func (m *Metadata) syncWithHTTPTracker(ctx context.Context, u *url.URL, peerID [20]byte, port uint16, p Progress) (*Response, error) {
 	c := &http.Client{Timeout: timeout}
 
-	trackerURL, err := m.trackerURL(peerID, port)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.trackerURL(u, peerID, port, p), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.Get(trackerURL)
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -114,8 +358,13 @@ func (m *Metadata) SyncWithTracker(peerID [20]byte, port uint16) (*Response, err
 		_ = Body.Close()
 	}(resp.Body)
 
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tracker response: %w", err)
+	}
+
 	rr := rawResponse{}
-	err = bencode.Unmarshal(resp.Body, &rr)
+	err = bencode.Unmarshal(bytes.NewReader(data), &rr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
 	}
@@ -124,14 +373,21 @@ func (m *Metadata) SyncWithTracker(peerID [20]byte, port uint16) (*Response, err
 		return nil, fmt.Errorf("failed to fetch peers from tracker due to: %s", rr.FailureReason)
 	}
 
-	peers, err := extractPeers([]byte(rr.Peers))
+	peers, err := extractResponsePeers(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	peers6, err := extractPeers([]byte(rr.Peers6), net.IPv6len)
 	if err != nil {
 		return nil, err
 	}
+	peers = append(peers, peers6...)
 
 	return &Response{
 		Peers:           peers,
 		RefreshInterval: rr.Interval,
+		MinInterval:     rr.MinInterval,
 	}, nil
 }
 
@@ -145,34 +401,169 @@ func (m *Metadata) String() (string, error) {
 }
 
 func New(r io.Reader) (Metadata, error) {
-	bi := baseInfo{}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to read torrent metadata: %w", err)
+	}
 
-	err := bencode.Unmarshal(r, &bi)
+	bi := baseInfo{}
+	err = bencode.Unmarshal(bytes.NewReader(data), &bi)
 	if err != nil {
 		return Metadata{}, fmt.Errorf("failed to decode torrent metadata: %w", err)
 	}
 
-	infoHash, err := bi.Info.hash()
+	// The info_hash passed to trackers and peers is the sha1 hash of the info
+	// dictionary exactly as it appears in the torrent file. Re-encoding the
+	// decoded struct would drop any keys we do not know about (private, source,
+	// md5sum, ...) and produce a different hash.
+	rawInfo, err := rawDictValue(data, "info")
 	if err != nil {
-		return Metadata{}, err
+		return Metadata{}, fmt.Errorf("failed to locate info dictionary: %w", err)
+	}
+
+	return newMetadata(rawInfo, bi.Info, bi.Announce, tiers(bi.Announce, bi.AnnounceList))
+}
+
+// NewFromInfo builds the metadata of a torrent from its bencoded info
+// dictionary, as fetched from peers for magnet links, and the tiers of trackers
+// to announce to.
+func NewFromInfo(info []byte, trackers [][]string) (Metadata, error) {
+	pi := pieceInfo{}
+	err := bencode.Unmarshal(bytes.NewReader(info), &pi)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to decode info dictionary: %w", err)
+	}
+
+	announce := ""
+	if len(trackers) > 0 && len(trackers[0]) > 0 {
+		announce = trackers[0][0]
 	}
 
-	pieces, err := split(bi.Info.Pieces)
+	return newMetadata(info, pi, announce, trackers)
+}
+
+func newMetadata(rawInfo []byte, pi pieceInfo, announce string, trackers [][]string) (Metadata, error) {
+	pieces, err := split(pi.Pieces)
 	if err != nil {
 		return Metadata{}, fmt.Errorf("failed to parse pieces: %w", err)
 	}
 
+	files, size, err := layout(pi)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to parse files: %w", err)
+	}
+
+	if pi.PieceLength <= 0 {
+		return Metadata{}, fmt.Errorf("invalid piece length %d", pi.PieceLength)
+	}
+	numPieces := (size + pi.PieceLength - 1) / pi.PieceLength
+	if len(pieces) != numPieces {
+		return Metadata{}, fmt.Errorf("expected %d piece hashes for %d bytes, got %d", numPieces, size, len(pieces))
+	}
+
 	return Metadata{
-		Name:        bi.Info.Name,
-		Size:        bi.Info.Length,
-		Announce:    bi.Announce,
-		InfoHash:    infoHash,
+		Name:        pi.Name,
+		Size:        size,
+		Files:       files,
+		Announce:    announce,
+		Trackers:    trackers,
+		InfoHash:    sha1.Sum(rawInfo),
 		Pieces:      pieces,
-		PieceLength: bi.Info.PieceLength,
+		PieceLength: pi.PieceLength,
 		Peers:       make([]peer.Peer, 0),
 	}, nil
 }
 
+// tiers returns the tiers of trackers listed in the torrent. When the
+// announce-list key is present the announce key is ignored, as per BEP 12, and
+// the trackers within each tier are shuffled.
+func tiers(announce string, announceList [][]string) [][]string {
+	result := make([][]string, 0, len(announceList))
+	for _, tier := range announceList {
+		trackers := make([]string, 0, len(tier))
+		for _, tracker := range tier {
+			if tracker != "" {
+				trackers = append(trackers, tracker)
+			}
+		}
+
+		if len(trackers) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(trackers), func(i, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+		result = append(result, trackers)
+	}
+
+	if len(result) == 0 && announce != "" {
+		result = append(result, []string{announce})
+	}
+
+	return result
+}
+
+// layout builds the list of files present in the torrent along with their
+// offsets in the piece stream. Single file torrents are represented as a list
+// holding just one file, while the files of a multi-file torrent are placed
+// inside a directory named after the torrent.
+func layout(pi pieceInfo) ([]File, int, error) {
+	if err := validPathComponent(pi.Name); err != nil {
+		return nil, 0, fmt.Errorf("invalid name %q: %w", pi.Name, err)
+	}
+
+	if len(pi.Files) == 0 {
+		if pi.Length < 0 {
+			return nil, 0, fmt.Errorf("negative length %d", pi.Length)
+		}
+
+		return []File{{Path: []string{pi.Name}, Length: pi.Length}}, pi.Length, nil
+	}
+
+	files := make([]File, len(pi.Files))
+	offset := 0
+	for i, fi := range pi.Files {
+		if len(fi.Path) == 0 {
+			return nil, 0, fmt.Errorf("file %d has an empty path", i)
+		}
+
+		for _, component := range fi.Path {
+			if err := validPathComponent(component); err != nil {
+				return nil, 0, fmt.Errorf("invalid path %q for file %d: %w", strings.Join(fi.Path, "/"), i, err)
+			}
+		}
+
+		if fi.Length < 0 {
+			return nil, 0, fmt.Errorf("file %d has a negative length %d", i, fi.Length)
+		}
+
+		files[i] = File{
+			Path:   append([]string{pi.Name}, fi.Path...),
+			Length: fi.Length,
+			Offset: offset,
+		}
+		offset += fi.Length
+	}
+
+	return files, offset, nil
+}
+
+// validPathComponent guards against path components that would allow a torrent
+// to write outside the download directory.
+func validPathComponent(component string) error {
+	switch {
+	case component == "":
+		return fmt.Errorf("path component cannot be empty")
+	case component == "." || component == "..":
+		return fmt.Errorf("path component cannot be %q", component)
+	case strings.ContainsAny(component, "/\\"):
+		return fmt.Errorf("path component cannot contain separators")
+	}
+
+	return nil
+}
+
 func split(pieces string) ([][20]byte, error) {
 	buf := []byte(pieces)
 
@@ -190,8 +581,97 @@ func split(pieces string) ([][20]byte, error) {
 	return hashes, nil
 }
 
-func extractPeers(bytes []byte) ([]peer.Peer, error) {
-	const peerBytes = 6 // 4 for IP, 2 for port
+// extractResponsePeers parses the peers of the tracker response data, which are
+// either a compact peers list or a list of dictionaries holding the peer id,
+// ip and port of every peer. The ip of a dictionary may be a host name, which
+// is resolved to every address it has, up to maxLookups host names.
+func extractResponsePeers(ctx context.Context, data []byte) ([]peer.Peer, error) {
+	raw, err := rawDictValue(data, "peers")
+	if errors.Is(err, errKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate peers of tracker response: %w", err)
+	}
+
+	if len(raw) == 0 || raw[0] != 'l' {
+		var compact string
+		err = bencode.Unmarshal(bytes.NewReader(raw), &compact)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode peers of tracker response: %w", err)
+		}
+
+		return extractPeers([]byte(compact), net.IPv4len)
+	}
+
+	var rawPeers []rawPeer
+	err = bencode.Unmarshal(bytes.NewReader(raw), &rawPeers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode peers of tracker response: %w", err)
+	}
+
+	// Host names are resolved concurrently, each within timeout, so that a
+	// slow resolver does not hold up the announce for every peer.
+	resolved := make([][]net.IP, len(rawPeers))
+	lookups := 0
+	var wg sync.WaitGroup
+	for i, rp := range rawPeers {
+		if rp.IP == "" || rp.Port <= 0 || rp.Port > math.MaxUint16 {
+			logger.Log(logger.Debug, "skipping peer %q with port %d from tracker response", rp.IP, rp.Port)
+			continue
+		}
+
+		if ip := net.ParseIP(rp.IP); ip != nil {
+			resolved[i] = []net.IP{ip}
+			continue
+		}
+
+		if lookups == maxLookups {
+			logger.Log(logger.Debug, "skipping peer %q from tracker response, %d host names resolved already", rp.IP, maxLookups)
+			continue
+		}
+		lookups++
+
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			ips, err := lookupIP(ctx, "ip", host)
+			if err != nil {
+				logger.Log(logger.Debug, "skipping peer %q from tracker response: %s", host, err)
+				return
+			}
+			resolved[i] = ips
+		}(i, rp.IP)
+	}
+	wg.Wait()
+
+	peers := make([]peer.Peer, 0, len(rawPeers))
+	for i, rp := range rawPeers {
+		for _, ip := range resolved[i] {
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+
+			p := peer.Peer{IP: ip, Port: uint16(rp.Port)}
+			if len(rp.PeerID) == len(p.ID) {
+				copy(p.ID[:], rp.PeerID)
+			}
+			peers = append(peers, p)
+		}
+	}
+
+	return peers, nil
+}
+
+// extractPeers parses a compact peers list, made of ipLen bytes of IP address
+// followed by 2 bytes of port for every peer. IPv4 peers take net.IPv4len bytes
+// and IPv6 peers net.IPv6len bytes (BEP 7).
+func extractPeers(bytes []byte, ipLen int) ([]peer.Peer, error) {
+	peerBytes := ipLen + 2
 	numPeers := len(bytes) / peerBytes
 
 	if len(bytes)%peerBytes != 0 {
@@ -201,8 +681,8 @@ func extractPeers(bytes []byte) ([]peer.Peer, error) {
 	peers := make([]peer.Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerBytes
-		peers[i].IP = bytes[offset : offset+4]
-		peers[i].Port = binary.BigEndian.Uint16(bytes[offset+4 : offset+6])
+		peers[i].IP = bytes[offset : offset+ipLen]
+		peers[i].Port = binary.BigEndian.Uint16(bytes[offset+ipLen : offset+peerBytes])
 	}
 
 	return peers, nil
@@ -0,0 +1,487 @@
+package metadata
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xanish/torrenty/internal/peer"
+)
+
+// bstr bencodes s as a string.
+func bstr(s string) string {
+	return fmt.Sprintf("%d:%s", len(s), s)
+}
+
+func TestNewInfoHash(t *testing.T) {
+	pieces := bstr(strings.Repeat("\x8f", 40))
+
+	tests := []struct {
+		name   string
+		prefix string
+		info   string
+		suffix string
+		files  int
+		size   int
+	}{
+		{
+			name:   "should hash a plain single file torrent",
+			prefix: "d8:announce" + bstr("http://tracker.example.com/announce"),
+			info:   "d6:lengthi20000e4:name" + bstr("file.txt") + "12:piece lengthi16384e6:pieces" + pieces + "e",
+			suffix: "e",
+			files:  1,
+			size:   20000,
+		},
+		{
+			name:   "should hash a private torrent with a source tag",
+			prefix: "d8:announce" + bstr("https://tracker.example.org/abc/announce") + "10:created by" + bstr("mktorrent 1.1"),
+			info:   "d6:lengthi20000e4:name" + bstr("ubuntu.iso") + "12:piece lengthi16384e6:pieces" + pieces + "7:privatei1e6:source" + bstr("EXAMPLE") + "e",
+			suffix: "13:creation datei1700000000ee",
+			files:  1,
+			size:   20000,
+		},
+		{
+			name:   "should hash a torrent carrying an md5sum",
+			prefix: "d8:announce" + bstr("udp://tracker.example.com:80") + "7:comment" + bstr("4:info is not a key here"),
+			info:   "d6:lengthi20000e6:md5sum" + bstr("d41d8cd98f00b204e9800998ecf8427e") + "4:name" + bstr("file.bin") + "12:piece lengthi16384e6:pieces" + pieces + "e",
+			suffix: "e",
+			files:  1,
+			size:   20000,
+		},
+		{
+			name:   "should hash a multi-file torrent with padding files",
+			prefix: "d8:announce" + bstr("http://tracker.example.com/announce"),
+			info: "d5:filesl" +
+				"d6:lengthi10000e4:pathl" + bstr("a.txt") + "ee" +
+				"d4:attr" + bstr("p") + "6:lengthi6384e4:pathl" + bstr(".pad") + bstr("6384") + "ee" +
+				"d6:lengthi3616e4:pathl" + bstr("sub") + bstr("b.txt") + "ee" +
+				"e4:name" + bstr("dir") + "12:piece lengthi16384e6:pieces" + pieces + "7:privatei1ee",
+			suffix: "e",
+			files:  3,
+			size:   20000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(strings.NewReader(tt.prefix + "4:info" + tt.info + tt.suffix))
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+
+			want := sha1.Sum([]byte(tt.info))
+			if m.InfoHash != want {
+				t.Errorf("expected info hash to be %x, got %x", want, m.InfoHash)
+			}
+
+			if len(m.Files) != tt.files {
+				t.Errorf("expected %d files, got %d", tt.files, len(m.Files))
+			}
+
+			if m.Size != tt.size {
+				t.Errorf("expected size to be %d, got %d", tt.size, m.Size)
+			}
+		})
+	}
+}
+
+func TestNewInfoHashFixture(t *testing.T) {
+	// multi-file-private.torrent carries keys the decoder does not know about
+	// (private, source, md5sum, url-list, ...), its info-hash was computed
+	// independently of this package when the fixture was created.
+	f, err := os.Open("testdata/multi-file-private.torrent")
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	m, err := New(f)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	want := "9237976f793e99f69e58bd6b8722790c716607d9"
+	if got := hex.EncodeToString(m.InfoHash[:]); got != want {
+		t.Errorf("expected info hash to be %s, got %s", want, got)
+	}
+
+	if len(m.Files) != 3 || m.Size != 41100 || len(m.Pieces) != 3 {
+		t.Errorf("expected 3 files of 41100 bytes in 3 pieces, got %d files of %d bytes in %d pieces", len(m.Files), m.Size, len(m.Pieces))
+	}
+}
+
+func TestNewLayout(t *testing.T) {
+	torrent := "d4:infod5:filesl" +
+		"d6:lengthi5e4:pathl" + bstr("a.txt") + "ee" +
+		"d6:lengthi0e4:pathl" + bstr("empty") + "ee" +
+		"d6:lengthi7e4:pathl" + bstr("sub") + bstr("b.txt") + "ee" +
+		"e4:name" + bstr("dir") + "12:piece lengthi8e6:pieces" + bstr(strings.Repeat("x", 40)) + "ee"
+
+	m, err := New(strings.NewReader(torrent))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	want := []File{
+		{Path: []string{"dir", "a.txt"}, Length: 5, Offset: 0},
+		{Path: []string{"dir", "empty"}, Length: 0, Offset: 5},
+		{Path: []string{"dir", "sub", "b.txt"}, Length: 7, Offset: 5},
+	}
+	if !reflect.DeepEqual(m.Files, want) {
+		t.Errorf("expected files to be %#v, got %#v", want, m.Files)
+	}
+
+	if m.PieceSize(0) != 8 || m.PieceSize(1) != 4 {
+		t.Errorf("expected piece sizes to be 8 and 4, got %d and %d", m.PieceSize(0), m.PieceSize(1))
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := map[string]string{
+		"should fail without an info dictionary":     "d8:announce" + bstr("http://t") + "e",
+		"should fail on a truncated info dictionary": "d4:infod4:name" + bstr("x"),
+		"should fail on path traversal": "d4:infod5:filesld6:lengthi1e4:pathl" + bstr("..") + bstr("x") +
+			"eee4:name" + bstr("dir") + "12:piece lengthi8e6:pieces" + bstr(strings.Repeat("x", 20)) + "ee",
+		"should fail on a zero piece length": "d4:infod6:lengthi20e4:name" + bstr("x") +
+			"12:piece lengthi0e6:pieces" + bstr(strings.Repeat("x", 20)) + "ee",
+		"should fail on too many piece hashes": "d4:infod6:lengthi20e4:name" + bstr("x") +
+			"12:piece lengthi16e6:pieces" + bstr(strings.Repeat("x", 60)) + "ee",
+		"should fail on too few piece hashes": "d4:infod6:lengthi20e4:name" + bstr("x") +
+			"12:piece lengthi16e6:pieces" + bstr(strings.Repeat("x", 20)) + "ee",
+		"should fail on a negative length": "d4:infod6:lengthi-20e4:name" + bstr("x") +
+			"12:piece lengthi16e6:pieces" + bstr("") + "ee",
+	}
+
+	for name, torrent := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(strings.NewReader(torrent))
+			if err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestNewAnnounceList(t *testing.T) {
+	torrent := "d8:announce" + bstr("http://ignored.example.com/announce") +
+		"13:announce-listll" + bstr("udp://a.example.com:80") + bstr("udp://b.example.com:80") + "el" +
+		bstr("http://c.example.com/announce") + "elee" +
+		"4:infod6:lengthi1e4:name" + bstr("x") + "12:piece lengthi8e6:pieces" + bstr(strings.Repeat("x", 20)) + "ee"
+
+	m, err := New(strings.NewReader(torrent))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if len(m.Trackers) != 2 || len(m.Trackers[0]) != 2 || len(m.Trackers[1]) != 1 {
+		t.Fatalf("expected 2 non-empty tiers, got %v", m.Trackers)
+	}
+
+	first := strings.Join(m.Trackers[0], ",")
+	if first != "udp://a.example.com:80,udp://b.example.com:80" && first != "udp://b.example.com:80,udp://a.example.com:80" {
+		t.Errorf("unexpected first tier %v", m.Trackers[0])
+	}
+
+	if m.Trackers[1][0] != "http://c.example.com/announce" {
+		t.Errorf("unexpected second tier %v", m.Trackers[1])
+	}
+}
+
+func TestSyncWithTrackerTiers(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 1)
+
+	first := startFakeUDPTracker(t, &fakeUDPTracker{peers: []byte{10, 0, 0, 1, 0x1A, 0xE1}})
+	second := startFakeUDPTracker(t, &fakeUDPTracker{peers: []byte{10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE1}})
+	dead := "wss://dead.example.com/announce"
+
+	m := Metadata{
+		Trackers: [][]string{
+			{dead, first.url()},
+			{dead},
+			{second.url()},
+		},
+	}
+
+	res, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if len(res.Peers) != 2 {
+		t.Errorf("expected peers from every reachable tier to be merged, got %v", res.Peers)
+	}
+
+	if m.Trackers[0][0] != first.url() || m.Trackers[0][1] != dead {
+		t.Errorf("expected working tracker to be promoted, got %v", m.Trackers[0])
+	}
+
+	m.Trackers = [][]string{{dead}}
+	_, err = m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted})
+	if err == nil {
+		t.Errorf("expected an error when no tracker is reachable")
+	}
+}
+
+func TestSyncWithTrackerFuncStreamsTiers(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 1)
+
+	fast := startFakeUDPTracker(t, &fakeUDPTracker{peers: []byte{10, 0, 0, 1, 0x1A, 0xE1}})
+
+	// the slow tier only responds once the peers of the fast one arrived
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		peers := string([]byte{10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE1})
+		_, _ = w.Write([]byte("d8:intervali900e5:peers" + bstr(peers) + "e"))
+	}))
+	defer slow.Close()
+
+	m := Metadata{Trackers: [][]string{{slow.URL + "/announce"}, {fast.url()}}}
+
+	found := make(chan []peer.Peer, 2)
+	type result struct {
+		res *Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := m.SyncWithTrackerFunc(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted}, func(peers []peer.Peer) {
+			found <- peers
+		})
+		done <- result{res: res, err: err}
+	}()
+
+	select {
+	case peers := <-found:
+		if len(peers) != 1 || peers[0].String() != "10.0.0.1:6881" {
+			t.Errorf("expected the peer of the fast tier, got %v", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the peers of the fast tier before the slow one responds")
+	}
+	close(release)
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("expected error to be nil, got %v", r.err)
+	}
+	if len(r.res.Peers) != 2 {
+		t.Errorf("expected peers from every tier to be merged, got %v", r.res.Peers)
+	}
+
+	// peers handed over already are left out
+	peers := <-found
+	if len(peers) != 1 || peers[0].String() != "10.0.0.2:6881" {
+		t.Errorf("expected only the new peer of the slow tier, got %v", peers)
+	}
+}
+
+func TestSyncWithHTTPTracker(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		peers := string([]byte{10, 0, 0, 1, 0x1A, 0xE1})
+		peers6 := string(append(net.ParseIP("2001:db8::1"), 0x1A, 0xE1))
+		_, _ = w.Write([]byte("d8:intervali900e12:min intervali60e5:peers6:" + peers + "6:peers618:" + peers6 + "e"))
+	}))
+	defer srv.Close()
+
+	tests := map[string]struct {
+		progress Progress
+		pieces   int
+		want     map[string]string
+	}{
+		"should report the event and the transfer counters": {
+			progress: Progress{Event: EventStarted, Uploaded: 10, Downloaded: 20, Left: 30},
+			pieces:   1,
+			want:     map[string]string{"event": "started", "uploaded": "10", "downloaded": "20", "left": "30", "ipv6": ""},
+		},
+		"should report the ipv6 address of the client": {
+			progress: Progress{IPv6: net.ParseIP("2001:db8::2")},
+			pieces:   1,
+			want:     map[string]string{"ipv6": "2001:db8::2"},
+		},
+		"should leave out the event of a regular announce": {
+			progress: Progress{Uploaded: 5, Left: 0},
+			pieces:   1,
+			want:     map[string]string{"event": "", "uploaded": "5", "downloaded": "0", "left": "0"},
+		},
+		"should report bytes left while the size is unknown": {
+			progress: Progress{Event: EventStopped},
+			want:     map[string]string{"event": "stopped", "left": "1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := Metadata{Announce: srv.URL + "/announce", Pieces: make([][20]byte, test.pieces)}
+			res, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, test.progress)
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+
+			if res.RefreshInterval != 900 || res.MinInterval != 60 {
+				t.Errorf("expected interval 900 and min interval 60, got %+v", res)
+			}
+
+			if len(res.Peers) != 2 || res.Peers[0].String() != "10.0.0.1:6881" || res.Peers[1].String() != "[2001:db8::1]:6881" {
+				t.Errorf("expected an ipv4 and an ipv6 peer, got %v", res.Peers)
+			}
+
+			for key, want := range test.want {
+				if got := query.Get(key); got != want {
+					t.Errorf("expected %s to be %q, got %q", key, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncWithHTTPTrackerPeerFormats(t *testing.T) {
+	defer func(lookup func(context.Context, string, string) ([]net.IP, error)) {
+		lookupIP = lookup
+	}(lookupIP)
+	lookupIP = func(_ context.Context, _, host string) ([]net.IP, error) {
+		if host == "peer.example.com" {
+			return []net.IP{net.IPv4(10, 0, 0, 3), net.ParseIP("2001:db8::3")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	peerID := "-TR3000-abcdefghijkl"
+
+	tests := map[string]struct {
+		peers string
+		want  []string
+		ids   [][20]byte
+	}{
+		"should decode compact peers": {
+			peers: bstr(string([]byte{10, 0, 0, 1, 0x1A, 0xE1})),
+			want:  []string{"10.0.0.1:6881"},
+			ids:   [][20]byte{{}},
+		},
+		"should decode the dictionary model": {
+			peers: "ld7:peer id" + bstr(peerID) + "2:ip8:10.0.0.14:porti6881eed2:ip11:2001:db8::14:porti6882eee",
+			want:  []string{"10.0.0.1:6881", "[2001:db8::1]:6882"},
+			ids:   [][20]byte{[20]byte([]byte(peerID)), {}},
+		},
+		"should resolve dictionary peers with a host name": {
+			peers: "ld7:peer id" + bstr(peerID) + "2:ip" + bstr("peer.example.com") + "4:porti6881eee",
+			want:  []string{"10.0.0.3:6881", "[2001:db8::3]:6881"},
+			ids:   [][20]byte{[20]byte([]byte(peerID)), [20]byte([]byte(peerID))},
+		},
+		"should skip dictionary peers whose host name does not resolve": {
+			peers: "ld2:ip" + bstr("unknown.example.com") + "4:porti6881eed2:ip8:10.0.0.24:porti6882eee",
+			want:  []string{"10.0.0.2:6882"},
+			ids:   [][20]byte{{}},
+		},
+		"should accept a response without peers": {},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := "d8:intervali900e"
+				if test.peers != "" {
+					body += "5:peers" + test.peers
+				}
+				_, _ = w.Write([]byte(body + "e"))
+			}))
+			defer srv.Close()
+
+			m := Metadata{Announce: srv.URL + "/announce"}
+			res, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{})
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+
+			if len(res.Peers) != len(test.want) {
+				t.Fatalf("expected peers %v, got %v", test.want, res.Peers)
+			}
+			for i, p := range res.Peers {
+				if p.String() != test.want[i] || p.ID != test.ids[i] {
+					t.Errorf("expected peer %s with id %q, got %s with id %q", test.want[i], test.ids[i], p, p.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractResponsePeersLookups(t *testing.T) {
+	defer func(lookup func(context.Context, string, string) ([]net.IP, error)) {
+		lookupIP = lookup
+	}(lookupIP)
+
+	// every lookup waits for the others to start, which only happens when they
+	// run concurrently
+	var started sync.WaitGroup
+	started.Add(maxLookups)
+	lookupIP = func(ctx context.Context, _, host string) ([]net.IP, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected the lookup of %s to have a deadline", host)
+		}
+		started.Done()
+		started.Wait()
+
+		return []net.IP{net.IPv4(10, 0, 0, 1)}, nil
+	}
+
+	peers := "l"
+	for i := range maxLookups + 1 {
+		peers += "d2:ip" + bstr(fmt.Sprintf("peer%d.example.com", i)) + "4:porti6881ee"
+	}
+	data := []byte("d5:peers" + peers + "ee")
+
+	done := make(chan []peer.Peer, 1)
+	go func() {
+		res, err := extractResponsePeers(context.Background(), data)
+		if err != nil {
+			t.Errorf("expected error to be nil, got %v", err)
+		}
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		if len(res) != maxLookups {
+			t.Errorf("expected the host names beyond %d to be skipped, got %d peers", maxLookups, len(res))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the host names to be resolved concurrently")
+	}
+}
+
+func TestNewFromInfo(t *testing.T) {
+	info := "d6:lengthi20e4:name" + bstr("file.txt") + "12:piece lengthi16e6:pieces" + bstr(strings.Repeat("x", 40)) + "7:privatei1ee"
+	trackers := [][]string{{"udp://a.example.com:80"}, {"udp://b.example.com:80"}}
+
+	m, err := NewFromInfo([]byte(info), trackers)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if m.InfoHash != sha1.Sum([]byte(info)) {
+		t.Errorf("expected info hash to be the hash of the info dictionary, got %x", m.InfoHash)
+	}
+
+	if m.Announce != "udp://a.example.com:80" || !reflect.DeepEqual(m.Trackers, trackers) {
+		t.Errorf("unexpected trackers %q %v", m.Announce, m.Trackers)
+	}
+
+	if m.Size != 20 || len(m.Pieces) != 2 {
+		t.Errorf("expected 20 bytes in 2 pieces, got %d bytes in %d pieces", m.Size, len(m.Pieces))
+	}
+}
@@ -0,0 +1,209 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// errScrapeUnsupported is returned for HTTP trackers whose announce url does not
+// follow the scrape convention.
+var errScrapeUnsupported = errors.New("tracker does not support scraping")
+
+// SwarmStats is the health of the swarm of a torrent as reported by a tracker
+// scrape (BEP 48). Seeders is the number of peers with the complete torrent
+// ("complete"), Leechers the number of peers still downloading it
+// ("incomplete") and Completed the number of times it was downloaded in full
+// ("downloaded").
+type SwarmStats struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// TrackerScrape is the result of scraping a single tracker of a torrent.
+type TrackerScrape struct {
+	Tracker string
+	Stats   SwarmStats
+	Err     error
+}
+
+// Scrape asks every tracker of the torrent for the health of its swarm. The
+// trackers are scraped concurrently and their results returned in the order
+// they are listed, along with the error of the ones that failed. Cancelling
+// ctx aborts the pending scrapes.
+func (m *Metadata) Scrape(ctx context.Context) ([]TrackerScrape, error) {
+	trackers := m.Trackers
+	if len(trackers) == 0 && m.Announce != "" {
+		trackers = [][]string{{m.Announce}}
+	}
+
+	var results []TrackerScrape
+	for _, tier := range trackers {
+		for _, tracker := range tier {
+			results = append(results, TrackerScrape{Tracker: tracker})
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("torrent does not list any trackers")
+	}
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(r *TrackerScrape) {
+			defer wg.Done()
+
+			stats, err := ScrapeTracker(ctx, r.Tracker, [][20]byte{m.InfoHash})
+			if err != nil {
+				r.Err = err
+				return
+			}
+			r.Stats = stats[m.InfoHash]
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// ScrapeTracker asks the tracker at the given url for the health of the swarms
+// of the torrents identified by infoHashes. Torrents the tracker does not know
+// are left out of the result.
+func ScrapeTracker(ctx context.Context, tracker string, infoHashes [][20]byte) (map[[20]byte]SwarmStats, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse announce url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTPTracker(ctx, u, infoHashes)
+	case "udp":
+		return scrapeUDPTracker(ctx, u, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+// scrapeURL derives the scrape url of an HTTP tracker from its announce url, by
+// replacing the "announce" the last path segment starts with by "scrape". The
+// trackers whose announce url does not follow this convention do not support
+// scraping.
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(announce.Path, "/")
+	last := announce.Path[i+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return nil, errScrapeUnsupported
+	}
+
+	u := *announce
+	u.Path = announce.Path[:i+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	u.RawPath = ""
+
+	return &u, nil
+}
+
+func scrapeHTTPTracker(ctx context.Context, announce *url.URL, infoHashes [][20]byte) (map[[20]byte]SwarmStats, error) {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	// the parameters of the announce url, such as the passkey of private
+	// trackers, are kept
+	params := u.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &http.Client{Timeout: timeout}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	// The files of the response are keyed by binary info-hashes, which the
+	// struct decoding of bencode-go does not support.
+	decoded, err := bencode.Decode(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode scrape response: %w", err)
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected scrape response to be a dictionary")
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("failed to scrape tracker due to: %s", reason)
+	}
+
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected scrape response to list files")
+	}
+
+	stats := make(map[[20]byte]SwarmStats, len(files))
+	for key, value := range files {
+		file, ok := value.(map[string]interface{})
+		if !ok || len(key) != 20 {
+			continue
+		}
+
+		stats[[20]byte([]byte(key))] = SwarmStats{
+			Seeders:   intValue(file, "complete"),
+			Completed: intValue(file, "downloaded"),
+			Leechers:  intValue(file, "incomplete"),
+		}
+	}
+
+	return stats, nil
+}
+
+// intValue returns the integer stored under key in a decoded dictionary, or 0
+// if there is none.
+func intValue(dict map[string]interface{}, key string) int {
+	v, _ := dict[key].(int64)
+
+	return int(v)
+}
+
+func scrapeUDPTracker(ctx context.Context, u *url.URL, infoHashes [][20]byte) (map[[20]byte]SwarmStats, error) {
+	t, err := dialUDPTracker(ctx, u.Host, udpAnnounceRetransmits)
+	if err != nil {
+		return nil, err
+	}
+	defer func(t *udpTracker) {
+		_ = t.close()
+	}(t)
+
+	entries, err := t.scrape(ctx, infoHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[[20]byte]SwarmStats, len(entries))
+	for i, infoHash := range infoHashes {
+		stats[infoHash] = entries[i]
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]struct {
+		announce string
+		want     string
+		err      error
+	}{
+		"should replace announce by scrape": {
+			announce: "http://example.com/announce",
+			want:     "http://example.com/scrape",
+		},
+		"should keep the suffix of the last segment": {
+			announce: "http://example.com/x/announce.php?passkey=abc",
+			want:     "http://example.com/x/scrape.php?passkey=abc",
+		},
+		"should not support other paths": {
+			announce: "http://example.com/a",
+			err:      errScrapeUnsupported,
+		},
+		"should only look at the last segment": {
+			announce: "http://example.com/announce/x",
+			err:      errScrapeUnsupported,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			u, _ := url.Parse(test.announce)
+			got, err := scrapeURL(u)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error to be %v, got %v", test.err, err)
+			}
+
+			if err == nil && got.String() != test.want {
+				t.Errorf("expected scrape url %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestScrape(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 3)
+
+	infoHash := [20]byte{1, 2, 3}
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query()
+		files := "d20:" + string(infoHash[:]) + "d8:completei5e10:downloadedi50e10:incompletei10eee"
+		_, _ = w.Write([]byte("d5:files" + files + "e"))
+	}))
+	defer srv.Close()
+
+	udp := startFakeUDPTracker(t, &fakeUDPTracker{
+		scrape: []SwarmStats{{Seeders: 3, Completed: 4, Leechers: 7}},
+	})
+
+	m := Metadata{
+		InfoHash: infoHash,
+		Trackers: [][]string{
+			{srv.URL + "/announce?passkey=abc", udp.url()},
+			{srv.URL + "/tracker"},
+		},
+	}
+
+	results, err := m.Scrape(context.Background())
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("expected a result for every tracker, got %+v", results)
+	}
+
+	want := []SwarmStats{{Seeders: 5, Completed: 50, Leechers: 10}, {Seeders: 3, Completed: 4, Leechers: 7}}
+	for i, stats := range want {
+		if results[i].Err != nil || results[i].Stats != stats {
+			t.Errorf("expected tracker %s to report %+v, got %+v", results[i].Tracker, stats, results[i])
+		}
+	}
+
+	if !errors.Is(results[2].Err, errScrapeUnsupported) {
+		t.Errorf("expected scraping %s to be unsupported, got %v", results[2].Tracker, results[2].Err)
+	}
+
+	if query.Get("info_hash") != string(infoHash[:]) || query.Get("passkey") != "abc" {
+		t.Errorf("expected the info-hash and the passkey to be sent, got %v", query)
+	}
+}
+
+func TestScrapeWithoutTrackers(t *testing.T) {
+	m := Metadata{}
+	_, err := m.Scrape(context.Background())
+	if err == nil {
+		t.Errorf("expected an error for a torrent without trackers")
+	}
+}
@@ -0,0 +1,324 @@
+package metadata
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol as described in BEP 15.
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+
+	// A connection ID can be used by the client for up to one minute after it
+	// was received.
+	connectionIDLifetime = time.Minute
+
+	maxUDPPacketSize = 65507
+)
+
+var (
+	// udpTimeout is the base of the retransmission timeout. A request that
+	// gets no response after udpTimeout * 2^n is sent again, with n starting at
+	// 0 and increasing up to the retransmission limit of the tracker.
+	udpTimeout = 15 * time.Second
+
+	// udpAnnounceRetransmits caps the announce a download waits on before
+	// starting, so that a dead tracker does not block the fallback to the next
+	// one in its tier, and the scrapes a user waits on. The background
+	// announces get a few more retransmissions, but far fewer than the 8 of
+	// the spec, which would hold up the next announce for hours.
+	udpAnnounceRetransmits   = 1
+	udpBackgroundRetransmits = 2
+)
+
+type connectionID struct {
+	id         uint64
+	receivedAt time.Time
+}
+
+// connectionIDs caches the connection IDs handed out by UDP trackers keyed by
+// the tracker address, so that consecutive requests within a minute can skip
+// the connect round trip.
+var connectionIDs = struct {
+	sync.Mutex
+	ids map[string]connectionID
+}{ids: make(map[string]connectionID)}
+
+type udpTracker struct {
+	conn net.Conn
+	addr string
+
+	// retransmits is the number of times a request is sent again before
+	// giving up on the tracker.
+	retransmits int
+}
+
+func (m *Metadata) syncWithUDPTracker(ctx context.Context, u *url.URL, peerID [20]byte, port uint16, p Progress) (*Response, error) {
+	t, err := dialUDPTracker(ctx, u.Host, announceRetransmits(p.Event))
+	if err != nil {
+		return nil, err
+	}
+	defer func(t *udpTracker) {
+		_ = t.close()
+	}(t)
+
+	p.Left = m.left(p)
+
+	return t.announce(ctx, m.InfoHash, peerID, port, p)
+}
+
+// announceRetransmits returns the retransmission limit of an announce. The
+// started and stopped announces hold up the start and the shutdown of the
+// download, the others run in the background and get a few more attempts.
+func announceRetransmits(event Event) int {
+	if event == EventStarted || event == EventStopped {
+		return udpAnnounceRetransmits
+	}
+
+	return udpBackgroundRetransmits
+}
+
+func dialUDPTracker(ctx context.Context, addr string, retransmits int) (*udpTracker, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to udp tracker %s: %w", addr, err)
+	}
+
+	return &udpTracker{conn: conn, addr: addr, retransmits: retransmits}, nil
+}
+
+func (t *udpTracker) close() error {
+	return t.conn.Close()
+}
+
+// connectionID returns a valid connection ID for the tracker, reusing a cached
+// one if it has not expired yet. A new one is requested with a single
+// transmission as the n-th attempt, retransmitting is left to the caller.
+func (t *udpTracker) connectionID(n int) (uint64, error) {
+	connectionIDs.Lock()
+	cached, ok := connectionIDs.ids[t.addr]
+	connectionIDs.Unlock()
+
+	if ok && time.Since(cached.receivedAt) < connectionIDLifetime {
+		return cached.id, nil
+	}
+
+	res, err := t.transmit(n, actionConnect, func(txID uint32) []byte {
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(req[8:12], actionConnect)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+
+		return req
+	}, 16)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to udp tracker %s: %w", t.addr, err)
+	}
+
+	id := binary.BigEndian.Uint64(res[8:16])
+
+	connectionIDs.Lock()
+	connectionIDs.ids[t.addr] = connectionID{id: id, receivedAt: time.Now()}
+	connectionIDs.Unlock()
+
+	return id, nil
+}
+
+// announce informs the tracker about the client and the progress of its
+// download, and fetches the list of peers sharing the torrent identified by
+// infoHash.
+func (t *udpTracker) announce(ctx context.Context, infoHash, peerID [20]byte, port uint16, p Progress) (*Response, error) {
+	key, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.roundTripWithConnection(ctx, actionAnnounce, func(connID uint64, txID uint32) []byte {
+		req := make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], actionAnnounce)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		copy(req[16:36], infoHash[:])
+		copy(req[36:56], peerID[:])
+		binary.BigEndian.PutUint64(req[56:64], uint64(p.Downloaded))
+		binary.BigEndian.PutUint64(req[64:72], uint64(p.Left))
+		binary.BigEndian.PutUint64(req[72:80], uint64(p.Uploaded))
+		binary.BigEndian.PutUint32(req[80:84], uint32(p.Event))
+		binary.BigEndian.PutUint32(req[84:88], 0) // ip: default
+		binary.BigEndian.PutUint32(req[88:92], key)
+		binary.BigEndian.PutUint32(req[92:96], 0xFFFFFFFF) // num_want: default
+		binary.BigEndian.PutUint16(req[96:98], port)
+
+		return req
+	}, 20)
+	if err != nil {
+		return nil, fmt.Errorf("failed to announce to udp tracker %s: %w", t.addr, err)
+	}
+
+	// trackers reached over IPv6 respond with IPv6 peers (BEP 15)
+	ipLen := net.IPv4len
+	if addr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+
+	peers, err := extractPeers(res[20:], ipLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		Peers:           peers,
+		RefreshInterval: int(binary.BigEndian.Uint32(res[8:12])),
+	}, nil
+}
+
+// scrape fetches the swarm statistics for every info-hash in infoHashes.
+func (t *udpTracker) scrape(ctx context.Context, infoHashes [][20]byte) ([]SwarmStats, error) {
+	res, err := t.roundTripWithConnection(ctx, actionScrape, func(connID uint64, txID uint32) []byte {
+		req := make([]byte, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], actionScrape)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		for i, infoHash := range infoHashes {
+			copy(req[16+20*i:], infoHash[:])
+		}
+
+		return req
+	}, 8+12*len(infoHashes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape udp tracker %s: %w", t.addr, err)
+	}
+
+	entries := make([]SwarmStats, len(infoHashes))
+	for i := range entries {
+		offset := 8 + 12*i
+		entries[i] = SwarmStats{
+			Seeders:   int(binary.BigEndian.Uint32(res[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(res[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(res[offset+8 : offset+12])),
+		}
+	}
+
+	return entries, nil
+}
+
+// roundTripWithConnection is like roundTrip but fetches a connection ID before
+// every transmission, so that retransmissions do not reuse an expired one. The
+// connect request is part of the attempt, so that it shares the retransmission
+// limit of the request instead of running its own. Cancelling ctx closes the
+// connection to the tracker, aborting the request.
+func (t *udpTracker) roundTripWithConnection(ctx context.Context, action uint32, build func(connID uint64, txID uint32) []byte, minLen int) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = t.conn.Close()
+	})
+	defer stop()
+
+	for n := 0; n <= t.retransmits; n++ {
+		connID, err := t.connectionID(n)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		res, err := t.transmit(n, action, func(txID uint32) []byte {
+			return build(connID, txID)
+		}, minLen)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			return res, nil
+		}
+
+		if !isTimeout(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no response after %d retransmissions", t.retransmits)
+}
+
+// transmit sends the request produced by build once, as the n-th attempt, and
+// waits udpTimeout * 2^n for the matching response.
+func (t *udpTracker) transmit(n int, action uint32, build func(txID uint32) []byte, minLen int) ([]byte, error) {
+	txID, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.conn.Write(build(txID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	_ = t.conn.SetReadDeadline(time.Now().Add(udpTimeout * (1 << n)))
+
+	return t.readResponse(make([]byte, maxUDPPacketSize), action, txID, minLen)
+}
+
+// isTimeout reports whether err is a read timeout, after which the request is
+// sent again.
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// readResponse reads packets until one matching txID arrives. Packets carrying
+// other transaction IDs are stale responses to earlier transmissions and are
+// discarded.
+func (t *udpTracker) readResponse(buf []byte, action, txID uint32, minLen int) ([]byte, error) {
+	for {
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue
+		}
+
+		res := buf[:n]
+		switch binary.BigEndian.Uint32(res[0:4]) {
+		case action:
+			if n < minLen {
+				return nil, fmt.Errorf("expected response of at-least %d bytes, got %d", minLen, n)
+			}
+
+			return res, nil
+		case actionError:
+			return nil, fmt.Errorf("tracker responded with error: %s", res[8:])
+		default:
+			return nil, fmt.Errorf("expected action %d, got %d", action, binary.BigEndian.Uint32(res[0:4]))
+		}
+	}
+}
+
+func randomUint32() (uint32, error) {
+	var buf [4]byte
+
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random number: %w", err)
+	}
+
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
@@ -0,0 +1,318 @@
+package metadata
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker is an in-process stand-in for a BEP 15 tracker.
+type fakeUDPTracker struct {
+	conn   net.PacketConn
+	listen string // address to listen on, 127.0.0.1:0 when empty
+
+	mu       sync.Mutex
+	packets  int
+	connects int
+	drop     int    // number of incoming packets to ignore
+	failWith string // respond to announces with an error action
+	peers    []byte
+	scrape   []SwarmStats
+
+	// announced is the progress reported by the last announce.
+	announced Progress
+}
+
+func startFakeUDPTracker(t *testing.T, f *fakeUDPTracker) *fakeUDPTracker {
+	if f.listen == "" {
+		f.listen = "127.0.0.1:0"
+	}
+
+	conn, err := net.ListenPacket("udp", f.listen)
+	if err != nil {
+		t.Fatalf("failed to start fake tracker: %v", err)
+	}
+
+	f.conn = conn
+	go f.serve()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return f
+}
+
+func (f *fakeUDPTracker) url() string {
+	return "udp://" + f.conn.LocalAddr().String()
+}
+
+func (f *fakeUDPTracker) serve() {
+	const connID = 0x1122334455667788
+	buf := make([]byte, 2048)
+
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+
+		f.mu.Lock()
+		f.packets++
+		if f.drop > 0 {
+			f.drop--
+			f.mu.Unlock()
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(req[8:12])
+		txID := req[12:16]
+		res := make([]byte, 8)
+		binary.BigEndian.PutUint32(res[0:4], action)
+		copy(res[4:8], txID)
+
+		switch {
+		case action == actionConnect:
+			f.connects++
+			res = binary.BigEndian.AppendUint64(res, connID)
+		case binary.BigEndian.Uint64(req[0:8]) != connID:
+			binary.BigEndian.PutUint32(res[0:4], actionError)
+			res = append(res, "bad connection id"...)
+		case f.failWith != "":
+			binary.BigEndian.PutUint32(res[0:4], actionError)
+			res = append(res, f.failWith...)
+		case action == actionAnnounce:
+			f.announced = Progress{
+				Downloaded: int64(binary.BigEndian.Uint64(req[56:64])),
+				Left:       int64(binary.BigEndian.Uint64(req[64:72])),
+				Uploaded:   int64(binary.BigEndian.Uint64(req[72:80])),
+				Event:      Event(binary.BigEndian.Uint32(req[80:84])),
+			}
+			res = binary.BigEndian.AppendUint32(res, 1800) // interval
+			res = binary.BigEndian.AppendUint32(res, 3)    // leechers
+			res = binary.BigEndian.AppendUint32(res, 7)    // seeders
+			res = append(res, f.peers...)
+		case action == actionScrape:
+			for _, e := range f.scrape {
+				res = binary.BigEndian.AppendUint32(res, uint32(e.Seeders))
+				res = binary.BigEndian.AppendUint32(res, uint32(e.Completed))
+				res = binary.BigEndian.AppendUint32(res, uint32(e.Leechers))
+			}
+		}
+		f.mu.Unlock()
+
+		_, _ = f.conn.WriteTo(res, addr)
+	}
+}
+
+func withUDPTimeout(t *testing.T, d time.Duration, retransmits int) {
+	timeout, announceRetransmits := udpTimeout, udpAnnounceRetransmits
+	udpTimeout, udpAnnounceRetransmits = d, retransmits
+	t.Cleanup(func() {
+		udpTimeout, udpAnnounceRetransmits = timeout, announceRetransmits
+	})
+}
+
+func TestSyncWithUDPTracker(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 3)
+
+	tracker := startFakeUDPTracker(t, &fakeUDPTracker{
+		peers: []byte{10, 0, 0, 1, 0x1A, 0xE1, 192, 168, 1, 2, 0x1A, 0xE2},
+	})
+
+	m := Metadata{Announce: tracker.url(), Size: 1024}
+	for i := 0; i < 2; i++ {
+		res, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted})
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+
+		if res.RefreshInterval != 1800 {
+			t.Errorf("expected refresh interval to be 1800, got %d", res.RefreshInterval)
+		}
+
+		if len(res.Peers) != 2 || res.Peers[0].String() != "10.0.0.1:6881" || res.Peers[1].String() != "192.168.1.2:6882" {
+			t.Errorf("unexpected peers %v", res.Peers)
+		}
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.connects != 1 {
+		t.Errorf("expected connection id to be cached, got %d connect requests", tracker.connects)
+	}
+}
+
+func TestSyncWithUDPTrackerIPv6(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 3)
+
+	tracker := &fakeUDPTracker{
+		listen: "[::1]:0",
+		peers:  append(net.ParseIP("2001:db8::1"), 0x1A, 0xE1),
+	}
+	conn, err := net.ListenPacket("udp", tracker.listen)
+	if err != nil {
+		t.Skipf("ipv6 is not available: %v", err)
+	}
+	_ = conn.Close()
+	startFakeUDPTracker(t, tracker)
+
+	m := Metadata{Announce: tracker.url(), Size: 1024}
+	res, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if len(res.Peers) != 1 || res.Peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("expected an ipv6 peer, got %v", res.Peers)
+	}
+}
+
+func TestSyncWithUDPTrackerProgress(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 3)
+
+	tracker := startFakeUDPTracker(t, &fakeUDPTracker{})
+
+	m := Metadata{Announce: tracker.url(), Size: 1024, Pieces: make([][20]byte, 1)}
+	want := Progress{Event: EventCompleted, Uploaded: 300, Downloaded: 1000, Left: 24}
+	_, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, want)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if !reflect.DeepEqual(tracker.announced, want) {
+		t.Errorf("expected the announce to report %+v, got %+v", want, tracker.announced)
+	}
+}
+
+func TestSyncWithUDPTrackerBackgroundRetransmits(t *testing.T) {
+	withUDPTimeout(t, 10*time.Millisecond, 0)
+	retransmits := udpBackgroundRetransmits
+	udpBackgroundRetransmits = 3
+	t.Cleanup(func() {
+		udpBackgroundRetransmits = retransmits
+	})
+
+	tests := map[string]struct {
+		event Event
+		fails bool
+	}{
+		"should give up on a started announce after a single attempt": {event: EventStarted, fails: true},
+		"should give up on a stopped announce after a single attempt": {event: EventStopped, fails: true},
+		"should retransmit a regular announce a few times":            {event: EventNone},
+		"should retransmit a completed announce a few times":          {event: EventCompleted},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tracker := startFakeUDPTracker(t, &fakeUDPTracker{drop: 2})
+
+			m := Metadata{Announce: tracker.url()}
+			_, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: test.event})
+			if test.fails && err == nil {
+				t.Errorf("expected the announce to fail")
+			}
+			if !test.fails && err != nil {
+				t.Errorf("expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSyncWithUDPTrackerRetransmits(t *testing.T) {
+	withUDPTimeout(t, 20*time.Millisecond, 3)
+
+	tracker := startFakeUDPTracker(t, &fakeUDPTracker{drop: 2})
+
+	m := Metadata{Announce: tracker.url()}
+	_, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted})
+	if err != nil {
+		t.Fatalf("expected error to be nil after retransmitting, got %v", err)
+	}
+}
+
+func TestSyncWithUDPTrackerGivesUp(t *testing.T) {
+	withUDPTimeout(t, 10*time.Millisecond, 2)
+
+	tracker := startFakeUDPTracker(t, &fakeUDPTracker{drop: 100})
+
+	m := Metadata{Announce: tracker.url()}
+	_, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted})
+	if err == nil || !strings.Contains(err.Error(), "no response after 2 retransmissions") {
+		t.Errorf("expected retransmissions to be exhausted, got %v", err)
+	}
+
+	// every attempt sends a single connect request, the connect is not
+	// retransmitted on its own
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.packets != 3 {
+		t.Errorf("expected 3 connect requests, got %d", tracker.packets)
+	}
+}
+
+func TestSyncWithUDPTrackerAborts(t *testing.T) {
+	withUDPTimeout(t, time.Minute, 2)
+
+	tracker := startFakeUDPTracker(t, &fakeUDPTracker{drop: 100})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	m := Metadata{Announce: tracker.url()}
+	_, err := m.SyncWithTracker(ctx, [20]byte{1}, 6881, Progress{Event: EventStarted})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the announce to be aborted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the announce to be aborted right away, took %s", elapsed)
+	}
+}
+
+func TestSyncWithUDPTrackerError(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 3)
+
+	tracker := startFakeUDPTracker(t, &fakeUDPTracker{failWith: "torrent not registered"})
+
+	m := Metadata{Announce: tracker.url()}
+	_, err := m.SyncWithTracker(context.Background(), [20]byte{1}, 6881, Progress{Event: EventStarted})
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Errorf("expected tracker error to be reported, got %v", err)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	withUDPTimeout(t, 50*time.Millisecond, 3)
+
+	tracker := startFakeUDPTracker(t, &fakeUDPTracker{
+		scrape: []SwarmStats{{Seeders: 5, Completed: 40, Leechers: 2}, {Seeders: 0, Completed: 1, Leechers: 9}},
+	})
+
+	ut, err := dialUDPTracker(context.Background(), strings.TrimPrefix(tracker.url(), "udp://"), udpAnnounceRetransmits)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(ut *udpTracker) {
+		_ = ut.close()
+	}(ut)
+
+	got, err := ut.scrape(context.Background(), [][20]byte{{1}, {2}})
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	for i, want := range tracker.scrape {
+		if got[i] != want {
+			t.Errorf("expected scrape entry %d to be %+v, got %+v", i, want, got[i])
+		}
+	}
+}
@@ -2,8 +2,10 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/xanish/torrenty/internal/handshake"
@@ -12,22 +14,91 @@ import (
 	"github.com/xanish/torrenty/internal/utility"
 )
 
+// BlockRequest identifies a block of length bytes starting at begin within
+// the piece at index.
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
 type Connection struct {
-	Conn         net.Conn
-	Peer         Peer
+	Conn net.Conn
+	Peer Peer
+
+	// PeerID is the peer id the remote peer sent in its handshake.
+	PeerID [20]byte
+
 	Bitfield     []byte
 	AmChoked     bool
 	AmInterested bool
+
+	// PeerChoked and PeerInterested track the state of the remote peer, that
+	// is whether we are choking it and whether it is interested in our pieces.
+	PeerChoked     bool
+	PeerInterested bool
+
+	// peerRequests holds the block requests received from the remote peer
+	// that have not been served or cancelled yet. They are served from another
+	// goroutine than the one reading messages, and requested is signalled
+	// whenever a request is queued.
+	requestsMu   sync.Mutex
+	peerRequests []BlockRequest
+	requested    chan struct{}
+
+	// Extensions holds the extensions we support on this connection, and
+	// RemoteExtensions the extended handshake received from the remote peer.
+	// RemoteExtensions is nil until the remote peer sends its handshake. It is
+	// updated by the goroutine reading messages, under extMu, so that other
+	// goroutines may send extended messages.
+	Extensions       *Extensions
+	RemoteExtensions *ExtendedHandshake
+	extMu            sync.Mutex
+
+	// Inbound is set when the remote peer connected to us, in which case Peer
+	// holds the address it connected from rather than the one it listens on.
+	Inbound bool
+
+	// remoteDHT is set when the remote peer advertised a DHT node in its
+	// handshake, and DHTPort is the UDP port of that node once the peer sent
+	// it with a Port message.
+	remoteDHT bool
+	DHTPort   uint16
 }
 
 // newConnection tries to set up a connection to the remote peer via handshake.
-func newConnection(peer Peer, infoHash, peerID [20]byte) (*Connection, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 15*time.Second)
+// Cancelling ctx aborts the attempt and closes the connection.
+func newConnection(ctx context.Context, peer Peer, infoHash, peerID [20]byte, ext *Extensions) (*Connection, error) {
+	dialer := net.Dialer{Timeout: 15 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String())
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to %s: %w", peer.String(), err)
 	}
 
-	_, err = exchangeHandshake(conn, infoHash, peerID)
+	// Closing the connection unblocks the handshake below when ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	c, err := setupConnection(conn, peer, infoHash, peerID, ext)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("connecting to %s aborted: %w", peer.String(), ctx.Err())
+		}
+		return nil, err
+	}
+
+	if !stop() {
+		return nil, fmt.Errorf("connecting to %s aborted: %w", peer.String(), ctx.Err())
+	}
+
+	return c, nil
+}
+
+// setupConnection exchanges the handshakes with the remote peer over conn.
+func setupConnection(conn net.Conn, peer Peer, infoHash, peerID [20]byte, ext *Extensions) (*Connection, error) {
+	res, err := exchangeHandshake(conn, infoHash, peerID, peer.ID, ext.dht())
 	if err != nil {
 		// We won't want to defer the connection close since this connection
 		// object will be used for fetching pieces. So only close on errors.
@@ -35,35 +106,54 @@ func newConnection(peer Peer, infoHash, peerID [20]byte) (*Connection, error) {
 		return nil, err
 	}
 
+	c := &Connection{
+		Conn:         conn,
+		Peer:         peer,
+		PeerID:       res.PeerID,
+		AmChoked:     true,
+		AmInterested: false,
+		PeerChoked:   true,
+		Extensions:   ext,
+		remoteDHT:    res.SupportsDHT(),
+	}
+
+	// The extended handshake is sent right after the BitTorrent handshake to
+	// peers that advertise support for the extension protocol.
+	if ext != nil && res.SupportsExtensions() {
+		err = c.sendExtendedHandshake()
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
 	// Once we successfully establish a new connection and exchange a handshake,
 	// we immediately receive a Bitfield message from the remote peer. It is
 	// optional, and may not be received if the peer has no pieces.
-	bitfield, err := readBitfield(conn)
+	err = c.readBitfield()
 	if err != nil {
 		// Only close on errors.
 		_ = conn.Close()
 		return nil, err
 	}
 
-	return &Connection{
-		conn,
-		peer,
-		bitfield,
-		true,
-		false,
-	}, nil
+	return c, nil
 }
 
 // exchangeHandshake initiates handshake to identify itself to the peer and
 // inform them about the protocol this client follows and the file it is
-// interested in.
-func exchangeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake, error) {
+// interested in. The peer must respond with remoteID, unless it is zero. When
+// dht is set the handshake advertises our DHT node.
+func exchangeHandshake(conn net.Conn, infoHash, peerID, remoteID [20]byte, dht bool) (*handshake.Handshake, error) {
 	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer func(conn net.Conn, t time.Time) {
 		_ = conn.SetDeadline(t)
 	}(conn, time.Time{}) // Disable the deadline
 
 	req := handshake.New(infoHash, peerID)
+	if dht {
+		req.SetDHT()
+	}
 	marshaled, err := req.Marshal()
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal handshake request: %w", err)
@@ -83,47 +173,74 @@ func exchangeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 		return nil, fmt.Errorf("expected infohash to be %x, but got %x", infoHash, res.InfoHash)
 	}
 
-	// Ideally we should verify the peerID received in response with the peerID
-	// present in non-compacted response of tracker and drop the connection if
-	// they do not match
+	// The peer id is only known from the non-compact responses of trackers,
+	// a peer answering with another one is not the peer we meant to reach.
+	if remoteID != [20]byte{} && res.PeerID != remoteID {
+		return nil, fmt.Errorf("expected peer id to be %x, but got %x", remoteID, res.PeerID)
+	}
 
 	return res, nil
 }
 
-// readBitfield extracts Bitfield from the message payload.
-func readBitfield(conn net.Conn) ([]byte, error) {
-	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+// readBitfield extracts Bitfield from the message payload. Peers may send
+// their extended handshake or the port of their DHT node before the Bitfield,
+// in which case they are processed while waiting for the Bitfield.
+func (c *Connection) readBitfield() error {
+	_ = c.Conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer func(conn net.Conn, t time.Time) {
 		_ = conn.SetDeadline(t)
-	}(conn, time.Time{}) // Disable the deadline
+	}(c.Conn, time.Time{}) // Disable the deadline
 
-	msg, err := message.Unmarshal(conn)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		msg, err := message.Unmarshal(c.Conn)
+		if err != nil {
+			return err
+		}
 
-	if msg == nil {
-		return nil, fmt.Errorf("expected message<bitfield> but got %s", msg)
-	}
+		if msg != nil && msg.ID == message.Extended {
+			err = c.handleExtended(msg)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 
-	if msg.ID != message.Bitfield {
-		return nil, fmt.Errorf("expected message<bitfield> but got %s", msg.ID)
-	}
+		if msg != nil && msg.ID == message.Port {
+			err = c.handlePort(msg)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if msg == nil {
+			return fmt.Errorf("expected message<bitfield> but got %s", msg)
+		}
 
-	return msg.Payload, nil
+		if msg.ID != message.Bitfield {
+			return fmt.Errorf("expected message<bitfield> but got %s", msg)
+		}
+
+		c.Bitfield = msg.Payload
+
+		return nil
+	}
 }
 
-// ReadMessage reads the message received from remote Peer.
-func (c *Connection) ReadMessage(index int, buf []byte) error {
+// ReadMessage reads the message received from remote Peer and updates the
+// state of the connection accordingly. The message is returned so that callers
+// can act on it as well, such as storing the block of a Piece message. It is
+// nil for keep-alive messages.
+func (c *Connection) ReadMessage() (*message.Message, error) {
 	msg, err := message.Unmarshal(c.Conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// keep-alive
 	if msg == nil {
 		logger.Log(logger.Debug, "received msg<KeepAlive> from remote peer %s", c.Peer)
-		return nil
+		return nil, nil
 	}
 
 	switch msg.ID {
@@ -135,47 +252,156 @@ func (c *Connection) ReadMessage(index int, buf []byte) error {
 		c.AmChoked = false
 	case message.Interested:
 		logger.Log(logger.Debug, "received msg<Interested> from remote peer %s", c.Peer)
-		c.AmInterested = true
+		c.PeerInterested = true
 	case message.NotInterested:
 		logger.Log(logger.Debug, "received msg<NotInterested> from remote peer %s", c.Peer)
-		c.AmInterested = false
+		c.PeerInterested = false
 	case message.Have:
-		logger.Log(logger.Debug, "received msg<Have, piece:%d> from remote peer %s", index, c.Peer)
 		index, err := message.ParseHave(msg)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		logger.Log(logger.Debug, "received msg<Have, piece:%d> from remote peer %s", index, c.Peer)
 		utility.SetPiece(index, c.Bitfield)
 	case message.Bitfield:
 		logger.Log(logger.Debug, "received msg<Bitfield> = %x from remote peer %s", msg.Payload, c.Peer)
 		c.Bitfield = msg.Payload
 	case message.Request:
 		logger.Log(logger.Debug, "received msg<Request> from remote peer %s", c.Peer)
-		_, _, _, err := message.ParseRequest(msg)
+		index, begin, length, err := message.ParseRequest(msg)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		c.queueRequest(BlockRequest{index, begin, length})
 	case message.Piece:
-		logger.Log(logger.Debug, "received msg<Piece, %d> from remote peer %s", index, c.Peer)
-		_, err := message.ParsePiece(index, buf, msg)
-		if err != nil {
-			return err
-		}
+		// blocks are matched against outstanding requests by the caller
+		logger.Log(logger.Debug, "received msg<Piece> from remote peer %s", c.Peer)
 	case message.Cancel:
 		logger.Log(logger.Debug, "received msg<Cancel> from remote peer %s", c.Peer)
+		index, begin, length, err := message.ParseCancel(msg)
+		if err != nil {
+			return nil, err
+		}
+		c.cancelRequest(BlockRequest{index, begin, length})
 	case message.Port:
-		logger.Log(logger.Debug, "received msg<Port> from remote peer %s", c.Peer)
+		err := c.handlePort(msg)
+		if err != nil {
+			return nil, err
+		}
+	case message.Extended:
+		return msg, c.handleExtended(msg)
 	}
 
+	return msg, nil
+}
+
+// handlePort records the UDP port of the DHT node of the remote Peer carried
+// by a Port message.
+func (c *Connection) handlePort(msg *message.Message) error {
+	port, err := message.ParsePort(msg)
+	if err != nil {
+		return err
+	}
+
+	logger.Log(logger.Debug, "received msg<Port, port:%d> from remote peer %s", port, c.Peer)
+	c.DHTPort = port
+
 	return nil
 }
 
-// SendChoke sends a message to Choke the remote Peer.
+// SupportsDHT reports whether the remote Peer advertised a DHT node in its
+// handshake.
+func (c *Connection) SupportsDHT() bool {
+	return c.remoteDHT
+}
+
+// queueRequest adds a block request of the remote Peer to the pending ones.
+// Requests from a choked peer are dropped, it is expected to request them
+// again once unchoked, and so are requests beyond the number of outstanding
+// requests we advertised.
+func (c *Connection) queueRequest(req BlockRequest) {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	if c.PeerChoked || (c.Extensions != nil && c.Extensions.Reqq > 0 && len(c.peerRequests) >= c.Extensions.Reqq) {
+		logger.Log(logger.Debug, "dropping msg<Request, piece:%d> from remote peer %s", req.Index, c.Peer)
+		return
+	}
+
+	c.peerRequests = append(c.peerRequests, req)
+	select {
+	case c.requestedLocked() <- struct{}{}:
+	default:
+	}
+}
+
+// cancelRequest removes a pending block request of the remote Peer.
+func (c *Connection) cancelRequest(req BlockRequest) {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	for i, pending := range c.peerRequests {
+		if pending == req {
+			c.peerRequests = append(c.peerRequests[:i], c.peerRequests[i+1:]...)
+			return
+		}
+	}
+}
+
+// NextRequest removes and returns the oldest pending block request of the
+// remote Peer. It reports false if there is none.
+func (c *Connection) NextRequest() (BlockRequest, bool) {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	if len(c.peerRequests) == 0 {
+		return BlockRequest{}, false
+	}
+
+	req := c.peerRequests[0]
+	c.peerRequests = c.peerRequests[1:]
+
+	return req, true
+}
+
+// PendingRequests returns the block requests of the remote Peer that have not
+// been served or cancelled yet.
+func (c *Connection) PendingRequests() []BlockRequest {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	return append([]BlockRequest(nil), c.peerRequests...)
+}
+
+// Requested returns a channel that receives a value whenever the remote Peer
+// makes a new block request.
+func (c *Connection) Requested() <-chan struct{} {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	return c.requestedLocked()
+}
+
+func (c *Connection) requestedLocked() chan struct{} {
+	if c.requested == nil {
+		c.requested = make(chan struct{}, 1)
+	}
+
+	return c.requested
+}
+
+// SendChoke sends a message to Choke the remote Peer. Pending requests of the
+// remote Peer are discarded, as it is expected to request them again once
+// unchoked.
 func (c *Connection) SendChoke() error {
 	_, err := c.Conn.Write(message.NewChoke().Marshal())
 	if err != nil {
 		return fmt.Errorf("failed to send choke: %w", err)
 	}
+	c.requestsMu.Lock()
+	c.PeerChoked = true
+	c.peerRequests = nil
+	c.requestsMu.Unlock()
 
 	return nil
 }
@@ -186,6 +412,9 @@ func (c *Connection) SendUnChoke() error {
 	if err != nil {
 		return fmt.Errorf("failed to send unchoke: %w", err)
 	}
+	c.requestsMu.Lock()
+	c.PeerChoked = false
+	c.requestsMu.Unlock()
 
 	return nil
 }
@@ -197,6 +426,7 @@ func (c *Connection) SendInterested() error {
 	if err != nil {
 		return fmt.Errorf("failed to send interested: %w", err)
 	}
+	c.AmInterested = true
 
 	return nil
 }
@@ -208,6 +438,7 @@ func (c *Connection) SendNotInterested() error {
 	if err != nil {
 		return fmt.Errorf("failed to send not interested: %w", err)
 	}
+	c.AmInterested = false
 
 	return nil
 }
@@ -272,7 +503,7 @@ func (c *Connection) SendCancel(index, begin, length int) error {
 func (c *Connection) SendPort(port int) error {
 	_, err := c.Conn.Write(message.NewPort(port).Marshal())
 	if err != nil {
-		return fmt.Errorf("failed to send port for index %d: %w", port, err)
+		return fmt.Errorf("failed to send port %d: %w", port, err)
 	}
 
 	return nil
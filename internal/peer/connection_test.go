@@ -0,0 +1,205 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanish/torrenty/internal/handshake"
+	"github.com/xanish/torrenty/internal/message"
+)
+
+func TestConnectionPeerRequests(t *testing.T) {
+	local, remote := net.Pipe()
+	defer func(local, remote net.Conn) {
+		_ = local.Close()
+		_ = remote.Close()
+	}(local, remote)
+
+	ext := NewExtensions()
+	ext.Reqq = 2
+	c := &Connection{Conn: local, PeerChoked: true, Extensions: ext}
+
+	send := func(msg *message.Message) {
+		go func() {
+			_, _ = remote.Write(msg.Marshal())
+		}()
+
+		_, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	// requests are dropped while the peer is choked
+	send(message.NewRequest(0, 0, 16384))
+	if pending := c.PendingRequests(); len(pending) != 0 {
+		t.Fatalf("expected requests of a choked peer to be dropped, got %v", pending)
+	}
+
+	c.PeerChoked = false
+	send(message.NewRequest(0, 0, 16384))
+	send(message.NewRequest(0, 16384, 16384))
+	send(message.NewRequest(1, 0, 16384))
+	if pending := c.PendingRequests(); len(pending) != 2 {
+		t.Fatalf("expected requests beyond reqq to be dropped, got %v", pending)
+	}
+
+	send(message.NewCancel(0, 0, 16384))
+	want := BlockRequest{Index: 0, Begin: 16384, Length: 16384}
+	if pending := c.PendingRequests(); len(pending) != 1 || pending[0] != want {
+		t.Errorf("expected only %v to be pending, got %v", want, pending)
+	}
+}
+
+func TestConnectionDHTPort(t *testing.T) {
+	local, remote := net.Pipe()
+	defer func(local, remote net.Conn) {
+		_ = local.Close()
+		_ = remote.Close()
+	}(local, remote)
+
+	ext := NewExtensions()
+	ext.DHTPort = 6881
+
+	// the remote peer runs a dht node and sends its port ahead of its
+	// bitfield
+	go func() {
+		hs, err := handshake.Unmarshal(remote)
+		if err != nil || !hs.SupportsDHT() {
+			return
+		}
+
+		// without the extension protocol, which would have the extended
+		// handshake written to the pipe first
+		res := handshake.New(hs.InfoHash, [20]byte{9})
+		res.Reserved = [8]byte{}
+		res.SetDHT()
+		marshaled, _ := res.Marshal()
+		_, _ = remote.Write(marshaled)
+		_, _ = remote.Write(message.NewPort(7000).Marshal())
+		_, _ = remote.Write(message.NewBitfield([]byte{0x80}).Marshal())
+	}()
+
+	c, err := setupConnection(local, Peer{}, [20]byte{1}, [20]byte{2}, ext)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if !c.SupportsDHT() || c.DHTPort != 7000 {
+		t.Errorf("expected the remote dht node on port 7000, got %t %d", c.SupportsDHT(), c.DHTPort)
+	}
+}
+
+func TestConnectAborts(t *testing.T) {
+	// the remote peer accepts the connection but never answers the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func(l net.Listener) {
+		_ = l.Close()
+	}(l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func(conn net.Conn) {
+				_ = conn.Close()
+			}(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	addr := l.Addr().(*net.TCPAddr)
+	start := time.Now()
+	_, err = Peer{IP: addr.IP, Port: uint16(addr.Port)}.Connect(ctx, [20]byte{1}, [20]byte{2}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the handshake to be aborted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected connecting to be aborted right away, took %s", elapsed)
+	}
+}
+
+func TestConnectVerifiesPeerID(t *testing.T) {
+	infoHash := [20]byte{1}
+	remoteID := [20]byte{9}
+
+	// the remote peer answers the handshake with remoteID and its bitfield
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func(l net.Listener) {
+		_ = l.Close()
+	}(l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer func(conn net.Conn) {
+					_ = conn.Close()
+				}(conn)
+
+				_, err := handshake.Unmarshal(conn)
+				if err != nil {
+					return
+				}
+				res := handshake.New(infoHash, remoteID)
+				marshaled, _ := res.Marshal()
+				_, _ = conn.Write(marshaled)
+				bitfield := &message.Message{ID: message.Bitfield, Payload: []byte{0x80}}
+				_, _ = conn.Write(bitfield.Marshal())
+
+				// keep the connection open until the client closes it
+				_, _ = conn.Read(make([]byte, 1))
+			}(conn)
+		}
+	}()
+
+	tests := map[string]struct {
+		id      [20]byte
+		wantErr bool
+	}{
+		"should accept any peer id if unknown": {},
+		"should accept the expected peer id":   {id: remoteID},
+		"should reject an unexpected peer id":  {id: [20]byte{8}, wantErr: true},
+	}
+
+	addr := l.Addr().(*net.TCPAddr)
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := Peer{IP: addr.IP, Port: uint16(addr.Port), ID: test.id}
+			c, err := p.Connect(context.Background(), infoHash, [20]byte{2}, nil)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "expected peer id") {
+					t.Errorf("expected the peer id to be rejected, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+			_ = c.Conn.Close()
+
+			if c.PeerID != remoteID {
+				t.Errorf("expected peer id %x, got %x", remoteID, c.PeerID)
+			}
+		})
+	}
+}
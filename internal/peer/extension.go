@@ -0,0 +1,245 @@
+package peer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/message"
+)
+
+// extendedHandshakeID is the extended message ID reserved for the extended
+// handshake itself.
+const extendedHandshakeID = 0
+
+// ExtendedHandshake is the payload of the extended handshake (BEP 10) sent by
+// both sides after the BitTorrent handshake.
+//
+// M: maps the names of supported extensions to the extended message IDs the
+// sender wants to receive them with. An ID of 0 disables the extension.
+//
+// V: client name and version.
+//
+// P: local TCP listen port of the sender.
+//
+// Reqq: number of outstanding requests the sender accepts without dropping.
+//
+// YourIP: compact address of the receiver as seen by the sender.
+//
+// MetadataSize: size of the info dictionary, used by ut_metadata (BEP 9).
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// ExtensionHandler handles the payload of an extended message received for the
+// extension it was registered for.
+type ExtensionHandler func(c *Connection, payload []byte) error
+
+// Extensions is a registry of extensions supported by the client. Handlers are
+// keyed by extension name and assigned local extended message IDs in the
+// order they are registered.
+//
+// DHTPort is the UDP port of our DHT node, if we run one. It is advertised in
+// the handshake and sent to the peers that run a DHT node as well.
+//
+// Extensions may be registered while connections using the registry are open.
+type Extensions struct {
+	Version      string
+	Port         uint16
+	Reqq         int
+	MetadataSize int
+	DHTPort      uint16
+
+	mu       sync.Mutex
+	names    []string
+	handlers map[string]ExtensionHandler
+}
+
+// NewExtensions returns an empty extension registry.
+func NewExtensions() *Extensions {
+	return &Extensions{handlers: make(map[string]ExtensionHandler)}
+}
+
+// Register plugs in the handler for the extension called name. Registering a
+// name twice replaces the previous handler.
+func (e *Extensions) Register(name string, handler ExtensionHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.handlers[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.handlers[name] = handler
+}
+
+// dht reports whether the handshake advertises our DHT node.
+func (e *Extensions) dht() bool {
+	return e != nil && e.DHTPort != 0
+}
+
+// handler returns the name and handler of the extension with the local
+// extended message ID id.
+func (e *Extensions) handler(id uint8) (string, ExtensionHandler, bool) {
+	if e == nil || id == extendedHandshakeID {
+		return "", nil, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if int(id) > len(e.names) {
+		return "", nil, false
+	}
+
+	name := e.names[id-1]
+
+	return name, e.handlers[name], true
+}
+
+// handshake builds our extended handshake for a peer connected from remote.
+func (e *Extensions) handshake(remote net.Addr) ExtendedHandshake {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	hs := ExtendedHandshake{
+		M:            make(map[string]int, len(e.names)),
+		V:            e.Version,
+		P:            int(e.Port),
+		Reqq:         e.Reqq,
+		MetadataSize: e.MetadataSize,
+	}
+
+	for i, name := range e.names {
+		hs.M[name] = i + 1
+	}
+
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		ip := addr.IP
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		hs.YourIP = string(ip)
+	}
+
+	return hs
+}
+
+// sendExtendedHandshake sends our extended handshake to the remote Peer.
+func (c *Connection) sendExtendedHandshake() error {
+	var payload bytes.Buffer
+	err := bencode.Marshal(&payload, c.Extensions.handshake(c.Conn.RemoteAddr()))
+	if err != nil {
+		return fmt.Errorf("failed to encode extended handshake: %w", err)
+	}
+
+	_, err = c.Conn.Write(message.NewExtended(extendedHandshakeID, payload.Bytes()).Marshal())
+	if err != nil {
+		return fmt.Errorf("failed to send extended handshake: %w", err)
+	}
+
+	return nil
+}
+
+// handleExtended processes an extended message, either updating the extended
+// handshake of the remote Peer or dispatching it to the registered handler.
+func (c *Connection) handleExtended(msg *message.Message) error {
+	id, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if id == extendedHandshakeID {
+		hs := ExtendedHandshake{}
+		err = bencode.Unmarshal(bytes.NewReader(payload), &hs)
+		if err != nil {
+			return fmt.Errorf("failed to decode extended handshake: %w", err)
+		}
+
+		// Subsequent handshakes only update the fields they carry.
+		c.extMu.Lock()
+		defer c.extMu.Unlock()
+		if c.RemoteExtensions == nil {
+			c.RemoteExtensions = &ExtendedHandshake{M: make(map[string]int)}
+		}
+		for name, remoteID := range hs.M {
+			c.RemoteExtensions.M[name] = remoteID
+		}
+		if hs.V != "" {
+			c.RemoteExtensions.V = hs.V
+		}
+		if hs.P != 0 {
+			c.RemoteExtensions.P = hs.P
+		}
+		if hs.Reqq != 0 {
+			c.RemoteExtensions.Reqq = hs.Reqq
+		}
+		if hs.YourIP != "" {
+			c.RemoteExtensions.YourIP = hs.YourIP
+		}
+		if hs.MetadataSize != 0 {
+			c.RemoteExtensions.MetadataSize = hs.MetadataSize
+		}
+
+		return nil
+	}
+
+	name, handler, ok := c.Extensions.handler(id)
+	if !ok {
+		logger.Log(logger.Debug, "received msg<Extended, id:%d> for unknown extension from remote peer %s", id, c.Peer)
+		return nil
+	}
+
+	logger.Log(logger.Debug, "received msg<Extended, %s> from remote peer %s", name, c.Peer)
+
+	return handler(c, payload)
+}
+
+// SupportsExtension reports whether the remote Peer advertised support for the
+// extension called name in its extended handshake.
+func (c *Connection) SupportsExtension(name string) bool {
+	_, ok := c.remoteExtensionID(name)
+
+	return ok
+}
+
+// remoteExtensionID returns the extended message ID the remote Peer assigned
+// to the extension called name.
+func (c *Connection) remoteExtensionID(name string) (uint8, bool) {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+
+	if c.RemoteExtensions == nil {
+		return 0, false
+	}
+
+	remoteID := c.RemoteExtensions.M[name]
+	if remoteID <= 0 || remoteID > 255 {
+		return 0, false
+	}
+
+	return uint8(remoteID), true
+}
+
+// SendExtended sends an extended message for the extension called name, using
+// the extended message ID the remote Peer assigned to it.
+func (c *Connection) SendExtended(name string, payload []byte) error {
+	remoteID, ok := c.remoteExtensionID(name)
+	if !ok {
+		return fmt.Errorf("remote peer does not support extension %s", name)
+	}
+
+	_, err := c.Conn.Write(message.NewExtended(remoteID, payload).Marshal())
+	if err != nil {
+		return fmt.Errorf("failed to send extended message for %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/message"
+)
+
+func TestExtensionsHandshake(t *testing.T) {
+	ext := NewExtensions()
+	ext.Version = "torrenty"
+	ext.Port = 6881
+	ext.Register("ut_metadata", nil)
+	ext.Register("ut_pex", nil)
+	ext.Register("ut_metadata", nil)
+
+	hs := ext.handshake(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+
+	want := map[string]int{"ut_metadata": 1, "ut_pex": 2}
+	if len(hs.M) != len(want) || hs.M["ut_metadata"] != 1 || hs.M["ut_pex"] != 2 {
+		t.Errorf("expected m to be %v, got %v", want, hs.M)
+	}
+
+	if hs.V != "torrenty" || hs.P != 6881 || hs.YourIP != string([]byte{10, 0, 0, 1}) {
+		t.Errorf("unexpected extended handshake %+v", hs)
+	}
+}
+
+func TestConnectionHandleExtended(t *testing.T) {
+	local, remote := net.Pipe()
+	defer func(local, remote net.Conn) {
+		_ = local.Close()
+		_ = remote.Close()
+	}(local, remote)
+
+	var got []byte
+	ext := NewExtensions()
+	ext.Register("ut_pex", func(c *Connection, payload []byte) error {
+		got = payload
+		return nil
+	})
+	c := &Connection{Conn: local, Extensions: ext}
+
+	var hs bytes.Buffer
+	_ = bencode.Marshal(&hs, ExtendedHandshake{M: map[string]int{"ut_pex": 7, "ut_metadata": 3}, Reqq: 500})
+	err := c.handleExtended(message.NewExtended(0, hs.Bytes()))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if !c.SupportsExtension("ut_pex") || c.RemoteExtensions.Reqq != 500 {
+		t.Errorf("expected remote handshake to be recorded, got %+v", c.RemoteExtensions)
+	}
+
+	// a later handshake disabling an extension only updates that extension
+	hs.Reset()
+	_ = bencode.Marshal(&hs, ExtendedHandshake{M: map[string]int{"ut_metadata": 0}})
+	_ = c.handleExtended(message.NewExtended(0, hs.Bytes()))
+	if c.SupportsExtension("ut_metadata") || !c.SupportsExtension("ut_pex") || c.RemoteExtensions.Reqq != 500 {
+		t.Errorf("expected only ut_metadata to be disabled, got %+v", c.RemoteExtensions)
+	}
+
+	err = c.handleExtended(message.NewExtended(1, []byte("payload")))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if string(got) != "payload" {
+		t.Errorf("expected handler to receive the payload, got %q", got)
+	}
+
+	go func() {
+		_ = c.SendExtended("ut_pex", []byte("hello"))
+	}()
+
+	msg, err := message.Unmarshal(remote)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	id, payload, _ := message.ParseExtended(msg)
+	if id != 7 || string(payload) != "hello" {
+		t.Errorf("expected message to use the remote extension id 7, got %d %q", id, payload)
+	}
+}
@@ -0,0 +1,178 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xanish/torrenty/internal/handshake"
+	"github.com/xanish/torrenty/internal/logger"
+)
+
+// AcceptFunc is called with every inbound connection established for a
+// registered torrent. It takes ownership of the connection.
+type AcceptFunc func(c *Connection)
+
+type registration struct {
+	ext    *Extensions
+	accept AcceptFunc
+}
+
+// Listener accepts connections from remote peers on the port announced to
+// trackers, and hands them to the torrent matching the info-hash of their
+// handshake.
+type Listener struct {
+	listener net.Listener
+	peerID   [20]byte
+
+	mu       sync.Mutex
+	torrents map[[20]byte]registration
+}
+
+// Listen starts accepting connections on port, over both IPv4 and IPv6 where
+// the host supports it. Remote peers are sent peerID in the reply to their
+// handshake.
+func Listen(port int, peerID [20]byte) (*Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+
+	l := &Listener{
+		listener: ln,
+		peerID:   peerID,
+		torrents: make(map[[20]byte]registration),
+	}
+	go l.serve()
+
+	return l, nil
+}
+
+// Port returns the port the Listener accepts connections on.
+func (l *Listener) Port() int {
+	return l.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Register makes the Listener accept connections for the torrent identified
+// by infoHash. Established connections are passed to accept, after negotiating
+// the extensions in ext with peers that support the extension protocol.
+func (l *Listener) Register(infoHash [20]byte, ext *Extensions, accept AcceptFunc) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.torrents[infoHash] = registration{ext: ext, accept: accept}
+}
+
+// Unregister stops accepting connections for the torrent identified by
+// infoHash.
+func (l *Listener) Unregister(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, infoHash)
+}
+
+// Close stops accepting connections.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) lookup(infoHash [20]byte) (registration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r, ok := l.torrents[infoHash]
+
+	return r, ok
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log(logger.Warning, "failed to accept connection: %s", err)
+			continue
+		}
+
+		go func() {
+			err := l.handle(conn)
+			if err != nil {
+				logger.Log(logger.Debug, "rejected connection from %s: %s", conn.RemoteAddr(), err)
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// handle performs the receiving side of the handshake on conn and passes the
+// resulting connection to the torrent it belongs to.
+func (l *Listener) handle(conn net.Conn) error {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected remote address %s", conn.RemoteAddr())
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, err := handshake.Unmarshal(conn)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal handshake request: %w", err)
+	}
+
+	if req.Pstr != handshake.Protocol {
+		return fmt.Errorf("unexpected protocol %q", req.Pstr)
+	}
+
+	r, ok := l.lookup(req.InfoHash)
+	if !ok {
+		return fmt.Errorf("no active torrent with infohash %x", req.InfoHash)
+	}
+
+	res := handshake.New(req.InfoHash, l.peerID)
+	if r.ext.dht() {
+		res.SetDHT()
+	}
+	marshaled, err := res.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake response: %w", err)
+	}
+
+	_, err = conn.Write(marshaled)
+	if err != nil {
+		return fmt.Errorf("failed to send handshake response: %w", err)
+	}
+
+	// Unlike outbound connections the remote peer is not required to send its
+	// Bitfield first, so it is picked up by ReadMessage when it arrives.
+	c := &Connection{
+		Conn:         conn,
+		Peer:         Peer{IP: addr.IP, Port: uint16(addr.Port)},
+		Inbound:      true,
+		PeerID:       req.PeerID,
+		AmChoked:     true,
+		AmInterested: false,
+		PeerChoked:   true,
+		Extensions:   r.ext,
+		remoteDHT:    req.SupportsDHT(),
+	}
+
+	if r.ext != nil && req.SupportsExtensions() {
+		err = c.sendExtendedHandshake()
+		if err != nil {
+			return err
+		}
+	}
+
+	_ = conn.SetDeadline(time.Time{}) // Disable the deadline
+
+	logger.Log(logger.Debug, "accepted connection from remote peer %s", c.Peer)
+	r.accept(c)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/xanish/torrenty/internal/handshake"
+	"github.com/xanish/torrenty/internal/message"
+)
+
+func TestListener(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	peerID := [20]byte{4, 5, 6}
+
+	l, err := Listen(0, peerID)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(l *Listener) {
+		_ = l.Close()
+	}(l)
+
+	ext := NewExtensions()
+	ext.Register("ut_pex", nil)
+	accepted := make(chan *Connection, 1)
+	l.Register(infoHash, ext, func(c *Connection) {
+		accepted <- c
+	})
+
+	dial := func(host string, req handshake.Handshake) net.Conn {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(l.Port())))
+		if err != nil {
+			t.Fatalf("failed to connect to listener: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		marshaled, _ := req.Marshal()
+		_, _ = conn.Write(marshaled)
+
+		return conn
+	}
+
+	t.Run("should accept a registered torrent", func(t *testing.T) {
+		conn := dial("127.0.0.1", handshake.New(infoHash, [20]byte{7}))
+		defer func(conn net.Conn) {
+			_ = conn.Close()
+		}(conn)
+
+		res, err := handshake.Unmarshal(conn)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+
+		if res.InfoHash != infoHash || res.PeerID != peerID {
+			t.Errorf("unexpected handshake response %+v", res)
+		}
+
+		msg, err := message.Unmarshal(conn)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil || id != 0 {
+			t.Fatalf("expected an extended handshake, got %s", msg)
+		}
+
+		hs := ExtendedHandshake{}
+		_ = bencode.Unmarshal(bytes.NewReader(payload), &hs)
+		if hs.M["ut_pex"] != 1 {
+			t.Errorf("expected ut_pex to be advertised, got %v", hs.M)
+		}
+
+		select {
+		case c := <-accepted:
+			if !c.Peer.IP.Equal(net.IPv4(127, 0, 0, 1)) || c.PeerID != [20]byte{7} || c.Extensions != ext {
+				t.Errorf("unexpected connection %+v", c)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected connection to be accepted")
+		}
+	})
+
+	t.Run("should accept connections over ipv6", func(t *testing.T) {
+		probe, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skipf("ipv6 is not available: %v", err)
+		}
+		_ = probe.Close()
+
+		conn := dial("::1", handshake.New(infoHash, [20]byte{7}))
+		defer func(conn net.Conn) {
+			_ = conn.Close()
+		}(conn)
+
+		_, err = handshake.Unmarshal(conn)
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+
+		select {
+		case c := <-accepted:
+			if !c.Peer.IsIPv6() || c.Peer.String() != conn.LocalAddr().String() {
+				t.Errorf("expected the ipv6 address of the peer, got %s", c.Peer)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected connection to be accepted")
+		}
+	})
+
+	t.Run("should reject an unknown torrent", func(t *testing.T) {
+		conn := dial("127.0.0.1", handshake.New([20]byte{9}, [20]byte{7}))
+		defer func(conn net.Conn) {
+			_ = conn.Close()
+		}(conn)
+
+		_, err := handshake.Unmarshal(conn)
+		if err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+
+	t.Run("should reject another protocol", func(t *testing.T) {
+		req := handshake.New(infoHash, [20]byte{7})
+		req.Pstr = "BitTorrent protocoL"
+		conn := dial("127.0.0.1", req)
+		defer func(conn net.Conn) {
+			_ = conn.Close()
+		}(conn)
+
+		_, err := handshake.Unmarshal(conn)
+		if err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+}
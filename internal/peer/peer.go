@@ -1,6 +1,10 @@
 package peer
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"net"
 	"strconv"
 )
@@ -8,12 +12,81 @@ import (
 type Peer struct {
 	IP   net.IP
 	Port uint16
+
+	// ID is the peer id advertised for the Peer by a tracker, and is zero if
+	// unknown. The handshake of a Peer with a known ID must carry it.
+	ID [20]byte
 }
 
-func (p Peer) Connect(infoHash, peerID [20]byte) (*Connection, error) {
-	return newConnection(p, infoHash, peerID)
+// Connect sets up a connection to the Peer. When ext is not nil and the Peer
+// supports the extension protocol, the extensions in ext are negotiated via the
+// extended handshake. Cancelling ctx aborts connecting.
+func (p Peer) Connect(ctx context.Context, infoHash, peerID [20]byte, ext *Extensions) (*Connection, error) {
+	return newConnection(ctx, p, infoHash, peerID, ext)
 }
 
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
+
+// IsIPv6 reports whether the Peer is reached over IPv6.
+func (p Peer) IsIPv6() bool {
+	return p.IP.To4() == nil
+}
+
+// GlobalIPv6 returns a global unicast IPv6 address of this host, which peers
+// on the internet may reach us on, or nil if it has none.
+func GlobalIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipNet.IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// Compact returns the compact form of the Peer, its IP address followed by its
+// port in network byte order. IPv4 addresses take 4 bytes and IPv6 ones 16.
+func (p Peer) Compact() []byte {
+	ip := p.IP
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], p.Port)
+
+	return b
+}
+
+// ParseCompact parses a list of peers in compact form, made of ipLen bytes of
+// IP address followed by 2 bytes of port for every peer.
+func ParseCompact(b []byte, ipLen int) ([]Peer, error) {
+	size := ipLen + 2
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("compact peers list of %d bytes is not a multiple of %d", len(b), size)
+	}
+
+	peers := make([]Peer, 0, len(b)/size)
+	for offset := 0; offset < len(b); offset += size {
+		peers = append(peers, Peer{
+			IP:   net.IP(bytes.Clone(b[offset : offset+ipLen])),
+			Port: binary.BigEndian.Uint16(b[offset+ipLen : offset+size]),
+		})
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,171 @@
+package picker
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/xanish/torrenty/internal/utility"
+)
+
+// randomFirstPieces is the number of pieces picked at random before switching
+// to rarest-first, so that a complete piece to trade is obtained quickly.
+const randomFirstPieces = 4
+
+type pieceState uint8
+
+const (
+	missing pieceState = iota
+	inProgress
+	done
+)
+
+// Picker decides which piece to download next from a peer. It tracks how many
+// connected peers have each piece and hands out the rarest piece that the peer
+// has, so that pieces only a few peers have are fetched before they leave the
+// swarm.
+type Picker struct {
+	mu           sync.Mutex
+	availability []int
+	state        []pieceState
+	completed    int
+}
+
+// New returns a Picker for a torrent made of numPieces pieces, none of which
+// have been downloaded.
+func New(numPieces int) *Picker {
+	return &Picker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+	}
+}
+
+// AddBitfield records that a peer has every piece set in bitfield.
+func (p *Picker) AddBitfield(bitfield []byte) {
+	p.updateBitfield(bitfield, 1)
+}
+
+// RemoveBitfield forgets the pieces set in bitfield, when the peer they belong
+// to disconnects or replaces its bitfield.
+func (p *Picker) RemoveBitfield(bitfield []byte) {
+	p.updateBitfield(bitfield, -1)
+}
+
+func (p *Picker) updateBitfield(bitfield []byte, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index := range p.availability {
+		if utility.PieceExists(index, bitfield) {
+			p.availability[index] += delta
+		}
+	}
+}
+
+// AddHave records that a peer announced it has the piece at index.
+func (p *Picker) AddHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Pick returns the rarest missing piece that is set in bitfield and marks it
+// as in progress, ties are broken at random. Until the first few pieces have
+// been downloaded a random piece is returned instead. Pick reports false if
+// the peer has no piece we still need.
+func (p *Picker) Pick(bitfield []byte) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []int
+	rarest := 0
+	for index, state := range p.state {
+		if state != missing || !utility.PieceExists(index, bitfield) {
+			continue
+		}
+
+		if p.completed >= randomFirstPieces {
+			if len(candidates) > 0 && p.availability[index] > rarest {
+				continue
+			}
+			if len(candidates) == 0 || p.availability[index] < rarest {
+				rarest = p.availability[index]
+				candidates = candidates[:0]
+			}
+		}
+		candidates = append(candidates, index)
+	}
+
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	index := candidates[rand.Intn(len(candidates))]
+	p.state[index] = inProgress
+
+	return index, true
+}
+
+// Abort returns a piece handed out by Pick to the pool of missing pieces, when
+// downloading it failed.
+func (p *Picker) Abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.state) && p.state[index] == inProgress {
+		p.state[index] = missing
+	}
+}
+
+// Done marks the piece at index as downloaded and verified, it is never picked
+// again.
+func (p *Picker) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.state) && p.state[index] != done {
+		p.state[index] = done
+		p.completed++
+	}
+}
+
+// Needs reports whether bitfield has a piece that has not been downloaded
+// yet.
+func (p *Picker) Needs(bitfield []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index, state := range p.state {
+		if state != done && utility.PieceExists(index, bitfield) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Missing returns the number of pieces that are neither downloaded nor in
+// progress.
+func (p *Picker) Missing() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	missingPieces := 0
+	for _, state := range p.state {
+		if state == missing {
+			missingPieces++
+		}
+	}
+
+	return missingPieces
+}
+
+// Remaining returns the number of pieces that have not been downloaded yet.
+func (p *Picker) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.state) - p.completed
+}
@@ -0,0 +1,151 @@
+package picker
+
+import (
+	"testing"
+)
+
+func TestPickRarestFirst(t *testing.T) {
+	p := New(8)
+	for i := 0; i < randomFirstPieces; i++ {
+		p.Done(i)
+	}
+
+	// pieces 4..7 are available from three, one, two and one peers
+	p.AddBitfield([]byte{0b00001111})
+	p.AddBitfield([]byte{0b00001010})
+	p.AddBitfield([]byte{0b00001000})
+	p.AddHave(6)
+
+	seen := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		index, ok := p.Pick([]byte{0xff})
+		if !ok {
+			t.Fatalf("expected a piece to be picked")
+		}
+		if index != 5 && index != 7 {
+			t.Fatalf("expected one of the rarest pieces 5 or 7, got %d", index)
+		}
+		seen[index] = true
+		p.Abort(index)
+	}
+
+	if len(seen) != 2 {
+		t.Errorf("expected ties to be broken at random, only got %v", seen)
+	}
+}
+
+func TestPickOnlyPiecesOfPeer(t *testing.T) {
+	p := New(8)
+	for i := 0; i < randomFirstPieces; i++ {
+		p.Done(i)
+	}
+	p.AddBitfield([]byte{0b00001111})
+	p.AddBitfield([]byte{0b00000111})
+
+	index, ok := p.Pick([]byte{0b00001000})
+	if !ok || index != 4 {
+		t.Fatalf("expected piece 4, got %d %t", index, ok)
+	}
+
+	// a piece in progress is not handed out twice
+	_, ok = p.Pick([]byte{0b00001000})
+	if ok {
+		t.Errorf("expected no piece to be picked while piece 4 is in progress")
+	}
+
+	p.Abort(4)
+	index, ok = p.Pick([]byte{0b00001000})
+	if !ok || index != 4 {
+		t.Errorf("expected aborted piece 4 to be picked again, got %d %t", index, ok)
+	}
+
+	p.Done(4)
+	_, ok = p.Pick([]byte{0b00001000})
+	if ok {
+		t.Errorf("expected a done piece to never be picked again")
+	}
+
+	if p.Remaining() != 3 {
+		t.Errorf("expected 3 pieces to remain, got %d", p.Remaining())
+	}
+}
+
+func TestPickRandomFirst(t *testing.T) {
+	p := New(16)
+	p.AddBitfield([]byte{0xff, 0xff})
+	p.AddBitfield([]byte{0xff, 0xfe})
+
+	// piece 15 is the rarest, but the first pieces are picked at random
+	seen := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		index, ok := p.Pick([]byte{0xff, 0xff})
+		if !ok {
+			t.Fatalf("expected a piece to be picked")
+		}
+		seen[index] = true
+		p.Abort(index)
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("expected random pieces to be picked, got %v", seen)
+	}
+
+	for i := 0; i < randomFirstPieces; i++ {
+		p.Done(i)
+	}
+
+	index, ok := p.Pick([]byte{0xff, 0xff})
+	if !ok || index != 15 {
+		t.Errorf("expected rarest piece 15 once the first pieces are done, got %d %t", index, ok)
+	}
+}
+
+func TestRemoveBitfield(t *testing.T) {
+	p := New(8)
+	for i := 0; i < randomFirstPieces; i++ {
+		p.Done(i)
+	}
+	p.AddBitfield([]byte{0b00001100})
+	p.AddBitfield([]byte{0b00000100})
+
+	// the second peer leaves and one with piece 4 joins, making piece 5 the rarest
+	p.RemoveBitfield([]byte{0b00000100})
+	p.AddBitfield([]byte{0b00001000})
+
+	index, ok := p.Pick([]byte{0b00001100})
+	if !ok || index != 5 {
+		t.Errorf("expected piece 5 to be the rarest, got %d %t", index, ok)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	p := New(4)
+	p.AddBitfield([]byte{0xf0})
+
+	p.Done(0)
+	index, _ := p.Pick([]byte{0xf0})
+	if got := p.Missing(); got != 2 {
+		t.Errorf("expected 2 missing pieces, got %d", got)
+	}
+
+	p.Abort(index)
+	if got := p.Missing(); got != 3 {
+		t.Errorf("expected aborted piece to be missing again, got %d missing pieces", got)
+	}
+}
+
+func TestNeeds(t *testing.T) {
+	p := New(8)
+	p.Done(0)
+	p.Done(1)
+
+	if p.Needs([]byte{0b11000000}) {
+		t.Errorf("expected downloaded pieces to not be needed")
+	}
+
+	// pieces in progress are still needed
+	p.Pick([]byte{0b00100000})
+	if !p.Needs([]byte{0b11100000}) {
+		t.Errorf("expected piece 2 to be needed")
+	}
+}
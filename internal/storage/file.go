@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/xanish/torrenty/internal/metadata"
+)
+
+// File stores the whole piece stream of a torrent in a single file, regardless
+// of the files the torrent is made of.
+type File struct {
+	*pieces
+
+	file *os.File
+}
+
+// OpenFile opens the file at path, creating it and its parent directories if
+// needed, and sizes it to the size of the torrent. Data left by an earlier run
+// is kept.
+func OpenFile(path string, torrent metadata.Metadata) (*File, error) {
+	out, _, err := openSized(path, int64(torrent.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{pieces: newPieces(torrent), file: out}, nil
+}
+
+// ReadBlock fills p with the data of the piece at index starting at begin.
+func (f *File) ReadBlock(index, begin int, p []byte) error {
+	off, err := f.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.file.ReadAt(p, off)
+	if err != nil {
+		return fmt.Errorf("failed reading %d bytes of %s: %w", len(p), f.file.Name(), err)
+	}
+
+	return nil
+}
+
+// WriteBlock writes p to the piece at index starting at begin.
+func (f *File) WriteBlock(index, begin int, p []byte) error {
+	off, err := f.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.file.WriteAt(p, off)
+	if err != nil {
+		return fmt.Errorf("failed writing %d bytes of %s: %w", len(p), f.file.Name(), err)
+	}
+
+	return nil
+}
+
+// Stat returns the size and modification time of the file.
+func (f *File) Stat() ([]FileStat, error) {
+	return statFiles([]*os.File{f.file})
+}
+
+// Flush syncs the file to disk.
+func (f *File) Flush() error {
+	err := f.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %w", f.file.Name(), err)
+	}
+
+	return nil
+}
+
+// Close flushes and closes the file.
+func (f *File) Close() error {
+	err := f.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
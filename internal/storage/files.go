@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/xanish/torrenty/internal/metadata"
+)
+
+// Files stores a torrent in the files it is made of, so that a piece spanning
+// file boundaries is split across every file it belongs to.
+type Files struct {
+	*pieces
+
+	entries []metadata.File
+	files   []*os.File
+
+	// hasData is set when any file held data before it was opened.
+	hasData bool
+}
+
+// OpenFiles opens the files of the torrent inside dir, creating the directory
+// tree and the files that do not exist yet, and sizes each file to its final
+// length. Data left by an earlier run is kept, so that the pieces it holds can
+// be verified instead of being downloaded again, and HasData reports whether
+// there was any.
+func OpenFiles(dir string, torrent metadata.Metadata) (*Files, error) {
+	f := &Files{
+		pieces:  newPieces(torrent),
+		entries: torrent.Files,
+		files:   make([]*os.File, 0, len(torrent.Files)),
+	}
+
+	for _, entry := range torrent.Files {
+		out, existed, err := openSized(filepath.Join(append([]string{dir}, entry.Path...)...), int64(entry.Length))
+		if err != nil {
+			_ = f.close()
+			return nil, err
+		}
+		f.files = append(f.files, out)
+		f.hasData = f.hasData || existed
+	}
+
+	return f, nil
+}
+
+// HasData reports whether any file of the torrent held data when it was
+// opened. Otherwise every file was just created or was empty, so no piece can
+// be complete.
+func (f *Files) HasData() bool {
+	return f.hasData
+}
+
+// ReadBlock fills p with the data of the piece at index starting at begin.
+func (f *Files) ReadBlock(index, begin int, p []byte) error {
+	off, err := f.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.ReadAt(p, off)
+
+	return err
+}
+
+// WriteBlock writes p to the piece at index starting at begin.
+func (f *Files) WriteBlock(index, begin int, p []byte) error {
+	off, err := f.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(p, off)
+
+	return err
+}
+
+// WriteAt writes p at offset off of the piece stream, spreading it over every
+// file that overlaps the range.
+func (f *Files) WriteAt(p []byte, off int64) (int, error) {
+	return span(f.entries, p, off, func(i int, b []byte, fileOff int64) (int, error) {
+		return f.files[i].WriteAt(b, fileOff)
+	})
+}
+
+// ReadAt reads len(p) bytes at offset off of the piece stream, gathering them
+// from every file that overlaps the range.
+func (f *Files) ReadAt(p []byte, off int64) (int, error) {
+	return span(f.entries, p, off, func(i int, b []byte, fileOff int64) (int, error) {
+		return f.files[i].ReadAt(b, fileOff)
+	})
+}
+
+// Stat returns the size and modification time of every file of the torrent.
+func (f *Files) Stat() ([]FileStat, error) {
+	return statFiles(f.files)
+}
+
+// Flush syncs every file of the torrent to disk.
+func (f *Files) Flush() error {
+	for _, file := range f.files {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", file.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// Close flushes and closes every file opened for the torrent.
+func (f *Files) Close() error {
+	err := f.Flush()
+	if closeErr := f.close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (f *Files) close() error {
+	return closeFiles(f.files)
+}
+
+// openSized opens the file at path, creating it and its parent directories if
+// needed, and sizes it to length unless it already has that size. It reports
+// whether the file held any data before.
+func openSized(path string, length int64) (*os.File, bool, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create directory for file %s: %w", path, err)
+	}
+
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not open output file %s: %w", path, err)
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		_ = out.Close()
+		return nil, false, fmt.Errorf("could not stat output file %s: %w", path, err)
+	}
+
+	if info.Size() != length {
+		err = out.Truncate(length)
+		if err != nil {
+			_ = out.Close()
+			return nil, false, fmt.Errorf("could not allocate %d bytes for file %s: %w", length, path, err)
+		}
+	}
+
+	return out, info.Size() > 0, nil
+}
+
+func statFiles(files []*os.File) ([]FileStat, error) {
+	stats := make([]FileStat, 0, len(files))
+	for _, file := range files {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("could not stat output file %s: %w", file.Name(), err)
+		}
+		stats = append(stats, FileStat{Length: info.Size(), MTime: info.ModTime().UnixNano()})
+	}
+
+	return stats, nil
+}
+
+func closeFiles(files []*os.File) error {
+	var firstErr error
+	for _, file := range files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xanish/torrenty/internal/metadata"
+)
+
+// testFiles creates the files of a torrent made of files with the given
+// lengths inside a temporary directory.
+func testFiles(t *testing.T, lengths ...int) (*Files, string) {
+	t.Helper()
+
+	torrent := metadata.Metadata{Name: "dir"}
+	for i, length := range lengths {
+		torrent.Files = append(torrent.Files, metadata.File{
+			Path:   []string{"dir", string(rune('a' + i))},
+			Length: length,
+			Offset: torrent.Size,
+		})
+		torrent.Size += length
+	}
+
+	dir := t.TempDir()
+	f, err := OpenFiles(dir, torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+
+	return f, dir
+}
+
+func TestFilesReadWriteAt(t *testing.T) {
+	tests := []struct {
+		name    string
+		lengths []int
+		off     int64
+		data    string
+		// written is the number of bytes expected to be written when the range
+		// exceeds the torrent size, which fails the write
+		written int
+		// want holds the expected contents of every file after the write
+		want []string
+	}{
+		{
+			name:    "should split a range spanning two files",
+			lengths: []int{4, 6},
+			off:     2,
+			data:    "xxyyy",
+			want:    []string{"\x00\x00xx", "yyy\x00\x00\x00"},
+		},
+		{
+			name:    "should split a range spanning three files",
+			lengths: []int{3, 2, 4},
+			off:     1,
+			data:    "aabbcc",
+			want:    []string{"\x00aa", "bb", "cc\x00\x00"},
+		},
+		{
+			name:    "should skip zero-length files",
+			lengths: []int{2, 0, 0, 3, 0},
+			off:     0,
+			data:    "aabbb",
+			want:    []string{"aa", "", "", "bbb", ""},
+		},
+		{
+			name:    "should write a range ending at a file boundary",
+			lengths: []int{3, 3},
+			off:     3,
+			data:    "bbb",
+			want:    []string{"\x00\x00\x00", "bbb"},
+		},
+		{
+			name:    "should fail on a range past the torrent size",
+			lengths: []int{4, 0, 3},
+			off:     3,
+			data:    "abcdef",
+			written: 4,
+			want:    []string{"\x00\x00\x00a", "", "bcd"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, dir := testFiles(t, tt.lengths...)
+
+			written := len(tt.data)
+			if tt.written > 0 {
+				written = tt.written
+			}
+
+			n, err := f.WriteAt([]byte(tt.data), tt.off)
+			if (err != nil) != (tt.written > 0) {
+				t.Fatalf("expected error only for ranges past the torrent size, got %v", err)
+			}
+			if n != written {
+				t.Errorf("expected %d bytes to be written, got %d", written, n)
+			}
+
+			for i, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dir, "dir", string(rune('a'+i))))
+				if err != nil {
+					t.Fatalf("expected error to be nil, got %v", err)
+				}
+				if string(got) != want {
+					t.Errorf("expected file %d to be %q, got %q", i, want, got)
+				}
+			}
+
+			buf := make([]byte, len(tt.data))
+			n, err = f.ReadAt(buf, tt.off)
+			if (err != nil) != (tt.written > 0) {
+				t.Fatalf("expected error only for ranges past the torrent size, got %v", err)
+			}
+			if n != written || string(buf[:n]) != tt.data[:written] {
+				t.Errorf("expected to read back %q, got %q", tt.data[:written], buf[:n])
+			}
+		})
+	}
+}
+
+func TestFilesSingleFile(t *testing.T) {
+	torrent := metadata.Metadata{
+		Name:  "file.bin",
+		Size:  10,
+		Files: []metadata.File{{Path: []string{"file.bin"}, Length: 10}},
+	}
+
+	dir := t.TempDir()
+	f, err := OpenFiles(dir, torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(f *Files) {
+		_ = f.Close()
+	}(f)
+
+	_, err = f.WriteAt([]byte("0123456789"), 0)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if !bytes.Equal(got, []byte("0123456789")) {
+		t.Errorf("expected file to hold the written data, got %q", got)
+	}
+
+	buf := make([]byte, 4)
+	_, err = f.ReadAt(buf, 6)
+	if err != nil || string(buf) != "6789" {
+		t.Errorf("expected to read %q, got %q (%v)", "6789", buf, err)
+	}
+}
+
+func TestOpenFilesKeepsData(t *testing.T) {
+	torrent := metadata.Metadata{
+		Name: "dir",
+		Size: 10,
+		Files: []metadata.File{
+			{Path: []string{"dir", "a"}, Length: 4},
+			{Path: []string{"dir", "b"}, Length: 6, Offset: 4},
+		},
+	}
+
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "dir"), 0755)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	// a is complete while b was cut short by an interrupted run
+	_ = os.WriteFile(filepath.Join(dir, "dir", "a"), []byte("abcd"), 0666)
+	_ = os.WriteFile(filepath.Join(dir, "dir", "b"), []byte("ef"), 0666)
+
+	f, err := OpenFiles(dir, torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(f *Files) {
+		_ = f.Close()
+	}(f)
+
+	buf := make([]byte, 10)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if string(buf) != "abcdef\x00\x00\x00\x00" {
+		t.Errorf("expected existing data to be kept, got %q", buf)
+	}
+}
+
+func TestOpenFilesHasData(t *testing.T) {
+	torrent := metadata.Metadata{
+		Name:  "file.bin",
+		Size:  10,
+		Files: []metadata.File{{Path: []string{"file.bin"}, Length: 10}},
+	}
+
+	dir := t.TempDir()
+	f, err := OpenFiles(dir, torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	if f.HasData() {
+		t.Errorf("expected files just created to hold no data")
+	}
+	_ = f.Close()
+
+	// the file left sized by the previous run counts as data
+	f, err = OpenFiles(dir, torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	defer func(f *Files) {
+		_ = f.Close()
+	}(f)
+	if !f.HasData() {
+		t.Errorf("expected existing files to hold data")
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"github.com/xanish/torrenty/internal/metadata"
+)
+
+// Memory stores a torrent in memory. Its data is lost once it is dropped.
+type Memory struct {
+	*pieces
+
+	data []byte
+}
+
+// NewMemory returns an empty in-memory storage for the torrent.
+func NewMemory(torrent metadata.Metadata) *Memory {
+	return &Memory{pieces: newPieces(torrent), data: make([]byte, torrent.Size)}
+}
+
+// ReadBlock fills p with the data of the piece at index starting at begin.
+func (m *Memory) ReadBlock(index, begin int, p []byte) error {
+	off, err := m.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	copy(p, m.data[off:])
+
+	return nil
+}
+
+// WriteBlock writes p to the piece at index starting at begin.
+func (m *Memory) WriteBlock(index, begin int, p []byte) error {
+	off, err := m.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	copy(m.data[off:], p)
+
+	return nil
+}
+
+// Flush does nothing, memory is never durable.
+func (m *Memory) Flush() error {
+	return nil
+}
+
+// Close does nothing, the data is released once the storage is dropped.
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+
+	"github.com/xanish/torrenty/internal/metadata"
+)
+
+// Mmap is only available on unix platforms, use Files elsewhere.
+type Mmap struct {
+	*Files
+}
+
+// OpenMmap always fails, memory mapped storage is only available on unix
+// platforms.
+func OpenMmap(dir string, torrent metadata.Metadata) (*Mmap, error) {
+	return nil, errors.New("memory mapped storage is not supported on this platform")
+}
@@ -0,0 +1,134 @@
+//go:build unix
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/xanish/torrenty/internal/metadata"
+	"golang.org/x/sys/unix"
+)
+
+// Mmap stores a torrent in the files it is made of like Files, but accesses
+// them through shared memory mappings instead of read and write calls.
+type Mmap struct {
+	*pieces
+
+	entries []metadata.File
+	files   []*os.File
+	maps    [][]byte
+}
+
+// OpenMmap opens the files of the torrent inside dir like OpenFiles and maps
+// each of them into memory.
+func OpenMmap(dir string, torrent metadata.Metadata) (*Mmap, error) {
+	m := &Mmap{
+		pieces:  newPieces(torrent),
+		entries: torrent.Files,
+		files:   make([]*os.File, 0, len(torrent.Files)),
+		maps:    make([][]byte, 0, len(torrent.Files)),
+	}
+
+	for _, entry := range torrent.Files {
+		path := filepath.Join(append([]string{dir}, entry.Path...)...)
+		out, _, err := openSized(path, int64(entry.Length))
+		if err != nil {
+			_ = m.close()
+			return nil, err
+		}
+		m.files = append(m.files, out)
+
+		// empty files cannot be mapped, span never accesses them anyway
+		var data []byte
+		if entry.Length > 0 {
+			data, err = unix.Mmap(int(out.Fd()), 0, entry.Length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+			if err != nil {
+				_ = m.close()
+				return nil, fmt.Errorf("could not map output file %s: %w", path, err)
+			}
+		}
+		m.maps = append(m.maps, data)
+	}
+
+	return m, nil
+}
+
+// ReadBlock fills p with the data of the piece at index starting at begin.
+func (m *Mmap) ReadBlock(index, begin int, p []byte) error {
+	off, err := m.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	_, err = span(m.entries, p, off, func(i int, b []byte, fileOff int64) (int, error) {
+		return copy(b, m.maps[i][fileOff:]), nil
+	})
+
+	return err
+}
+
+// WriteBlock writes p to the piece at index starting at begin.
+func (m *Mmap) WriteBlock(index, begin int, p []byte) error {
+	off, err := m.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	_, err = span(m.entries, p, off, func(i int, b []byte, fileOff int64) (int, error) {
+		return copy(m.maps[i][fileOff:], b), nil
+	})
+
+	return err
+}
+
+// Stat returns the size and modification time of every file of the torrent.
+func (m *Mmap) Stat() ([]FileStat, error) {
+	return statFiles(m.files)
+}
+
+// Flush syncs the mapped files to disk.
+func (m *Mmap) Flush() error {
+	for i, data := range m.maps {
+		if data == nil {
+			continue
+		}
+
+		err := unix.Msync(data, unix.MS_SYNC)
+		if err != nil {
+			return fmt.Errorf("failed to sync %s: %w", m.files[i].Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// Close flushes and unmaps every file of the torrent before closing it.
+func (m *Mmap) Close() error {
+	err := m.Flush()
+	if closeErr := m.close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (m *Mmap) close() error {
+	var firstErr error
+	for _, data := range m.maps {
+		if data == nil {
+			continue
+		}
+		if err := unix.Munmap(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	m.maps = nil
+
+	if err := closeFiles(m.files); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
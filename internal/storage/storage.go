@@ -0,0 +1,149 @@
+// Package storage exports the backends the pieces of a torrent are downloaded
+// to and seeded from.
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/xanish/torrenty/internal/metadata"
+	"github.com/xanish/torrenty/internal/utility"
+)
+
+// Storage holds the pieces of a torrent, addressed by piece index and offset
+// within the piece. Blocks of different pieces may be read and written
+// concurrently.
+type Storage interface {
+	// ReadBlock fills p with the data of the piece at index starting at begin.
+	ReadBlock(index, begin int, p []byte) error
+
+	// WriteBlock writes p to the piece at index starting at begin.
+	WriteBlock(index, begin int, p []byte) error
+
+	// MarkComplete records that the piece at index was verified and written.
+	MarkComplete(index int) error
+
+	// IsComplete reports whether the piece at index was marked complete.
+	IsComplete(index int) bool
+
+	// Bitfield returns a copy of the bitfield of the pieces marked complete.
+	Bitfield() []byte
+
+	// Flush commits the data written so far to durable storage.
+	Flush() error
+
+	// Close flushes the storage and releases its resources.
+	Close() error
+}
+
+// FileStat is the size and modification time of a file of the torrent, used
+// to tell whether the files changed since they were last seen.
+type FileStat struct {
+	Length int64 `bencode:"length"`
+	MTime  int64 `bencode:"mtime"`
+}
+
+// Stater is implemented by storage backed by files that can report their
+// stats.
+type Stater interface {
+	Stat() ([]FileStat, error)
+}
+
+// pieces maps the blocks of a torrent onto its piece stream and keeps track of
+// the pieces marked complete. It is embedded by every Storage.
+type pieces struct {
+	pieceLength int
+	size        int
+	numPieces   int
+
+	mu       sync.Mutex
+	bitfield []byte
+}
+
+func newPieces(torrent metadata.Metadata) *pieces {
+	return &pieces{
+		pieceLength: torrent.PieceLength,
+		size:        torrent.Size,
+		numPieces:   len(torrent.Pieces),
+		bitfield:    make([]byte, (len(torrent.Pieces)+7)/8),
+	}
+}
+
+// offset returns the offset in the piece stream of the block of n bytes of the
+// piece at index starting at begin.
+func (p *pieces) offset(index, begin, n int) (int64, error) {
+	off := int64(index)*int64(p.pieceLength) + int64(begin)
+	if index < 0 || index >= p.numPieces || begin < 0 || begin+n > p.pieceLength || off+int64(n) > int64(p.size) {
+		return 0, fmt.Errorf("block of %d bytes at %d of piece %d is out of range", n, begin, index)
+	}
+
+	return off, nil
+}
+
+// MarkComplete records that the piece at index was verified and written.
+func (p *pieces) MarkComplete(index int) error {
+	if index < 0 || index >= p.numPieces {
+		return fmt.Errorf("piece %d is out of range", index)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	utility.SetPiece(index, p.bitfield)
+
+	return nil
+}
+
+// IsComplete reports whether the piece at index was marked complete.
+func (p *pieces) IsComplete(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return utility.PieceExists(index, p.bitfield)
+}
+
+// Bitfield returns a copy of the bitfield of the pieces marked complete.
+func (p *pieces) Bitfield() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bitfield := make([]byte, len(p.bitfield))
+	copy(bitfield, p.bitfield)
+
+	return bitfield
+}
+
+// span splits the range of the piece stream starting at off and covering p
+// into the parts belonging to each file of entries and calls fn for each of
+// them, with the index of the file and the offset of the part in the file.
+func span(entries []metadata.File, p []byte, off int64, fn func(i int, b []byte, fileOff int64) (int, error)) (int, error) {
+	done := 0
+	for i, entry := range entries {
+		start := int64(entry.Offset)
+		end := start + int64(entry.Length)
+
+		if end <= off || entry.Length == 0 {
+			continue
+		}
+		if start >= off+int64(len(p)) {
+			break
+		}
+
+		// bytes of p that fall into the current file
+		from := max(start, off) - off
+		to := min(end, off+int64(len(p))) - off
+
+		n, err := fn(i, p[from:to], off+from-start)
+		done += n
+		if err != nil {
+			return done, fmt.Errorf("failed accessing %d bytes of %s: %w", to-from, filepath.Join(entry.Path...), err)
+		}
+	}
+
+	if done != len(p) {
+		return done, fmt.Errorf("range of %d bytes at offset %d exceeds torrent size", len(p), off)
+	}
+
+	return done, nil
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/xanish/torrenty/internal/metadata"
+)
+
+// testTorrent returns a torrent of 3 pieces of 4 bytes, the last one being
+// short, laid out over files of 3, 0 and 7 bytes.
+func testTorrent() metadata.Metadata {
+	return metadata.Metadata{
+		Name:        "dir",
+		Size:        10,
+		PieceLength: 4,
+		Pieces:      make([][20]byte, 3),
+		Files: []metadata.File{
+			{Path: []string{"dir", "a"}, Length: 3},
+			{Path: []string{"dir", "b"}, Length: 0, Offset: 3},
+			{Path: []string{"dir", "c"}, Length: 7, Offset: 3},
+		},
+	}
+}
+
+// backends opens every storage for the torrent, file backed ones inside dir.
+func backends(t *testing.T, dir string, torrent metadata.Metadata) map[string]Storage {
+	t.Helper()
+
+	file, err := OpenFile(filepath.Join(dir, "file", "stream"), torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	files, err := OpenFiles(filepath.Join(dir, "files"), torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	mmap, err := OpenMmap(filepath.Join(dir, "mmap"), torrent)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	return map[string]Storage{
+		"memory": NewMemory(torrent),
+		"file":   file,
+		"files":  files,
+		"mmap":   mmap,
+	}
+}
+
+func TestStorageBlocks(t *testing.T) {
+	torrent := testTorrent()
+
+	for name, store := range backends(t, t.TempDir(), torrent) {
+		t.Run(name, func(t *testing.T) {
+			defer func(store Storage) {
+				_ = store.Close()
+			}(store)
+
+			// blocks of the first piece span the first and the last file
+			writes := []struct {
+				index, begin int
+				data         string
+			}{
+				{0, 2, "cd"},
+				{0, 0, "ab"},
+				{1, 0, "efgh"},
+				{2, 1, "j"},
+				{2, 0, "i"},
+			}
+			for _, w := range writes {
+				err := store.WriteBlock(w.index, w.begin, []byte(w.data))
+				if err != nil {
+					t.Fatalf("expected error to be nil, got %v", err)
+				}
+			}
+
+			for index, want := range []string{"abcd", "efgh", "ij"} {
+				got := make([]byte, len(want))
+				err := store.ReadBlock(index, 0, got)
+				if err != nil {
+					t.Fatalf("expected error to be nil, got %v", err)
+				}
+				if string(got) != want {
+					t.Errorf("expected piece %d to be %q, got %q", index, want, got)
+				}
+			}
+
+			invalid := []struct {
+				name         string
+				index, begin int
+				length       int
+			}{
+				{"should reject a negative index", -1, 0, 1},
+				{"should reject an index past the last piece", 3, 0, 1},
+				{"should reject a block past the end of the piece", 0, 3, 2},
+				{"should reject a block past the end of the torrent", 2, 1, 2},
+			}
+			for _, tt := range invalid {
+				if err := store.WriteBlock(tt.index, tt.begin, make([]byte, tt.length)); err == nil {
+					t.Errorf("%s on write", tt.name)
+				}
+				if err := store.ReadBlock(tt.index, tt.begin, make([]byte, tt.length)); err == nil {
+					t.Errorf("%s on read", tt.name)
+				}
+			}
+
+			if err := store.Flush(); err != nil {
+				t.Errorf("expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStorageMarkComplete(t *testing.T) {
+	torrent := testTorrent()
+
+	for name, store := range backends(t, t.TempDir(), torrent) {
+		t.Run(name, func(t *testing.T) {
+			defer func(store Storage) {
+				_ = store.Close()
+			}(store)
+
+			for _, index := range []int{0, 2} {
+				err := store.MarkComplete(index)
+				if err != nil {
+					t.Fatalf("expected error to be nil, got %v", err)
+				}
+			}
+
+			if store.IsComplete(1) || !store.IsComplete(2) {
+				t.Errorf("expected only the marked pieces to be complete")
+			}
+			if got := store.Bitfield(); !bytes.Equal(got, []byte{0b10100000}) {
+				t.Errorf("expected bitfield %08b, got %08b", 0b10100000, got)
+			}
+			if err := store.MarkComplete(3); err == nil {
+				t.Errorf("expected marking a piece past the last one to fail")
+			}
+		})
+	}
+}
+
+func TestStorageKeepsData(t *testing.T) {
+	torrent := testTorrent()
+	dir := t.TempDir()
+
+	for name, store := range backends(t, dir, torrent) {
+		if name == "memory" {
+			_ = store.Close()
+			continue
+		}
+
+		err := store.WriteBlock(0, 0, []byte("abcd"))
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+	}
+
+	for name, store := range backends(t, dir, torrent) {
+		t.Run(name, func(t *testing.T) {
+			defer func(store Storage) {
+				_ = store.Close()
+			}(store)
+			if name == "memory" {
+				t.Skip("memory storage is not persisted")
+			}
+
+			got := make([]byte, 4)
+			err := store.ReadBlock(0, 0, got)
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+			if string(got) != "abcd" {
+				t.Errorf("expected data of the earlier run to be kept, got %q", got)
+			}
+
+			stater, ok := store.(Stater)
+			if !ok {
+				t.Fatalf("expected file backed storage to report file stats")
+			}
+			stats, err := stater.Stat()
+			if err != nil {
+				t.Fatalf("expected error to be nil, got %v", err)
+			}
+
+			var size int64
+			for _, stat := range stats {
+				size += stat.Length
+			}
+			if size != int64(torrent.Size) {
+				t.Errorf("expected files to hold %d bytes, got %d", torrent.Size, size)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package utility
 import (
 	"crypto/rand"
 	"fmt"
+	"os"
+	"path/filepath"
 )
 
 func PeerID() ([20]byte, error) {
@@ -37,3 +39,34 @@ func SetPiece(index int, bitfield []byte) {
 
 	bitfield[byteIndex] |= 1 << uint(7-offset)
 }
+
+// WriteFileAtomic writes data to the file at path through a temporary file in
+// the same directory, synced to disk before it replaces the file, so that a
+// crash leaves either the previous content or the new one.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	return nil
+}
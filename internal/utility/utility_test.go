@@ -2,6 +2,8 @@ package utility
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -65,3 +67,25 @@ func TestSetPiece(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+
+	for _, data := range []string{"first", "second"} {
+		err := WriteFileAtomic(path, []byte(data))
+		if err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != data {
+			t.Errorf("expected file to hold %q, got %q (%v)", data, got, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected the temporary files to be removed, got %d entries", len(entries))
+	}
+}
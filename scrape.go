@@ -0,0 +1,103 @@
+package torrenty
+
+import (
+	"context"
+	"io"
+
+	"github.com/xanish/torrenty/internal/magnet"
+	"github.com/xanish/torrenty/internal/metadata"
+)
+
+// TorrentInfo describes a torrent along with the health of its swarm, as
+// reported by its trackers.
+type TorrentInfo struct {
+	InfoHash [20]byte
+	Name     string
+
+	// Size is the size of the torrent in bytes, and Pieces its number of
+	// pieces. Both are zero for magnet links, whose info dictionary is not
+	// fetched.
+	Size   int
+	Pieces int
+
+	// Trackers holds the scrape of every tracker of the torrent.
+	Trackers []TrackerStats
+}
+
+// TrackerStats is the health of the swarm of a torrent reported by one of its
+// trackers.
+type TrackerStats struct {
+	URL string
+
+	// Seeders and Leechers are the number of peers with the complete torrent
+	// and with parts of it, and Completed the number of times it was
+	// downloaded in full.
+	Seeders   int
+	Leechers  int
+	Completed int
+
+	// Err is the error scraping the tracker failed with, in which case the
+	// counts are zero.
+	Err error
+}
+
+// Scrape asks the trackers of the torrent described by the .torrent file read
+// from r how many peers share it, without downloading anything. Cancelling ctx
+// aborts the pending scrapes.
+func Scrape(ctx context.Context, r io.Reader) (*TorrentInfo, error) {
+	torrent, err := metadata.New(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TorrentInfo{
+		InfoHash: torrent.InfoHash,
+		Name:     torrent.Name,
+		Size:     torrent.Size,
+		Pieces:   len(torrent.Pieces),
+	}
+
+	return scrape(ctx, &torrent, info)
+}
+
+// ScrapeMagnet asks the trackers listed in a magnet uri how many peers share
+// the torrent it refers to. Cancelling ctx aborts the pending scrapes.
+func ScrapeMagnet(ctx context.Context, uri string) (*TorrentInfo, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	trackers := make([][]string, 0, len(m.Trackers))
+	for _, tracker := range m.Trackers {
+		trackers = append(trackers, []string{tracker})
+	}
+
+	torrent := metadata.Metadata{Name: m.Name, InfoHash: m.InfoHash, Trackers: trackers}
+	info := &TorrentInfo{
+		InfoHash: m.InfoHash,
+		Name:     m.Name,
+	}
+
+	return scrape(ctx, &torrent, info)
+}
+
+// scrape fills the tracker stats of info by scraping the trackers of torrent.
+func scrape(ctx context.Context, torrent *metadata.Metadata, info *TorrentInfo) (*TorrentInfo, error) {
+	results, err := torrent.Scrape(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range results {
+		info.Trackers = append(info.Trackers, TrackerStats{
+			URL:       r.Tracker,
+			Seeders:   r.Stats.Seeders,
+			Leechers:  r.Stats.Leechers,
+			Completed: r.Stats.Completed,
+			Err:       r.Err,
+		})
+	}
+
+	return info, nil
+}
@@ -0,0 +1,40 @@
+package torrenty
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestScrapeMagnet(t *testing.T) {
+	infoHash := [20]byte{0xaa, 0xbb}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files := "d20:" + string(infoHash[:]) + "d8:completei2e10:downloadedi9e10:incompletei4eee"
+		_, _ = w.Write([]byte("d5:files" + files + "e"))
+	}))
+	defer srv.Close()
+
+	uri := "magnet:?xt=urn:btih:aabb000000000000000000000000000000000000&dn=test" +
+		"&tr=" + url.QueryEscape(srv.URL+"/announce") +
+		"&tr=" + url.QueryEscape(srv.URL+"/tracker")
+
+	info, err := ScrapeMagnet(context.Background(), uri)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+
+	if info.InfoHash != infoHash || info.Name != "test" || len(info.Trackers) != 2 {
+		t.Fatalf("unexpected torrent info %+v", info)
+	}
+
+	got := info.Trackers[0]
+	if got.Err != nil || got.Seeders != 2 || got.Leechers != 4 || got.Completed != 9 {
+		t.Errorf("expected 2 seeders, 4 leechers and 9 downloads, got %+v", got)
+	}
+
+	if info.Trackers[1].Err == nil {
+		t.Errorf("expected scraping a tracker without scrape url to fail")
+	}
+}
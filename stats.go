@@ -0,0 +1,112 @@
+package torrenty
+
+import (
+	"time"
+)
+
+const (
+	// rateWindow is the period transfer rates are averaged over.
+	rateWindow = 5 * time.Second
+
+	// sampleInterval is how often the transfer counters are sampled for
+	// computing the rates.
+	sampleInterval = time.Second
+)
+
+// Stats is a snapshot of the progress of a torrent.
+type Stats struct {
+	State State
+
+	// Size is the size of the torrent in bytes, and Completed the number of
+	// bytes of the verified pieces on disk.
+	Size      int64
+	Completed int64
+
+	// Downloaded and Uploaded are the number of piece bytes received from and
+	// sent to peers since the torrent was added.
+	Downloaded int64
+	Uploaded   int64
+
+	// DownloadRate and UploadRate are the transfer rates in bytes per second,
+	// averaged over the last few seconds.
+	DownloadRate float64
+	UploadRate   float64
+
+	// Peers is the number of connected peers.
+	Peers int
+
+	// ETA is the estimated time left until the download completes, zero when
+	// it is complete or nothing is being downloaded.
+	ETA time.Duration
+}
+
+// sample is a reading of the transfer counters of a torrent.
+type sample struct {
+	at         time.Time
+	downloaded int64
+	uploaded   int64
+}
+
+// Stats returns a snapshot of the progress of the torrent.
+func (t *Torrent) Stats() Stats {
+	now := t.current()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := Stats{
+		State:      t.state,
+		Size:       int64(t.size),
+		Completed:  t.stats.Completed.Load(),
+		Downloaded: now.downloaded,
+		Uploaded:   now.uploaded,
+		Peers:      int(t.stats.Peers.Load()),
+	}
+
+	if len(t.samples) > 0 {
+		base := t.samples[0]
+		if elapsed := now.at.Sub(base.at).Seconds(); elapsed > 0 {
+			stats.DownloadRate = float64(now.downloaded-base.downloaded) / elapsed
+			stats.UploadRate = float64(now.uploaded-base.uploaded) / elapsed
+		}
+	}
+
+	if left := stats.Size - stats.Completed; left > 0 && stats.DownloadRate > 0 {
+		stats.ETA = time.Duration(float64(left) / stats.DownloadRate * float64(time.Second))
+	}
+
+	return stats
+}
+
+// current reads the transfer counters of the torrent.
+func (t *Torrent) current() sample {
+	return sample{
+		at:         time.Now(),
+		downloaded: t.stats.Downloaded.Load(),
+		uploaded:   t.stats.Uploaded.Load(),
+	}
+}
+
+// sampleRates samples the transfer counters every sampleInterval until the
+// torrent stops, keeping the samples of the last rateWindow.
+func (t *Torrent) sampleRates() {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+
+		s := t.current()
+
+		t.mu.Lock()
+		t.samples = append(t.samples, s)
+		for len(t.samples) > 1 && s.at.Sub(t.samples[1].at) >= rateWindow {
+			t.samples = t.samples[1:]
+		}
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,407 @@
+package torrenty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xanish/torrenty/internal/downloader"
+	"github.com/xanish/torrenty/internal/logger"
+	"github.com/xanish/torrenty/internal/magnet"
+	"github.com/xanish/torrenty/internal/metadata"
+	"github.com/xanish/torrenty/internal/peer"
+	"github.com/xanish/torrenty/internal/storage"
+	"github.com/xanish/torrenty/internal/utility"
+)
+
+// ErrStopped is returned by Torrent.Wait when the torrent was removed, or the
+// context it was added with was cancelled, before its download completed.
+var ErrStopped = errors.New("torrent stopped")
+
+// Torrent is a torrent added to a Client.
+type Torrent struct {
+	client   *Client
+	infoHash [20]byte
+
+	mu      sync.Mutex
+	name    string
+	size    int
+	state   State
+	samples []sample
+
+	stats  downloader.Stats
+	events chan Event
+
+	// tracker announces the torrent, it is only used by the goroutine
+	// running the torrent and the announcer it starts. search looks up its
+	// peers on the DHT of the client, if it runs one.
+	tracker announcer
+	search  dhtSearch
+
+	// ctx bounds the lifetime of the torrent, it is cancelled with
+	// ErrStopped when the torrent is removed.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	err    error
+}
+
+func newTorrent(ctx context.Context, c *Client, infoHash [20]byte, name string, size int, state State) *Torrent {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	t := &Torrent{
+		client:   c,
+		infoHash: infoHash,
+		name:     name,
+		size:     size,
+		state:    state,
+		samples:  []sample{{at: time.Now()}},
+		events:   make(chan Event, eventBuffer),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	t.tracker.t = t
+	t.search.t = t
+
+	return t
+}
+
+// InfoHash returns the info-hash identifying the torrent.
+func (t *Torrent) InfoHash() [20]byte {
+	return t.infoHash
+}
+
+// Name returns the name of the torrent, which may be empty for a magnet link
+// until its metadata has been fetched.
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.name
+}
+
+// Size returns the size of the torrent in bytes, which is zero for a magnet
+// link until its metadata has been fetched.
+func (t *Torrent) Size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.size
+}
+
+// Done returns a channel closed once the torrent stops, either because its
+// download completed, because it failed or because it was removed. A torrent
+// seeding once complete only stops when removed, or when the context it was
+// added with is cancelled.
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+// Events returns the channel the events of the torrent are delivered on,
+// which is closed once the torrent stops. Events are dropped while the channel
+// is full, so it should be read continuously. Stats reports the progress of
+// the torrent regardless.
+func (t *Torrent) Events() <-chan Event {
+	return t.events
+}
+
+// Wait blocks until the torrent stops and returns the error it failed with,
+// an error wrapping ErrStopped if it was stopped before completing, or nil.
+// If ctx is done first, Wait returns the error of ctx and the torrent keeps
+// running.
+func (t *Torrent) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Torrent) stop() {
+	t.cancel(ErrStopped)
+}
+
+// run runs fn, recording its error, and removes the torrent from its client
+// once it returns. An error caused by the torrent being stopped is reported
+// as ErrStopped, along with the cause of the cancellation when the context the
+// torrent was added with ended.
+func (t *Torrent) run(fn func() error) {
+	go t.sampleRates()
+
+	err := fn()
+	if err != nil && t.ctx.Err() != nil {
+		cause := context.Cause(t.ctx)
+		if cause == ErrStopped {
+			err = ErrStopped
+		} else {
+			err = fmt.Errorf("%w: %w", ErrStopped, cause)
+		}
+	}
+	t.cancel(nil)
+
+	t.err = err
+	if t.err != nil {
+		logger.Log(logger.Error, "torrent %x stopped: %s", t.infoHash, t.err)
+	}
+
+	t.client.mu.Lock()
+	if t.client.torrents[t.infoHash] == t {
+		delete(t.client.torrents, t.infoHash)
+	}
+	t.client.mu.Unlock()
+
+	t.setState(Stopped)
+	close(t.events)
+	close(t.done)
+}
+
+// downloadMagnet fetches the info dictionary of the torrent referred to by m
+// and downloads it.
+func (t *Torrent) downloadMagnet(m *magnet.Magnet) error {
+	c := t.client
+	t.setState(FetchingMetadata)
+
+	// Magnet links carry no tiers, so every tracker is placed in its own tier
+	// in order for all of them to be queried.
+	trackers := make([][]string, 0, len(m.Trackers))
+	for _, tracker := range m.Trackers {
+		trackers = append(trackers, []string{tracker})
+	}
+
+	torrent := metadata.Metadata{Name: m.Name, InfoHash: m.InfoHash, Trackers: trackers}
+	defer t.tracker.stop(t.ctx, &torrent)
+
+	peers := m.Peers
+	refreshInterval := 0
+	if len(trackers) > 0 {
+		tr, err := t.tracker.announce(t.ctx, &torrent, metadata.EventStarted, nil)
+		if err != nil {
+			logger.Log(logger.Warning, "failed to fetch peers from trackers: %s", err)
+		} else {
+			peers = mergePeers(peers, tr.Peers)
+			refreshInterval = tr.RefreshInterval
+		}
+	}
+
+	if c.dht != nil && c.joinedDHT(t.ctx) {
+		found, err := c.dht.GetPeers(t.ctx, m.InfoHash)
+		if err != nil {
+			logger.Log(logger.Warning, "failed to look up peers on the dht: %s", err)
+		} else {
+			logger.Log(logger.Info, "found %d peers on the dht", len(found))
+			peers = mergePeers(peers, found)
+		}
+	}
+
+	logger.Log(logger.Info, "fetching metadata from %d peers", len(peers))
+	info, err := magnet.Fetch(t.ctx, m.InfoHash, c.peerID, uint16(c.Port()), peers)
+	if err != nil {
+		return err
+	}
+
+	torrent, err = metadata.NewFromInfo(info, trackers)
+	if err != nil {
+		return err
+	}
+	torrent.SetPeers(peers)
+	torrent.SetRefreshInterval(refreshInterval)
+
+	return t.download(torrent)
+}
+
+// download downloads the torrent into the data directory of the client from
+// its peers, announcing to its trackers first unless its peers are already
+// known. The trackers are announced to periodically while the torrent runs,
+// and so is the DHT of the client, and the peers they return are fed into the
+// download. With a DHT the download starts without peers, waiting for the
+// ones found on the DHT.
+func (t *Torrent) download(torrent metadata.Metadata) error {
+	c := t.client
+
+	t.mu.Lock()
+	t.name, t.size = torrent.Name, torrent.Size
+	t.mu.Unlock()
+	t.setState(Checking)
+
+	out, err := storage.OpenFiles(c.opts.DataDir, torrent)
+	if err != nil {
+		return err
+	}
+	defer func(out *storage.Files) {
+		_ = out.Close()
+	}(out)
+
+	resumePath := filepath.Join(c.opts.DataDir, torrent.Name+".resume")
+	partial, err := existingData(t.ctx, torrent, out, resumePath)
+	if err != nil {
+		return err
+	}
+
+	completed := completedBytes(torrent, out)
+	t.stats.Completed.Store(completed)
+	if completed < int64(torrent.Size) {
+		t.tracker.completed = make(chan struct{})
+	}
+
+	if len(torrent.Peers) == 0 {
+		tr, err := t.tracker.announce(t.ctx, &torrent, metadata.EventStarted, nil)
+		if err != nil && !complete(torrent, out) && c.dht == nil {
+			return fmt.Errorf("failed to fetch peers from trackers: %w", err)
+		}
+		if err != nil {
+			logger.Log(logger.Warning, "failed to fetch peers from trackers: %s", err)
+		} else {
+			logger.Log(logger.Info, "successfully fetched %d peers from tracker", len(tr.Peers))
+			torrent.SetPeers(tr.Peers)
+			torrent.SetRefreshInterval(tr.RefreshInterval)
+		}
+	}
+
+	// A complete torrent is seeded to the peers connecting to us even when
+	// the trackers know of no other peer.
+	if len(torrent.Peers) == 0 && !complete(torrent, out) && c.dht == nil {
+		return fmt.Errorf("no peers found")
+	}
+
+	ext := peer.NewExtensions()
+	ext.Version = clientVersion
+	ext.Port = uint16(c.Port())
+	ext.Reqq = c.opts.MaxPeerRequests
+	if c.dht != nil {
+		ext.DHTPort = uint16(c.dht.Port())
+	}
+
+	// Accept connections from peers that learned about us from the trackers.
+	incoming := make(chan *peer.Connection)
+	finished := make(chan struct{})
+	defer close(finished)
+
+	c.listener.Register(torrent.InfoHash, ext, func(conn *peer.Connection) {
+		select {
+		case incoming <- conn:
+		case <-finished:
+			_ = conn.Conn.Close()
+		}
+	})
+	defer c.listener.Unregister(torrent.InfoHash)
+
+	// Announce periodically while the torrent runs, and tell the trackers
+	// about the shutdown once it stops.
+	peers := make(chan []peer.Peer)
+	if hasTrackers(&torrent) {
+		t.tracker.needed = make(chan struct{}, 1)
+		ctx, cancel := context.WithCancel(t.ctx)
+		announcing := make(chan struct{})
+		go func() {
+			defer close(announcing)
+			t.tracker.run(ctx, &torrent, peers)
+		}()
+		defer func() {
+			cancel()
+			<-announcing
+			t.tracker.stop(t.ctx, &torrent)
+		}()
+	}
+
+	// Look up peers on the DHT while the torrent runs.
+	if c.dht != nil {
+		t.search.needed = make(chan struct{}, 1)
+		ctx, cancel := context.WithCancel(t.ctx)
+		searching := make(chan struct{})
+		go func() {
+			defer close(searching)
+			t.search.run(ctx, torrent.InfoHash, peers)
+		}()
+		defer func() {
+			cancel()
+			<-searching
+		}()
+	}
+
+	logger.Log(logger.Info, "initiating download")
+	t.setState(Downloading)
+
+	return downloader.Download(t.ctx, c.peerID, torrent, out, downloader.Options{
+		Extensions:  ext,
+		Incoming:    incoming,
+		Peers:       peers,
+		Seed:        c.opts.Seed,
+		Progress:    c.opts.Progress,
+		Partial:     partial,
+		ResumePath:  resumePath,
+		MaxRequests: c.opts.MaxRequests,
+		MaxPeers:    c.opts.MaxPeers,
+		PreferIPv6:  c.opts.PreferIPv6,
+		Events:      t.downloadEvent,
+		Stats:       &t.stats,
+	})
+}
+
+// announced emits a TrackerAnnounced event with the result of announcing to
+// the trackers.
+func (t *Torrent) announced(tr *metadata.Response, err error) {
+	e := Event{Type: TrackerAnnounced, Err: err}
+	if tr != nil {
+		e.Peers = len(tr.Peers)
+	}
+	t.emit(e)
+}
+
+// complete reports whether every piece of the torrent is marked complete in
+// store.
+func complete(torrent metadata.Metadata, store storage.Storage) bool {
+	return completedBytes(torrent, store) == int64(torrent.Size)
+}
+
+// completedBytes returns the number of bytes of the pieces of the torrent
+// marked complete in store.
+func completedBytes(torrent metadata.Metadata, store storage.Storage) int64 {
+	var n int64
+	for index := range torrent.Pieces {
+		if store.IsComplete(index) {
+			n += int64(torrent.PieceSize(index))
+		}
+	}
+
+	return n
+}
+
+// existingData marks complete the pieces left in out by an earlier run, and
+// returns the blocks of its unfinished pieces. The resume data saved at
+// resumePath is trusted when the files were not modified since it was saved,
+// otherwise every piece is verified so that only the missing ones are
+// downloaded. Nothing is checked when the files held no data.
+func existingData(ctx context.Context, torrent metadata.Metadata, out *storage.Files, resumePath string) ([]downloader.PartialPiece, error) {
+	if !out.HasData() {
+		logger.Log(logger.Info, "no existing data to check")
+		return nil, nil
+	}
+
+	resume, err := downloader.LoadResume(resumePath)
+	if err == nil {
+		stats, err := out.Stat()
+		if err == nil && resume.Matches(torrent.InfoHash, len(torrent.Pieces), stats) {
+			logger.Log(logger.Info, "resuming from %s", resumePath)
+			for index := range torrent.Pieces {
+				if utility.PieceExists(index, []byte(resume.Bitfield)) {
+					_ = out.MarkComplete(index)
+				}
+			}
+
+			return resume.Partial, nil
+		}
+	}
+
+	logger.Log(logger.Info, "checking existing data")
+	err = downloader.Verify(ctx, torrent, out)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}